@@ -0,0 +1,11 @@
+// Package assets holds the css, js, images and templates used by the
+// frontend. They are compiled into the binary so that it can be run from any
+// directory without having to ship the asset tree alongside it.
+package assets
+
+import "embed"
+
+// FS contains everything under the assets directory
+//
+//go:embed css fonts images js templates
+var FS embed.FS
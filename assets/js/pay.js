@@ -144,49 +144,44 @@ function getURLParameters() {
 function checkResponse(response) {
   var response = response;
   logger.info("Response From Server: " + response)
+
+  // the register has to be re-keyed before it can take payments, the sale is
+  // kept so it can be retried afterwards
+  if (response.redirect_url) {
+    window.location = response.redirect_url
+    return
+  }
+
+  // failed requests tell us which step to send to Vend
+  switch (response.step) {
+    case 'RETRY':
+      // nothing was taken, so the cashier can correct the code and try again
+      showOutcome(response.html)
+      $('#outcomes').show()
+      return
+    case 'EXIT':
+      showOutcome(response.html)
+
+      setTimeout(exitStep, 4000)
+      return
+  }
+
   switch (response.status) {
     case 'ACCEPTED':
         $('#statusMessage').empty()
-        var receiptHTML = '';
         console.debug(response)
-        
-        if (typeof(response.id) != 'undefined') {
-            receiptHTML = `
-            <div>
-                <h2>APPROVED</h2>
-                <span>Oxipay Purchase #: ` + response.id+ ` </span>
-            </div>`;
-        }
-      
-        acceptStep(receiptHTML, response.id)
+
+        acceptStep(response.receipt_html || '', response.transaction_id || response.id)
       break
     case 'DECLINED':
-      $('#statusMessage').empty()
-      $.get('/assets/templates/declined.html', function (data) {
-        data = data.replace("${response.status}", response.status.toLowerCase());
-        data = data.replace("${response.message}", response.message);
-
-        $('#statusMessage').append(data)
-      })
+      showOutcome(response.html)
 
-      setTimeout(declineStep, 4000, '<div>Declined</div>')
+      setTimeout(declineStep, 4000, response.receipt_html || '<div>Declined</div>')
       break
     case 'FAILED':
-      
-      $('#statusMessage').empty()
-      $.get('/assets/templates/failed.html', function (data) {
-        response.message = response.message? response.message: "" 
-        data = data.replace("${response.status}", response.status.toLowerCase());
-        data = data.replace("${response.message}", response.message);
-        $('#statusMessage').append(data)
-      })
-      receiptHTML = `
-        <div>
-            <h2>DECLINED</h2>
-            <span> ` + response.message + `</span>
-        </div>`;
+      showOutcome(response.html)
 
-      setTimeout(declineStep, 4000, receiptHTML)
+      setTimeout(declineStep, 4000, response.receipt_html || '<div>Declined</div>')
       break
     case 'TIMEOUT':
       $('#statusMessage').empty()
@@ -197,16 +192,35 @@ function checkResponse(response) {
       setTimeout(declineStep, 4000,'<div>TIMEOUT</div>')
       break
     default:
-      $('#statusMessage').empty()
-      $.get('../assets/templates/failed.html', function (data) {
-        $('#statusMessage').append(data)
-      })
+      showOutcome(response.html)
 
-      setTimeout(declineStep, 4000, receiptHTML)
+      setTimeout(declineStep, 4000, response.receipt_html || '')
       break
   }
 }
 
+// showOutcome displays the outcome page rendered by the server. If the server
+// didn't send one we show a generic failure.
+function showOutcome(html) {
+  $('#statusMessage').empty()
+  if (html) {
+    $('#statusMessage').append(html)
+    return
+  }
+
+  $.get('/assets/templates/error.html', function (data) {
+    $('#statusMessage').append(data)
+  })
+}
+
+// outcomeFromError pulls the rendered outcome out of a failed ajax request
+function outcomeFromError(error) {
+  if (error && error.responseJSON) {
+    return error.responseJSON.html
+  }
+  return undefined
+}
+
 var refundDataResponseListener = function (event) {
     
     var result = getURLParameters()
@@ -232,7 +246,7 @@ var refundDataResponseListener = function (event) {
     };
     
     $.ajax({
-        url: '/refund',
+        url: '/api/v1/refunds',
         type: 'POST',
         dataType: 'json',
         data: data
@@ -251,10 +265,11 @@ var refundDataResponseListener = function (event) {
 
         // Make sure status text is cleared.
         $('#outcomes').hide()
-        $('#statusMessage').empty()
-        $.get('../assets/templates/failed.html', function (data) {
-          $('#statusMessage').append(data)
-        })
+        if (error && error.responseJSON) {
+          checkResponse(error.responseJSON)
+          return
+        }
+        showOutcome(outcomeFromError(error))
         // Quit window, giving cashier chance to try again.
         setTimeout(declineStep, 4000)
     })
@@ -285,15 +300,12 @@ var paymentDataResponseListener = function (event) {
     // If we did not at least two query params from Vend something is wrong.
     if (Object.keys(result).length < 2) {
       logger.logger('did not get at least two query results')
-      $('#statusMessage').empty()
-      $.get('../assets/templates/failed.html', function (data) {
-        $('#statusMessage').append(data)
-      })
+      showOutcome()
       setTimeout(exitStep(), 4000)
     }
     
     $.ajax({
-        url: '/pay',
+        url: '/api/v1/payments',
         type: 'POST',
         dataType: 'json',
         data: {
@@ -319,10 +331,11 @@ var paymentDataResponseListener = function (event) {
   
         // Make sure status text is cleared.
         $('#outcomes').hide()
-        $('#statusMessage').empty()
-        $.get('../assets/templates/failed.html', function (data) {
-            $('#statusMessage').append(data)
-        })
+        if (error && error.responseJSON) {
+          checkResponse(error.responseJSON)
+          return
+        }
+        showOutcome(outcomeFromError(error))
         // Quit window, giving cashier chance to try again.
         setTimeout(declineStep, 4000)
       })
@@ -349,10 +362,7 @@ function sendRefund() {
     // If we did not at least two query params from Vend something is wrong.
     if (Object.keys(result).length < 2) {
       logger.error('did not get at least two query results')
-      $('#statusMessage').empty()
-      $.get('../assets/templates/failed.html', function (data) {
-        $('#statusMessage').append(data)
-      })
+      showOutcome()
       setTimeout(exitStep(), 4000)
     }
   
@@ -399,10 +409,7 @@ function sendPayment() {
     // If we did not at least two query params from Vend something is wrong.
     if (Object.keys(result).length < 2) {
       logger.logger('did not get at least two query results')
-      $('#statusMessage').empty()
-      $.get('../assets/templates/failed.html', function (data) {
-        $('#statusMessage').append(data)
-      })
+      showOutcome()
       setTimeout(exitStep(), 4000)
     }
   
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/bulk"
+	"github.com/oxipay/oxipay-vend/internal/pkg/i18n"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// MaxUploadSize is the largest register file the admin API accepts
+const MaxUploadSize = 1 << 20
+
+// pairRow registers the device for a row of a bulk upload with Oxipay and
+// pairs it with the Vend register
+func pairRow(row bulk.Row) bulk.Result {
+	_, err := term.GetRegister(row.Origin, row.RegisterID)
+	switch {
+	case err == nil || errors.Is(err, terminal.ErrAmbiguous):
+		return bulk.Result{Status: bulk.Skipped, Message: "the register is already paired"}
+	case !errors.Is(err, terminal.ErrNotFound):
+		return bulk.Result{Status: bulk.Failed, Message: err.Error()}
+	}
+
+	registrationPayload := newRegistrationPayload(row.MerchantID, row.DeviceToken)
+	if err := registrationPayload.Validate(); err != nil {
+		return bulk.Result{Status: bulk.Failed, Message: err.Error()}
+	}
+
+	locale := row.Locale
+	if !messages.Supports(locale) {
+		locale = ""
+	}
+
+	outletID := registerOutlet(context.Background(), row.Origin, row.RegisterID)
+	register, response := pairRegister(registrationPayload, row.Origin, row.RegisterID, outletID, locale, "bulk-import", &Response{
+		Locale: i18n.DefaultLocale,
+		Brand:  brandFor(row.MerchantID),
+	})
+	if register == nil {
+		return bulk.Result{Status: bulk.Failed, Message: response.Message}
+	}
+	return bulk.Result{Status: bulk.Paired, DeviceID: register.FxlRegisterID}
+}
+
+// importRegisters pairs every register in the upload
+func importRegisters(rows []bulk.Row, concurrency int) bulk.Report {
+	report := bulk.Run(rows, concurrency, pairRow)
+
+	log.WithFields(logrus.Fields{
+		"module":  "bulk",
+		"rows":    len(rows),
+		"paired":  report.Summary[bulk.Paired],
+		"failed":  report.Summary[bulk.Failed],
+		"skipped": report.Summary[bulk.Skipped],
+	}).Info("Imported registers")
+	return report
+}
+
+func writeImportReport(out io.Writer, format string, report bulk.Report) error {
+	if format == "json" {
+		return bulk.WriteJSON(out, report)
+	}
+	return bulk.WriteCSV(out, report)
+}
+
+// ImportRegistersHandler pairs the registers in an uploaded CSV file. The file
+// is the body of the request or the "file" field of a form. It is part of the
+// admin API
+func ImportRegistersHandler(w http.ResponseWriter, r *http.Request) {
+	if appConfig == nil || appConfig.Admin.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !authorisedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vendproxy"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, fmt.Sprintf("unknown format %q, use csv or json", format), http.StatusBadRequest)
+		return
+	}
+
+	concurrency := bulk.DefaultConcurrency
+	if value := query.Get("concurrency"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "concurrency must be a positive number", http.StatusBadRequest)
+			return
+		}
+		concurrency = n
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	var file io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		upload, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "the form has no file", http.StatusBadRequest)
+			return
+		}
+		defer upload.Close()
+		file = upload
+	}
+
+	rows, err := bulk.ReadRows(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := importRegisters(rows, concurrency)
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	writeImportReport(w, format, report)
+}
+
+func importRegistersCommand(opts *options, file string, out io.Writer) int {
+	if opts.format != "csv" && opts.format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %s, use csv or json\n", opts.format)
+		return 2
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+	appConfig = hostConfig
+
+	defer connectServices(hostConfig)()
+
+	if hostConfig.Oxipay.ResponseCodes != "" {
+		if responseCodes, err = oxipay.LoadResponseCatalogue(hostConfig.Oxipay.ResponseCodes); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+
+	rows, err := bulk.ReadRows(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return 1
+	}
+
+	report := importRegisters(rows, opts.concurrency)
+	if err := writeImportReport(out, opts.format, report); err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "%d paired, %d failed, %d skipped\n", report.Summary[bulk.Paired], report.Summary[bulk.Failed], report.Summary[bulk.Skipped])
+	if report.Summary[bulk.Failed] > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestImportRegistersHandler(t *testing.T) {
+	savedConfig, savedLog := appConfig, log
+	defer func() { appConfig, log = savedConfig, savedLog }()
+
+	token := "0123456789abcdef0123456789abcdef"
+	appConfig = &config.HostConfig{Admin: config.AdminConfig{Token: token}}
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	// none of these rows are complete so nothing is sent to Oxipay
+	upload := "origin,register_id,merchant_id,device_token\nhttps://example.vendhq.com,r1,30188105,\n,r2,30188105,token\n"
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("file", "registers.csv")
+	part.Write([]byte(upload))
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		auth        string
+		contentType string
+		body        string
+		expected    int
+	}{
+		{"no token", "", "text/csv", upload, http.StatusUnauthorized},
+		{"bad file", "Bearer " + token, "text/csv", "origin\nhttps://example.vendhq.com\n", http.StatusBadRequest},
+		{"csv body", "Bearer " + token, "text/csv", upload, http.StatusOK},
+		{"form upload", "Bearer " + token, mw.FormDataContentType(), form.String(), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/admin/registers/import", strings.NewReader(tt.body))
+			r.Header.Set("Authorization", tt.auth)
+			r.Header.Set("Content-Type", tt.contentType)
+
+			w := httptest.NewRecorder()
+			ImportRegistersHandler(w, r)
+
+			if w.Code != tt.expected {
+				t.Fatalf("expected %d, got %d: %s", tt.expected, w.Code, w.Body)
+			}
+
+			if w.Code == http.StatusOK && strings.Count(w.Body.String(), ",skipped,") != 2 {
+				t.Errorf("expected both rows to be skipped, got %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/bulk"
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/reconcile"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// version is set at build time with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+const usage = `Usage: vendproxy [flags] <command> [args]
+
+Commands:
+  serve            start the webserver (default)
+  migrate          apply any outstanding database migrations
+  config check     validate the configuration file and print every problem
+  register list    list the Vend registers paired with Oxipay
+  register import <registers.csv>
+                   pair the registers in the file with Oxipay
+  outlet list      list the Vend outlets mapped to an Oxipay merchant
+  outlet set <origin> <outlet_id> <merchant_id>
+                   take payments at the outlet's registers with the merchant
+  outlet remove <origin> <outlet_id>
+                   remove the outlet's merchant
+  transaction find <id>
+                   find transactions by transaction ID, purchase number or Vend sale ID
+  reconcile <settlement.csv>
+                   match a settlement file against the recorded transactions
+  export           write the transactions for a date range, yesterday by default
+  vend check <origin>
+                   check the retailer's payment type in Vend opens this deployment
+  vend setup <origin>
+                   create or update the retailer's payment type in Vend
+  version          print the version
+
+Flags:
+`
+
+// options are the command line flags shared by every command
+type options struct {
+	configFile  string
+	assetDir    string
+	listen      string
+	logLevel    string
+	origin      string
+	merchant    string
+	from        string
+	to          string
+	format      string
+	concurrency int
+
+	// logOutput is where the logs go. Commands that write a report to stdout
+	// log to stderr so the report can be redirected to a file
+	logOutput io.Writer
+}
+
+// defaultConfigFile returns the configuration file used when -config isn't
+// given. The DEV environment variable switches to the file in the repository
+func defaultConfigFile() string {
+	if os.Getenv("DEV") != "" {
+		return "../configs/vendproxy.json"
+	}
+	return "/etc/vendproxy/vendproxy.json"
+}
+
+func (opts *options) flagSet(name string, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&opts.configFile, "config", opts.configFile, "path to the configuration file")
+	fs.StringVar(&opts.assetDir, "assets", opts.assetDir, "serve css, js, images and templates from this directory instead of the copies compiled into the binary")
+	fs.StringVar(&opts.listen, "listen", opts.listen, "address to listen on e.g :5000, defaults to the port in the configuration file")
+	fs.StringVar(&opts.logLevel, "loglevel", opts.logLevel, "log level, overrides the configuration file")
+	fs.StringVar(&opts.origin, "origin", opts.origin, "only include registers or transactions for this Vend origin")
+	fs.StringVar(&opts.merchant, "merchant", opts.merchant, "only include transactions for this Oxipay merchant ID")
+	fs.StringVar(&opts.from, "from", opts.from, "first day to include as YYYY-MM-DD")
+	fs.StringVar(&opts.to, "to", opts.to, "last day to include as YYYY-MM-DD")
+	fs.StringVar(&opts.format, "format", opts.format, "output format, csv or json (reconcile, register import) or ndjson (export)")
+	fs.IntVar(&opts.concurrency, "concurrency", opts.concurrency, "how many registers to pair at the same time")
+	return fs
+}
+
+// run parses the command line and dispatches to the command, returning the
+// exit code for the process
+func run(args []string) int {
+	opts := &options{
+		configFile:  defaultConfigFile(),
+		format:      "csv",
+		concurrency: bulk.DefaultConcurrency,
+		logOutput:   os.Stderr,
+	}
+
+	fs := opts.flagSet("vendproxy", os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	command := fs.Args()
+	if len(command) == 0 {
+		command = []string{"serve"}
+	}
+
+	// allow flags after the command as well e.g vendproxy serve -listen :8080
+	name := command[0]
+	subcommand := ""
+	rest := command[1:]
+	if (name == "config" || name == "register" || name == "outlet" || name == "transaction" || name == "vend") && len(rest) > 0 {
+		subcommand = rest[0]
+		rest = rest[1:]
+	}
+
+	cmdFlags := opts.flagSet(name, os.Stderr)
+	cmdFlags.Usage = fs.Usage
+	if err := cmdFlags.Parse(rest); err != nil {
+		return 2
+	}
+
+	switch {
+	case name == "serve":
+		opts.logOutput = os.Stdout
+		return serve(opts)
+	case name == "migrate":
+		return migrateDatabase(opts)
+	case name == "config" && subcommand == "check":
+		return checkConfig(opts.configFile)
+	case name == "register" && subcommand == "list":
+		return listRegisters(opts, os.Stdout)
+	case name == "register" && subcommand == "import" && cmdFlags.NArg() == 1:
+		return importRegistersCommand(opts, cmdFlags.Arg(0), os.Stdout)
+	case name == "outlet" && subcommand == "list":
+		return outletCommand(opts, subcommand, nil, os.Stdout)
+	case name == "outlet" && subcommand == "set" && cmdFlags.NArg() == 3:
+		return outletCommand(opts, subcommand, cmdFlags.Args(), os.Stdout)
+	case name == "outlet" && subcommand == "remove" && cmdFlags.NArg() == 2:
+		return outletCommand(opts, subcommand, cmdFlags.Args(), os.Stdout)
+	case name == "transaction" && subcommand == "find" && cmdFlags.NArg() == 1:
+		return findTransactions(opts, cmdFlags.Arg(0), os.Stdout)
+	case name == "reconcile" && cmdFlags.NArg() == 1:
+		return reconcileSettlement(opts, cmdFlags.Arg(0), os.Stdout)
+	case name == "export":
+		return exportCommand(opts, os.Stdout)
+	case name == "vend" && subcommand == "check" && cmdFlags.NArg() == 1:
+		return paymentTypeCommand(opts, cmdFlags.Arg(0), false, os.Stdout)
+	case name == "vend" && subcommand == "setup" && cmdFlags.NArg() == 1:
+		return paymentTypeCommand(opts, cmdFlags.Arg(0), true, os.Stdout)
+	case name == "version":
+		fmt.Println(version)
+		return 0
+	case name == "help":
+		fs.Usage()
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s %s\n\n", name, subcommand)
+	fs.Usage()
+	return 2
+}
+
+// loadConfig reads the configuration, applies any overrides from the command
+// line and sets up logging
+func loadConfig(opts *options) (*config.HostConfig, error) {
+	hostConfig, err := config.ReadApplicationConfig(opts.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.logLevel != "" {
+		hostConfig.LogLevel = opts.logLevel
+	}
+
+	level, err := logrus.ParseLevel(hostConfig.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("Level %s is not a valid log level. Try setting 'info' in production ", hostConfig.LogLevel)
+	}
+
+	logOutput := opts.logOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	log = initLogger(level, logOutput)
+
+	if opts.assetDir != "" {
+		log.Infof("Serving assets from %s", opts.assetDir)
+		assetFS = os.DirFS(opts.assetDir)
+		reloadTemplates = true
+	}
+
+	return &hostConfig, nil
+}
+
+// connectServices connects a command to the database and Oxipay. It returns
+// a function that closes the connection, and is replaced in tests
+var connectServices = func(hostConfig *config.HostConfig) func() {
+	db = connectToDatabase(hostConfig.Database)
+	term = terminal.NewTerminal(db)
+	transactions = transaction.NewStore(db)
+	oxipayClient = oxipay.NewOxipay(hostConfig.Oxipay.GatewayURL, hostConfig.Oxipay.Version, log)
+	return func() { db.Close() }
+}
+
+// checkConfig validates the configuration file and prints every problem found.
+// It returns the exit code for the process
+func checkConfig(configurationFile string) int {
+	hostConfig, err := config.ReadApplicationConfig(configurationFile)
+	if err == nil && hostConfig.Oxipay.ResponseCodes != "" {
+		_, err = oxipay.LoadResponseCatalogue(hostConfig.Oxipay.ResponseCodes)
+	}
+	if err == nil && hostConfig.ReceiptTemplate != "" {
+		_, err = loadReceiptTemplate(hostConfig.ReceiptTemplate)
+	}
+
+	if err == nil {
+		fmt.Printf("%s: configuration OK\n", configurationFile)
+		return 0
+	}
+
+	errs, ok := err.(config.Errors)
+	if !ok {
+		errs = config.Errors{err}
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %d problem(s) found\n", configurationFile, len(errs))
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "  - %s\n", e)
+	}
+	return 1
+}
+
+func migrateDatabase(opts *options) int {
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+
+	db = connectToDatabase(hostConfig.Database)
+	defer db.Close()
+
+	applied, err := migrate.Up(db)
+	for _, version := range applied {
+		log.Infof("Applied migration %s", version)
+	}
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	log.Infof("Database is up to date, %d migration(s) applied", len(applied))
+	return 0
+}
+
+func listRegisters(opts *options, out io.Writer) int {
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+
+	db = connectToDatabase(hostConfig.Database)
+	defer db.Close()
+
+	registers, err := terminal.NewTerminal(db).ListRegisters(opts.origin)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ORIGIN\tVEND REGISTER\tVEND OUTLET\tMERCHANT ID\tDEVICE ID")
+	for _, register := range registers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			register.Origin,
+			register.VendRegisterID,
+			register.VendOutletID,
+			register.FxlSellerID,
+			register.FxlRegisterID,
+		)
+	}
+	w.Flush()
+
+	return 0
+}
+
+func findTransactions(opts *options, query string, out io.Writer) int {
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+
+	db = connectToDatabase(hostConfig.Database)
+	defer db.Close()
+
+	txns, err := transaction.NewStore(db).Search(transaction.Filter{
+		Query:  query,
+		Origin: opts.origin,
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CREATED\tTRANSACTION ID\tTYPE\tSTATUS\tAMOUNT\tPURCHASE NUMBER\tVEND SALE ID\tMERCHANT ID\tVEND SALE STATUS")
+	for _, txn := range txns {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			txn.Created.Format(time.RFC3339),
+			txn.ID,
+			txn.Type,
+			txn.Status,
+			txn.Amount,
+			txn.PurchaseNumber,
+			txn.VendSaleID,
+			txn.MerchantID,
+			txn.VendSaleStatus,
+		)
+	}
+	w.Flush()
+
+	return 0
+}
+
+// dateRange parses -from and -to
+func (opts *options) dateRange() (from time.Time, to time.Time, err error) {
+	return parseDateRange(opts.from, opts.to)
+}
+
+// parseDateRange parses the first and last day of a range given as
+// YYYY-MM-DD. The range is returned with an exclusive end so that it includes
+// the whole of the last day. Either can be empty, which leaves it zero
+func parseDateRange(fromValue string, toValue string) (from time.Time, to time.Time, err error) {
+	if fromValue != "" {
+		from, err = time.ParseInLocation("2006-01-02", fromValue, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("from %q is not a date, use YYYY-MM-DD", fromValue)
+		}
+	}
+
+	if toValue != "" {
+		to, err = time.ParseInLocation("2006-01-02", toValue, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("to %q is not a date, use YYYY-MM-DD", toValue)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fmt.Errorf("from %s is after to %s", fromValue, toValue)
+	}
+
+	return from, to, nil
+}
+
+// reconcileSettlement matches the settlement file against the transactions
+// recorded over the same days, unless -from and -to say otherwise
+func reconcileSettlement(opts *options, file string, out io.Writer) int {
+	if opts.format != "csv" && opts.format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %s, use csv or json\n", opts.format)
+		return 2
+	}
+
+	from, to, err := opts.dateRange()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	settlement, err := reconcile.ReadSettlement(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return 1
+	}
+
+	// other merchants' rows are never in the proxy transactions we look up
+	settlement = reconcile.ForMerchant(settlement, opts.merchant)
+	if len(settlement) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no settlement rows for merchant %s\n", file, opts.merchant)
+		return 1
+	}
+
+	settledFrom, settledTo, err := reconcile.DateRange(settlement)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return 1
+	}
+	if from.IsZero() {
+		from = settledFrom
+	}
+	if to.IsZero() {
+		to = settledTo
+	}
+
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+	defer connectServices(hostConfig)()
+
+	txns, err := transactions.Search(transaction.Filter{
+		Origin:     opts.origin,
+		MerchantID: opts.merchant,
+		From:       from.AddDate(0, 0, -reconcile.SettlementLag),
+		To:         to,
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	report := reconcile.Reconcile(settlement, reconcile.Settled(settlement, txns, from))
+
+	if opts.format == "json" {
+		err = reconcile.WriteJSON(out, report)
+	} else {
+		err = reconcile.WriteCSV(out, report)
+	}
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "%s to %s: %d matched, %d missing in proxy, %d missing in settlement, %d amount mismatch\n",
+		from.Format("2006-01-02"),
+		to.AddDate(0, 0, -1).Format("2006-01-02"),
+		report.Summary[reconcile.Matched],
+		report.Summary[reconcile.MissingInProxy],
+		report.Summary[reconcile.MissingInSettlement],
+		report.Summary[reconcile.AmountMismatch],
+	)
+	return 0
+}
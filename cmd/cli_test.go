@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+)
+
+// runCommand runs vendproxy with the shipped configuration and the fakes in
+// place of the database and Oxipay. Logging is at debug level and assets are
+// served from the repository so that the command has something to log
+func runCommand(t *testing.T, gateway *fakeGateway, registers *memoryRegisters, txns *memoryTransactions, args ...string) (code int, stdout string, stderr string) {
+	t.Helper()
+
+	defer useFakes(gateway, registers, txns, nil)()
+	savedConnect, savedAssets, savedReload, savedTemplates := connectServices, assetFS, reloadTemplates, templates
+	savedStdout, savedStderr := os.Stdout, os.Stderr
+	defer func() {
+		connectServices, assetFS, reloadTemplates, templates = savedConnect, savedAssets, savedReload, savedTemplates
+		os.Stdout, os.Stderr = savedStdout, savedStderr
+	}()
+
+	connectServices = func(*config.HostConfig) func() {
+		oxipayClient, term, transactions = gateway, registers, txns
+		return func() {}
+	}
+
+	capture := func(f **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		*f = w
+
+		done := make(chan string)
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			done <- string(b)
+		}()
+		return func() string {
+			w.Close()
+			return <-done
+		}
+	}
+	readStdout, readStderr := capture(&os.Stdout), capture(&os.Stderr)
+
+	args = append([]string{"-config", filepath.Join("..", "configs", "vendproxy.json"), "-loglevel", "debug", "-assets", filepath.Join("..", "assets")}, args...)
+	code = run(args)
+	return code, readStdout(), readStderr()
+}
+
+// checkReport fails unless the output is a CSV report with the header and
+// nothing else
+func checkReport(t *testing.T, output string, header string) [][]string {
+	t.Helper()
+
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		t.Fatalf("expected only the report on stdout, got %s: %s", err, output)
+	}
+
+	if len(records) == 0 || strings.Join(records[0], ",") != header {
+		t.Fatalf("expected the report to start with %s, got %s", header, output)
+	}
+	return records
+}
+
+func TestReconcileWritesOnlyTheReport(t *testing.T) {
+	settlement := filepath.Join(t.TempDir(), "settlement.csv")
+	err := ioutil.WriteFile(settlement, []byte("Date,Merchant ID,Purchase Number,Amount\n"+
+		"2018-11-05,30188105,P100,44.00\n"+
+		"2018-11-05,30188106,P200,10.00\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txns := &memoryTransactions{txns: []*transaction.Transaction{
+		// made the night before it was settled
+		{ID: "t1", PurchaseNumber: "P100", MerchantID: "30188105", Amount: 4400, Status: statusAccepted, Created: time.Date(2018, 11, 4, 23, 50, 0, 0, time.Local)},
+	}}
+
+	code, stdout, stderr := runCommand(t, nil, newMemoryRegisters(), txns, "reconcile", "-merchant", "30188105", settlement)
+	if code != 0 {
+		t.Fatalf("expected the reconcile to succeed, got %d: %s", code, stderr)
+	}
+
+	records := checkReport(t, stdout, "status,purchase_number,type,merchant_id,settlement_amount,proxy_amount,settlement_date,transaction_ids,vend_sale_ids")
+
+	// the other merchant's purchase isn't reported as missing
+	if len(records) != 2 || records[1][0] != "matched" || records[1][1] != "P100" {
+		t.Errorf("expected only P100 to be matched, got %v", records)
+	}
+
+	if !strings.Contains(stderr, "Serving assets") {
+		t.Errorf("expected the logs on stderr, got %s", stderr)
+	}
+}
+
+func TestExportWritesOnlyTheExport(t *testing.T) {
+	txns := &memoryTransactions{txns: []*transaction.Transaction{
+		{ID: "t1", PurchaseNumber: "P100", MerchantID: "30188105", Amount: 4400, Status: statusAccepted, Created: time.Date(2018, 11, 5, 9, 0, 0, 0, time.Local)},
+	}}
+
+	code, stdout, stderr := runCommand(t, nil, newMemoryRegisters(), txns, "export", "-from", "2018-11-05", "-to", "2018-11-05")
+	if code != 0 {
+		t.Fatalf("expected the export to succeed, got %d: %s", code, stderr)
+	}
+
+	records := checkReport(t, stdout, "created,transaction_id,type,status,origin,vend_register_id,vend_sale_id,merchant_id,purchase_number,amount,response_code")
+	if len(records) != 2 || records[1][1] != "t1" {
+		t.Errorf("expected t1 to be exported, got %v", records)
+	}
+
+	if !strings.Contains(stderr, "Exported 1 transaction(s)") {
+		t.Errorf("expected the logs on stderr, got %s", stderr)
+	}
+}
+
+func TestImportWritesOnlyTheReport(t *testing.T) {
+	upload := filepath.Join(t.TempDir(), "registers.csv")
+	err := ioutil.WriteFile(upload, []byte("origin,register_id,merchant_id,device_token\n"+
+		testOrigin+",r1,30188105,token\n"+
+		testOrigin+",r2,30188105,token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := &fakeGateway{key: "token", response: oxipay.Response{Code: "SCRK01", Status: "Success", Message: "Success", Key: "new-key"}}
+	registers := newMemoryRegisters(pairedRegister())
+
+	code, stdout, stderr := runCommand(t, gateway, registers, nil, "register", "import", "-concurrency", "1", upload)
+	if code != 0 {
+		t.Fatalf("expected the import to succeed, got %d: %s", code, stderr)
+	}
+
+	records := checkReport(t, stdout, "line,origin,register_id,merchant_id,status,device_id,message")
+	if len(records) != 3 || records[1][4] != "skipped" || records[2][4] != "paired" {
+		t.Errorf("expected r1 to be skipped and r2 paired, got %v", records)
+	}
+
+	if !strings.Contains(stderr, "Imported registers") || !strings.Contains(stderr, "1 paired, 0 failed, 1 skipped") {
+		t.Errorf("expected the logs on stderr, got %s", stderr)
+	}
+}
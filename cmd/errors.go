@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/branding"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// These are the steps the payment page sends to Vend when a request fails
+const (
+	stepDecline = "DECLINE" // back to the sale so it can be paid another way
+	stepExit    = "EXIT"    // close the payment page, nothing was attempted
+	stepRetry   = "RETRY"   // stay on the payment page so the cashier can try again
+)
+
+// errorKind is what went wrong with a request, which decides how it is
+// reported to the cashier
+type errorKind int
+
+const (
+	kindInternal errorKind = iota
+	kindValidation
+	kindNotRegistered
+	kindGatewayUnreachable
+	kindSignatureInvalid
+	kindDeclined
+)
+
+func (k errorKind) String() string {
+	switch k {
+	case kindValidation:
+		return "validation"
+	case kindNotRegistered:
+		return "not-registered"
+	case kindGatewayUnreachable:
+		return "gateway-unreachable"
+	case kindSignatureInvalid:
+		return "signature-invalid"
+	case kindDeclined:
+		return "declined"
+	}
+	return "internal"
+}
+
+// errorOutcome is how a kind of error is reported
+type errorOutcome struct {
+	httpStatus  int
+	status      string // the payment status
+	step        string // the Vend step the payment page takes
+	message     string // the i18n key of the message for the cashier
+	redirectURL string
+}
+
+// errorOutcomes is the single place a kind of error is mapped to a response
+var errorOutcomes = map[errorKind]errorOutcome{
+	kindInternal:           {http.StatusServiceUnavailable, statusFailed, stepDecline, "error.internal", ""},
+	kindValidation:         {http.StatusBadRequest, statusFailed, stepRetry, "error.validation", ""},
+	kindNotRegistered:      {http.StatusNotFound, statusFailed, stepExit, "error.not_registered", "/register"},
+	kindGatewayUnreachable: {http.StatusBadGateway, statusFailed, stepRetry, "error.gateway_unreachable", ""},
+	kindSignatureInvalid:   {http.StatusBadGateway, statusFailed, stepDecline, "error.signature_invalid", ""},
+	kindDeclined:           {http.StatusOK, statusDeclined, stepDecline, "error.declined", ""},
+}
+
+// requestError is an error that is reported to the cashier. The cause is
+// logged but never shown
+type requestError struct {
+	kind    errorKind
+	message string // the i18n key of the message, if not the one for the kind
+	err     error
+}
+
+func (e *requestError) Error() string {
+	if e.err == nil {
+		return e.kind.String()
+	}
+	return e.kind.String() + ": " + e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func validationError(message string, err error) error {
+	return &requestError{kind: kindValidation, message: message, err: err}
+}
+
+func notRegisteredError(message string, err error) error {
+	return &requestError{kind: kindNotRegistered, message: message, err: err}
+}
+
+func gatewayUnreachableError(err error) error {
+	return &requestError{kind: kindGatewayUnreachable, err: err}
+}
+
+func signatureInvalidError(err error) error {
+	return &requestError{kind: kindSignatureInvalid, err: err}
+}
+
+func declinedError(message string, err error) error {
+	return &requestError{kind: kindDeclined, message: message, err: err}
+}
+
+func internalError(message string, err error) error {
+	return &requestError{kind: kindInternal, message: message, err: err}
+}
+
+// errorKindOf returns the kind of the error. Errors that aren't request errors
+// are internal
+func errorKindOf(err error) errorKind {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.kind
+	}
+	return kindInternal
+}
+
+// errorResponse logs the error and builds the response for it
+func errorResponse(err error, locale string, brand branding.Profile) *Response {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		reqErr = &requestError{kind: kindInternal, err: err}
+	}
+	outcome := errorOutcomes[reqErr.kind]
+
+	entry := log.WithFields(logrus.Fields{
+		"module": "proxy",
+		"error":  reqErr.kind.String(),
+	})
+	switch reqErr.kind {
+	case kindInternal, kindGatewayUnreachable, kindSignatureInvalid:
+		entry.Error(err)
+	default:
+		entry.Info(err)
+	}
+
+	message := reqErr.message
+	if message == "" {
+		message = outcome.message
+	}
+
+	return &Response{
+		Status:      outcome.status,
+		Step:        outcome.step,
+		Message:     brand.Apply(messages.Translate(locale, message)),
+		RedirectURL: outcome.redirectURL,
+		Locale:      locale,
+		Brand:       brand,
+		Timestamp:   time.Now(),
+		HTTPStatus:  outcome.httpStatus,
+	}
+}
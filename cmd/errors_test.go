@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/branding"
+	"github.com/sirupsen/logrus"
+)
+
+func TestErrorResponse(t *testing.T) {
+	savedLog := log
+	defer func() { log = savedLog }()
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	cause := errors.New("cause")
+	tests := []struct {
+		err        error
+		httpStatus int
+		status     string
+		step       string
+		redirect   string
+	}{
+		{validationError("", cause), http.StatusBadRequest, statusFailed, stepRetry, ""},
+		{notRegisteredError("", cause), http.StatusNotFound, statusFailed, stepExit, "/register"},
+		{gatewayUnreachableError(cause), http.StatusBadGateway, statusFailed, stepRetry, ""},
+		{signatureInvalidError(cause), http.StatusBadGateway, statusFailed, stepDecline, ""},
+		{declinedError("", cause), http.StatusOK, statusDeclined, stepDecline, ""},
+		{internalError("", cause), http.StatusServiceUnavailable, statusFailed, stepDecline, ""},
+		{cause, http.StatusServiceUnavailable, statusFailed, stepDecline, ""},
+		{fmt.Errorf("wrapped: %w", gatewayUnreachableError(cause)), http.StatusBadGateway, statusFailed, stepRetry, ""},
+	}
+
+	for _, tt := range tests {
+		response := errorResponse(tt.err, "en-NZ", branding.Default())
+
+		if response.HTTPStatus != tt.httpStatus || response.Status != tt.status || response.Step != tt.step || response.RedirectURL != tt.redirect {
+			t.Errorf("%s: expected %d %s %s %q, got %d %s %s %q", tt.err, tt.httpStatus, tt.status, tt.step, tt.redirect,
+				response.HTTPStatus, response.Status, response.Step, response.RedirectURL)
+		}
+
+		if response.Message == "" || strings.HasPrefix(response.Message, "error.") || strings.Contains(response.Message, "{") {
+			t.Errorf("%s: expected a translated message, got %q", tt.err, response.Message)
+		}
+
+		if strings.Contains(response.Message, "cause") {
+			t.Errorf("%s: expected the cause to stay out of the message, got %q", tt.err, response.Message)
+		}
+	}
+}
+
+func TestErrorResponseMessage(t *testing.T) {
+	savedLog := log
+	defer func() { log = savedLog }()
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	response := errorResponse(declinedError("verify.mismatch", errors.New("the amount does not match the sale")), "en-NZ", branding.Default())
+	if expected := messages.Translate("en-NZ", "verify.mismatch"); response.Message != expected {
+		t.Errorf("expected %q, got %q", expected, response.Message)
+	}
+}
+
+func TestEveryErrorKindIsMapped(t *testing.T) {
+	for kind := kindInternal; kind <= kindDeclined; kind++ {
+		outcome, ok := errorOutcomes[kind]
+		if !ok {
+			t.Errorf("%s: no outcome", kind)
+			continue
+		}
+
+		if _, ok := messages.Lookup("en-NZ", outcome.message); !ok {
+			t.Errorf("%s: %s isn't translated", kind, outcome.message)
+		}
+	}
+}
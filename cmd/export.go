@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/export"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// exportFlushRows is how often the export is flushed to the client
+const exportFlushRows = 500
+
+// exportTransactions streams every transaction matching the filter to out in
+// the format. flush is called every exportFlushRows so the client sees the
+// rows as they are read rather than all at the end
+func exportTransactions(store transactionStore, filter transaction.Filter, format string, out io.Writer, flush func()) (int, error) {
+	writer, err := export.NewWriter(format, out)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = store.Each(filter, func(txn *transaction.Transaction) error {
+		if err := writer.Write(txn); err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return count, err
+	}
+	flush()
+	return count, nil
+}
+
+// yesterday returns the range for a daily export
+func yesterday() (time.Time, time.Time) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return today.AddDate(0, 0, -1), today
+}
+
+// exportFilter builds the filter for an export. Without dates it covers
+// yesterday, and a missing end runs up to now
+func exportFilter(origin string, merchantID string, fromValue string, toValue string) (transaction.Filter, error) {
+	from, to, err := parseDateRange(fromValue, toValue)
+	if err != nil {
+		return transaction.Filter{}, err
+	}
+
+	if from.IsZero() && to.IsZero() {
+		from, to = yesterday()
+	}
+
+	return transaction.Filter{
+		Origin:     origin,
+		MerchantID: merchantID,
+		From:       from,
+		To:         to,
+	}, nil
+}
+
+// authorisedAdmin checks the bearer token against the admin token in the
+// configuration
+func authorisedAdmin(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || appConfig == nil || appConfig.Admin.Token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(appConfig.Admin.Token)) == 1
+}
+
+// ExportHandler streams the transactions for an origin or merchant as CSV or
+// NDJSON e.g GET /admin/export?merchant=30188105&from=2018-11-01&to=2018-11-30&format=ndjson
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if appConfig == nil || appConfig.Admin.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !authorisedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vendproxy"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	if format != export.FormatCSV && format != export.FormatNDJSON {
+		http.Error(w, fmt.Sprintf("unknown format %q, use csv or ndjson", format), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := exportFilter(query.Get("origin"), query.Get("merchant"), query.Get("from"), query.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="transactions-%s.%s"`, filter.From.Format("2006-01-02"), format))
+	w.Header().Set("Cache-Control", "no-store")
+
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	count, err := exportTransactions(transactions, filter, format, w, flush)
+
+	fields := logrus.Fields{
+		"module":   "export",
+		"origin":   filter.Origin,
+		"merchant": filter.MerchantID,
+		"from":     filter.From,
+		"to":       filter.To,
+		"rows":     count,
+	}
+	if err != nil {
+		// the headers have gone so all we can do is stop
+		log.WithFields(fields).Errorf("Export failed: %s", err)
+		return
+	}
+	log.WithFields(fields).Info("Exported transactions")
+}
+
+func exportCommand(opts *options, out io.Writer) int {
+	format := opts.format
+	if format != export.FormatCSV && format != export.FormatNDJSON {
+		fmt.Fprintf(os.Stderr, "unknown format %s, use csv or ndjson\n", format)
+		return 2
+	}
+
+	filter, err := exportFilter(opts.origin, opts.merchant, opts.from, opts.to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+
+	defer connectServices(hostConfig)()
+
+	count, err := exportTransactions(transactions, filter, format, out, func() {})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	log.Infof("Exported %d transaction(s)", count)
+	return 0
+}
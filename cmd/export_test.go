@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+)
+
+func TestExportHandlerRequiresToken(t *testing.T) {
+	saved := appConfig
+	defer func() { appConfig = saved }()
+
+	token := "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name     string
+		token    string
+		header   string
+		url      string
+		expected int
+	}{
+		{"disabled", "", "Bearer " + token, "/admin/export", http.StatusNotFound},
+		{"no token", token, "", "/admin/export", http.StatusUnauthorized},
+		{"wrong token", token, "Bearer nope", "/admin/export", http.StatusUnauthorized},
+		{"bad format", token, "Bearer " + token, "/admin/export?format=xml", http.StatusBadRequest},
+		{"bad date", token, "Bearer " + token, "/admin/export?from=yesterday", http.StatusBadRequest},
+		{"backwards range", token, "Bearer " + token, "/admin/export?from=2018-11-02&to=2018-11-01", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		appConfig = &config.HostConfig{Admin: config.AdminConfig{Token: tt.token}}
+
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+
+		ExportHandler(w, r)
+
+		if w.Code != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestExportFilterDefaultsToYesterday(t *testing.T) {
+	filter, err := exportFilter("", "30188105", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := yesterday()
+	if !filter.From.Equal(from) || !filter.To.Equal(to) {
+		t.Errorf("expected yesterday, got %s to %s", filter.From, filter.To)
+	}
+
+	filter, err = exportFilter("", "", "2018-11-01", "2018-11-30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.To.Format("2006-01-02") != "2018-12-01" {
+		t.Errorf("expected the range to include the last day, got %s", filter.To)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/sessions"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+)
+
+// fakeGateway is an Oxipay that answers every request with the response,
+// signed with the key unless it already has a signature, or fails with err
+type fakeGateway struct {
+	key      string
+	response oxipay.Response
+	err      error
+	calls    int
+}
+
+func (g *fakeGateway) reply() (*oxipay.Response, error) {
+	g.calls++
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	response := g.response
+	if response.Signature == "" {
+		response.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(&response), g.key)
+	}
+	return &response, nil
+}
+
+func (g *fakeGateway) RegisterPosDevice(*oxipay.RegistrationPayload) (*oxipay.Response, error) {
+	return g.reply()
+}
+
+func (g *fakeGateway) ProcessAuthorisation(*oxipay.AuthorisationPayload) (*oxipay.Response, error) {
+	return g.reply()
+}
+
+func (g *fakeGateway) ProcessSalesAdjustment(*oxipay.SalesAdjustmentPayload) (*oxipay.Response, error) {
+	return g.reply()
+}
+
+func (g *fakeGateway) GetVersion() string {
+	return "test"
+}
+
+// memoryRegisters keeps pairings in memory. When err is set every lookup
+// fails with it, and saveErr fails every change
+type memoryRegisters struct {
+	mu        sync.Mutex
+	registers map[string]*terminal.Register
+	outlets   map[string]*terminal.Outlet
+	err       error
+	saveErr   error
+}
+
+func newMemoryRegisters(registers ...*terminal.Register) *memoryRegisters {
+	m := &memoryRegisters{
+		registers: make(map[string]*terminal.Register),
+		outlets:   make(map[string]*terminal.Outlet),
+	}
+	for _, register := range registers {
+		m.registers[register.Origin+" "+register.VendRegisterID] = register
+	}
+	return m
+}
+
+func (m *memoryRegisters) GetRegister(originDomain string, vendRegisterID string) (*terminal.Register, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	register, ok := m.registers[originDomain+" "+vendRegisterID]
+	if !ok {
+		return nil, terminal.ErrNotFound
+	}
+	copied := *register
+	return &copied, nil
+}
+
+func (m *memoryRegisters) ListRegisters(originDomain string) ([]*terminal.Register, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var registers []*terminal.Register
+	for _, register := range m.registers {
+		if originDomain == "" || register.Origin == originDomain {
+			registers = append(registers, register)
+		}
+	}
+	return registers, m.err
+}
+
+func (m *memoryRegisters) Save(user string, register *terminal.Register) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.saveErr != nil {
+		return false, m.saveErr
+	}
+	m.registers[register.Origin+" "+register.VendRegisterID] = register
+	return true, nil
+}
+
+func (m *memoryRegisters) Rekey(user string, register *terminal.Register, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.saveErr != nil {
+		return m.saveErr
+	}
+	register.FxlDeviceSigningKey = key
+	register.NeedsRekey = false
+	m.registers[register.Origin+" "+register.VendRegisterID] = register
+	return nil
+}
+
+func (m *memoryRegisters) MarkNeedsRekey(rejected *terminal.Register) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	register, ok := m.registers[rejected.Origin+" "+rejected.VendRegisterID]
+	if ok && register.FxlRegisterID == rejected.FxlRegisterID && register.FxlSellerID == rejected.FxlSellerID && register.FxlDeviceSigningKey == rejected.FxlDeviceSigningKey {
+		register.NeedsRekey = true
+	}
+	return m.saveErr
+}
+
+func (m *memoryRegisters) Delete(user string, originDomain string, vendRegisterID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.registers, originDomain+" "+vendRegisterID)
+	return m.saveErr
+}
+
+func (m *memoryRegisters) SaveOutlet(user string, outlet *terminal.Outlet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.outlets[outlet.Origin+" "+outlet.VendOutletID] = outlet
+	return m.saveErr
+}
+
+func (m *memoryRegisters) OutletMerchant(originDomain string, vendOutletID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if outlet, ok := m.outlets[originDomain+" "+vendOutletID]; ok {
+		return outlet.FxlSellerID, m.err
+	}
+	return "", m.err
+}
+
+func (m *memoryRegisters) ListOutlets(originDomain string) ([]*terminal.Outlet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var outlets []*terminal.Outlet
+	for _, outlet := range m.outlets {
+		if originDomain == "" || outlet.Origin == originDomain {
+			outlets = append(outlets, outlet)
+		}
+	}
+	return outlets, m.err
+}
+
+func (m *memoryRegisters) DeleteOutlet(originDomain string, vendOutletID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.outlets, originDomain+" "+vendOutletID)
+	return m.saveErr
+}
+
+// memoryTransactions keeps transactions in memory. When err is set no
+// transaction can be created, and searched is called after every search
+type memoryTransactions struct {
+	mu          sync.Mutex
+	txns        []*transaction.Transaction
+	err         error
+	voidRefunds map[string]bool
+	searched    func(filter transaction.Filter)
+}
+
+func (m *memoryTransactions) Create(txn *transaction.Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	id, err := transaction.NewID()
+	if err != nil {
+		return err
+	}
+	txn.ID = id
+	m.txns = append(m.txns, txn)
+	return nil
+}
+
+func (m *memoryTransactions) Complete(txn *transaction.Transaction) error {
+	return nil
+}
+
+func (m *memoryTransactions) SetVendSaleStatus(id string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, txn := range m.txns {
+		if txn.ID == id {
+			txn.VendSaleStatus = status
+			return nil
+		}
+	}
+	return errors.New("transaction not found")
+}
+
+func (m *memoryTransactions) ClaimVoidRefund(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.voidRefunds[id] {
+		return false, nil
+	}
+	if m.voidRefunds == nil {
+		m.voidRefunds = make(map[string]bool)
+	}
+	m.voidRefunds[id] = true
+	return true, nil
+}
+
+func (m *memoryTransactions) ReleaseVoidRefund(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.voidRefunds, id)
+	return nil
+}
+
+func (m *memoryTransactions) Search(filter transaction.Filter) ([]*transaction.Transaction, error) {
+	var txns []*transaction.Transaction
+	err := m.Each(filter, func(txn *transaction.Transaction) error {
+		txns = append(txns, txn)
+		return nil
+	})
+	if m.searched != nil {
+		m.searched(filter)
+	}
+	return txns, err
+}
+
+func (m *memoryTransactions) Each(filter transaction.Filter, fn func(*transaction.Transaction) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, txn := range m.txns {
+		if filter.Origin != "" && txn.Origin != filter.Origin {
+			continue
+		}
+		if filter.MerchantID != "" && txn.MerchantID != filter.MerchantID {
+			continue
+		}
+		if filter.Query != "" && !strings.Contains(txn.ID+" "+txn.PurchaseNumber+" "+txn.VendSaleID, filter.Query) {
+			continue
+		}
+		if err := fn(txn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// last returns the most recent transaction, or nil if there are none
+func (m *memoryTransactions) last() *transaction.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.txns) == 0 {
+		return nil
+	}
+	return m.txns[len(m.txns)-1]
+}
+
+// memorySessions is a session store where every session holds the request
+// Vend opened the payment page with, if there is one, and the values
+type memorySessions struct {
+	vReq   *vend.PaymentRequest
+	values map[interface{}]interface{}
+}
+
+func (m *memorySessions) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return m.New(r, name)
+}
+
+func (m *memorySessions) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(m, name)
+	if m.vReq != nil {
+		copied := *m.vReq
+		session.Values["vReq"] = &copied
+	}
+	for key, value := range m.values {
+		session.Values[key] = value
+	}
+	return session, nil
+}
+
+func (m *memorySessions) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// middleware wraps a handler with behaviour every request needs
+type middleware func(http.Handler) http.Handler
+
+// chain wraps the handler in the middleware. The first middleware sees the
+// request first
+func chain(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// requestIDHeader carries the request ID to and from the proxy in front of us
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID is what we accept as a request ID from the proxy in front of
+// us, so it can't be used to inject into the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID gives every request an ID, which is sent back in the response
+// and included in the access log. An ID from the proxy in front of us is kept
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDFrom returns the ID of the request, or an empty string if it
+// didn't go through the middleware
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// responseRecorder remembers the status and size of the response for the
+// access log
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush lets streamed responses like the export through
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// recoverPanic turns a panic in a handler into a 500 rather than dropping the
+// connection, and logs where it happened
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// the handler wants the connection dropped
+				panic(p)
+			}
+
+			log.WithFields(logrus.Fields{
+				"module":     "http",
+				"request_id": requestIDFrom(r.Context()),
+				"stack":      string(debug.Stack()),
+			}).Errorf("Panic handling %s %s: %v", r.Method, r.URL.Path, p)
+
+			if rec.status == 0 {
+				// a 500 rather than the usual 503, a bug isn't an outage
+				// that is worth retrying
+				response := errorResponse(internalError("", fmt.Errorf("panic: %v", p)), requestLocale(r, nil), brandFor(""))
+				response.HTTPStatus = http.StatusInternalServerError
+				sendResponse(w, r, response)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// accessLog logs every request once it has been handled. The request itself
+// is dumped at debug level
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		log.WithFields(logrus.Fields{
+			"module":      "http",
+			"request_id":  requestIDFrom(r.Context()),
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       rec.bytes,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"remote_addr": r.RemoteAddr,
+		}).Info("Request handled")
+	})
+}
+
+// withTimeout gives up on the calls a request makes to Vend once the timeout
+// has passed. Zero means no timeout
+func withTimeout(timeout time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// securityHeaders stops browsers sniffing content types, leaking the payment
+// page URL and framing our pages anywhere but Vend, which opens the payment
+// page in a frame
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		h.Set("Content-Security-Policy", "frame-ancestors 'self' https://*.vendhq.com")
+
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMethods are the methods Vend's pages may call us with
+const corsMethods = "GET, POST, OPTIONS"
+
+// vendCORS lets pages on a Vend origin call the API with the session cookie.
+// Preflight requests are answered here as the routes only accept the methods
+// they handle
+func vendCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !isVendOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Set("Access-Control-Expose-Headers", requestIDHeader)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsMethods)
+			h.Set("Access-Control-Allow-Headers", "Content-Type, "+requestIDHeader)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isVendOrigin returns true for a retailer's Vend origin e.g
+// https://example.vendhq.com
+func isVendOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" || u.Path != "" {
+		return false
+	}
+
+	prefix, err := vend.DomainPrefixForOrigin(origin)
+	return err == nil && prefix != ""
+}
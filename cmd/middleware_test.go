@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	tests := []struct {
+		header string
+		kept   bool
+	}{
+		{"", false},
+		{"abc-123_DEF.4", true},
+		{"bad id\nwith a newline", false},
+		{strings.Repeat("a", 65), false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(requestIDHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(requestIDHeader)
+		if id == "" || id != seen {
+			t.Errorf("%q: expected the handler to see the response's ID, got %q and %q", tt.header, seen, id)
+		}
+
+		if kept := id == tt.header; kept != tt.kept {
+			t.Errorf("%q: expected kept to be %t, got ID %q", tt.header, tt.kept, id)
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	savedConfig, savedLog := appConfig, log
+	defer func() { appConfig, log = savedConfig, savedLog }()
+	appConfig = nil
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), requestID, accessLog, recoverPanic)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/payments", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	response := new(Response)
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil || response.Status != statusFailed || strings.Contains(response.Message, "boom") {
+		t.Errorf("expected a failed response without the panic, got %s", w.Body)
+	}
+}
+
+func TestRecoverPanicAfterWrite(t *testing.T) {
+	savedLog := log
+	defer func() { log = savedLog }()
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	handler := recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+		t.Errorf("expected the response already sent to be left alone, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	var deadline time.Time
+	var ok bool
+	handler := withTimeout(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok = r.Context().Deadline()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("expected a deadline within a minute, got %s", deadline)
+	}
+
+	handler = withTimeout(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok = r.Context().Deadline()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if ok {
+		t.Error("expected no deadline when the timeout is off")
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	handler := securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !strings.Contains(w.Header().Get("Content-Security-Policy"), "frame-ancestors 'self' https://*.vendhq.com") {
+		t.Errorf("expected Vend to be able to frame the payment page, got %v", w.Header())
+	}
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("expected no HSTS over plain HTTP")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Header().Get("Strict-Transport-Security") == "" {
+		t.Error("expected HSTS behind an HTTPS proxy")
+	}
+}
+
+func TestVendCORS(t *testing.T) {
+	var called bool
+	handler := vendCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	tests := []struct {
+		method   string
+		origin   string
+		allowed  bool
+		called   bool
+		expected int
+	}{
+		{http.MethodPost, "https://example.vendhq.com", true, true, http.StatusOK},
+		{http.MethodOptions, "https://example.vendhq.com", true, false, http.StatusNoContent},
+		{http.MethodPost, "http://example.vendhq.com", false, true, http.StatusOK},
+		{http.MethodPost, "https://example.vendhq.com.evil.com", false, true, http.StatusOK},
+		{http.MethodPost, "https://evil.com", false, true, http.StatusOK},
+		{http.MethodOptions, "https://evil.com", false, true, http.StatusOK},
+		{http.MethodPost, "", false, true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		called = false
+		r := httptest.NewRequest(tt.method, "/api/v1/payments", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		allowed := w.Header().Get("Access-Control-Allow-Origin") != ""
+		if allowed != tt.allowed || (allowed && w.Header().Get("Access-Control-Allow-Origin") != tt.origin) {
+			t.Errorf("%s %q: expected allowed to be %t, got %v", tt.method, tt.origin, tt.allowed, w.Header())
+		}
+
+		if called != tt.called || w.Code != tt.expected {
+			t.Errorf("%s %q: expected called %t and %d, got %t and %d", tt.method, tt.origin, tt.called, tt.expected, called, w.Code)
+		}
+	}
+}
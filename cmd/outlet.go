@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// registerOutlet asks Vend which outlet the register belongs to. It is empty
+// when the Vend API isn't configured or the retailer hasn't connected
+func registerOutlet(ctx context.Context, origin string, registerID string) string {
+	if vendClient == nil {
+		return ""
+	}
+
+	register, err := vendClient.Register(ctx, origin, registerID)
+	if err != nil {
+		log.WithField("origin", origin).Warnf("Unable to find the outlet of register %s: %s", registerID, err)
+		return ""
+	}
+	return register.OutletID
+}
+
+// checkOutletMerchant stops a register being paired with a merchant other than
+// the one its outlet is mapped to
+func checkOutletMerchant(origin string, outletID string, merchantID string) error {
+	if outletID == "" {
+		return nil
+	}
+
+	outletMerchant, err := term.OutletMerchant(origin, outletID)
+	if err != nil {
+		return err
+	}
+
+	if outletMerchant != "" && outletMerchant != merchantID {
+		return validationError("error.outlet_merchant", fmt.Errorf("the outlet takes payments with merchant %s", outletMerchant))
+	}
+	return nil
+}
+
+// lookupRegister finds the pairing for the register
+func lookupRegister(origin string, registerID string) (*terminal.Register, error) {
+	register, err := term.GetRegister(origin, registerID)
+	if err != nil {
+		return nil, registerError(registerID, err)
+	}
+	return register, nil
+}
+
+// registerError is the request error for a register that couldn't be looked
+// up. A register that isn't paired is sent to pair it
+func registerError(registerID string, err error) error {
+	switch {
+	case errors.Is(err, terminal.ErrNotFound):
+		return notRegisteredError("", err)
+	case errors.Is(err, terminal.ErrAmbiguous):
+		return internalError("register.ambiguous", err)
+	}
+	return internalError("", fmt.Errorf("unable to look up register %s: %w", registerID, err))
+}
+
+// OutletsHandler lists the outlet mappings on GET, maps an outlet to a
+// merchant on POST and removes the mapping on DELETE. It is part of the admin
+// API
+func OutletsHandler(w http.ResponseWriter, r *http.Request) {
+	if appConfig == nil || appConfig.Admin.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !authorisedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vendproxy"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	origin := r.FormValue("origin")
+	outlet := &terminal.Outlet{
+		Origin:       origin,
+		VendOutletID: r.FormValue("outlet_id"),
+		FxlSellerID:  r.FormValue("merchant_id"),
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		var outlets []*terminal.Outlet
+		if outlets, err = term.ListOutlets(origin); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(outlets)
+			return
+		}
+	case http.MethodPost:
+		if outlet.Origin == "" || outlet.VendOutletID == "" || outlet.FxlSellerID == "" {
+			http.Error(w, "origin, outlet_id and merchant_id are required", http.StatusBadRequest)
+			return
+		}
+		err = term.SaveOutlet("admin-api", outlet)
+	case http.MethodDelete:
+		if outlet.Origin == "" || outlet.VendOutletID == "" {
+			http.Error(w, "origin and outlet_id are required", http.StatusBadRequest)
+			return
+		}
+		err = term.DeleteOutlet(outlet.Origin, outlet.VendOutletID)
+	}
+
+	if err != nil {
+		log.Errorf("Unable to update the outlets for %s: %s", origin, err)
+		http.Error(w, "There was a problem processing the request", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"module":      "terminal",
+		"origin":      outlet.Origin,
+		"outlet_id":   outlet.VendOutletID,
+		"merchant_id": outlet.FxlSellerID,
+		"method":      r.Method,
+	}).Info("Updated the outlet mapping")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// outletCommand lists, sets or removes outlet mappings from the command line
+func outletCommand(opts *options, subcommand string, args []string, out io.Writer) int {
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+
+	db = connectToDatabase(hostConfig.Database)
+	defer db.Close()
+
+	outlets := terminal.NewTerminal(db)
+
+	switch subcommand {
+	case "set":
+		err = outlets.SaveOutlet("vendproxy", &terminal.Outlet{
+			Origin:       args[0],
+			VendOutletID: args[1],
+			FxlSellerID:  args[2],
+		})
+	case "remove":
+		err = outlets.DeleteOutlet(args[0], args[1])
+	default:
+		var mappings []*terminal.Outlet
+		if mappings, err = outlets.ListOutlets(opts.origin); err == nil {
+			w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ORIGIN\tVEND OUTLET\tMERCHANT ID")
+			for _, outlet := range mappings {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", outlet.Origin, outlet.VendOutletID, outlet.FxlSellerID)
+			}
+			w.Flush()
+		}
+	}
+
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOutletsHandler(t *testing.T) {
+	savedConfig, savedLog := appConfig, log
+	defer func() { appConfig, log = savedConfig, savedLog }()
+
+	token := "0123456789abcdef0123456789abcdef"
+	appConfig = &config.HostConfig{Admin: config.AdminConfig{Token: token}}
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	tests := []struct {
+		name     string
+		method   string
+		auth     string
+		body     string
+		expected int
+	}{
+		{"no token", http.MethodGet, "", "", http.StatusUnauthorized},
+		{"no merchant", http.MethodPost, "Bearer " + token, "origin=https%3A%2F%2Fexample.vendhq.com&outlet_id=o1", http.StatusBadRequest},
+		{"no outlet", http.MethodDelete, "Bearer " + token, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/admin/outlets", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Authorization", tt.auth)
+
+			w := httptest.NewRecorder()
+			OutletsHandler(w, r)
+
+			if w.Code != tt.expected {
+				t.Errorf("expected %d, got %d: %s", tt.expected, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected errorKind
+	}{
+		{terminal.ErrNotFound, kindNotRegistered},
+		{fmt.Errorf("%w: register r1 is paired with merchants 30188105, 30188106", terminal.ErrAmbiguous), kindInternal},
+		{errors.New("driver: bad connection"), kindInternal},
+	}
+
+	for _, tt := range tests {
+		err := registerError("r1", tt.err)
+		if kind := errorKindOf(err); kind != tt.expected {
+			t.Errorf("%s: expected a %s error, got %s", tt.err, tt.expected, kind)
+		}
+
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected the cause to be kept, got %s", tt.err, err)
+		}
+	}
+}
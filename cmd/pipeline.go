@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/branding"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// requestContext carries a request from the browser through the steps of a
+// handler. Each step fills in what the next one needs
+type requestContext struct {
+	r        *http.Request
+	vReq     *vend.PaymentRequest // the payment posted by the browser
+	session  *vend.PaymentRequest // the request Vend opened the payment page with
+	payload  *oxipay.RegistrationPayload
+	lang     string // the language the cashier chose for the register
+	register *terminal.Register
+	txn      *transaction.Transaction
+	response *Response
+}
+
+// step is one stage of a request. An error stops the request, no more steps
+// run and the error is sent to the browser
+type step func(c *requestContext) error
+
+// runSteps runs the steps in order. The browser gets the error from the first
+// step that fails, or the response set by the steps when they all succeed
+func runSteps(w http.ResponseWriter, r *http.Request, steps ...step) {
+	c := &requestContext{r: r}
+
+	for _, step := range steps {
+		if err := step(c); err != nil {
+			sendResponse(w, r, c.errorResponse(err))
+			return
+		}
+	}
+
+	if c.response == nil {
+		// a handler that doesn't set a response is a bug, don't send an empty one
+		sendResponse(w, r, c.errorResponse(internalError("", fmt.Errorf("no response for %s", r.URL.Path))))
+		return
+	}
+	sendResponse(w, r, c.response)
+}
+
+// locale is the language the cashier is talked to in
+func (c *requestContext) locale() string {
+	if c.lang != "" {
+		return c.lang
+	}
+	return requestLocale(c.r, c.register)
+}
+
+// brand is the branding of the merchant, once we know who the merchant is
+func (c *requestContext) brand() branding.Profile {
+	switch {
+	case c.register != nil:
+		return brandFor(c.register.FxlSellerID)
+	case c.payload != nil:
+		return brandFor(c.payload.MerchantID)
+	}
+	return brandFor("")
+}
+
+func (c *requestContext) errorResponse(err error) *Response {
+	response := errorResponse(err, c.locale(), c.brand())
+	if c.vReq != nil {
+		response.Amount = c.vReq.Amount
+		response.RegisterID = c.vReq.RegisterID
+	}
+	if c.register != nil {
+		response.RegisterID = c.register.VendRegisterID
+	}
+	if c.txn != nil {
+		response.TransactionID = c.txn.ID
+	}
+	return response
+}
+
+// bindPayment reads the payment posted by the browser
+func bindPayment(c *requestContext) error {
+	vReq, err := bindToPaymentPayload(c.r)
+	if err != nil {
+		return validationError("", err)
+	}
+	c.vReq = vReq
+	return nil
+}
+
+// loadSession reads the request Vend opened the payment page with
+func loadSession(c *requestContext) error {
+	vReq, err := getPaymentRequestFromSession(c.r)
+	if err != nil {
+		return validationError("error.no_sale", err)
+	}
+	c.session = vReq
+	return nil
+}
+
+// findRegister looks up the pairing of the register the payment is for
+func findRegister(c *requestContext) error {
+	vReq := c.vReq
+	if vReq == nil {
+		vReq = c.session
+	}
+
+	register, err := lookupRegister(vReq.Origin, vReq.RegisterID)
+	if err != nil {
+		return err
+	}
+	c.register = register
+	return nil
+}
+
+// verifySale refuses a payment that doesn't match the sale Vend sent
+func verifySale(c *requestContext) error {
+	// the session may have expired, which verifyPayment refuses
+	expected, _ := getPaymentRequestFromSession(c.r)
+
+	if err := verifyPayment(c.r.Context(), expected, c.vReq, salesClient()); err != nil {
+		log.WithFields(logrus.Fields{
+			"module":      "proxy",
+			"origin":      c.vReq.Origin,
+			"register_id": c.vReq.RegisterID,
+			"sale_id":     c.vReq.SaleID,
+			"amount":      c.vReq.Amount,
+		}).Warnf("Refusing the payment: %s", err)
+		return declinedError("verify.mismatch", err)
+	}
+	return nil
+}
+
+// createPayment records the payment before it is sent to Oxipay. Every
+// attempt gets an ID of its own, which is what Vend records against the
+// payment
+func createPayment(c *requestContext) error {
+	txn := &transaction.Transaction{
+		Type:           transaction.TypePayment,
+		Origin:         c.register.Origin,
+		VendRegisterID: c.register.VendRegisterID,
+		VendSaleID:     c.vReq.SaleID,
+		MerchantID:     c.register.FxlSellerID,
+	}
+
+	amount, err := strconv.ParseInt(c.vReq.Amount, 10, 64)
+	if err != nil {
+		return validationError("", fmt.Errorf("invalid amount %q: %w", c.vReq.Amount, err))
+	}
+	txn.Amount = amount
+
+	if err := transactions.Create(txn); err != nil {
+		return fmt.Errorf("unable to record the payment: %w", err)
+	}
+	c.txn = txn
+	return nil
+}
+
+// createRefund records the refund of the purchase posted by the browser
+// before it is sent to Oxipay
+func createRefund(c *requestContext) error {
+	if err := c.r.ParseForm(); err != nil {
+		return validationError("", err)
+	}
+
+	txn := &transaction.Transaction{
+		Type:           transaction.TypeRefund,
+		Origin:         c.register.Origin,
+		VendRegisterID: c.register.VendRegisterID,
+		VendSaleID:     strings.TrimSpace(c.r.Form.Get("sale_id")),
+		MerchantID:     c.register.FxlSellerID,
+		PurchaseNumber: strings.TrimSpace(c.r.Form.Get("purchaseno")),
+	}
+
+	amount, err := strconv.ParseInt(c.session.Amount, 10, 64)
+	if err != nil {
+		return validationError("", fmt.Errorf("invalid amount %q: %w", c.session.Amount, err))
+	}
+	txn.Amount = amount
+
+	if err := transactions.Create(txn); err != nil {
+		return fmt.Errorf("unable to record the refund: %w", err)
+	}
+	c.txn = txn
+	return nil
+}
+
+// authorise sends the payment to Oxipay
+func authorise(c *requestContext) error {
+	payload := &oxipay.AuthorisationPayload{
+		DeviceID:          c.register.FxlRegisterID,
+		MerchantID:        c.register.FxlSellerID,
+		PosTransactionRef: c.vReq.SaleID,
+		FinanceAmount:     c.vReq.Amount,
+		FirmwareVersion:   "vend_integration_v0.0.1",
+		OperatorID:        "Vend",
+		PurchaseAmount:    c.vReq.Amount,
+		PreApprovalCode:   c.vReq.Code,
+	}
+
+	// generate the plaintext for the signature
+	plainText := oxipay.GeneratePlainTextSignature(payload)
+	log.Debugf("Oxipay plain text: %s \n", plainText)
+
+	// sign the message
+	payload.Signature = oxipay.SignMessage(plainText, c.register.FxlDeviceSigningKey)
+	log.Debugf("Oxipay signature: %s \n", payload.Signature)
+
+	// send authorisation to the Oxipay POS API
+	oxipayResponse, err := oxipayClient.ProcessAuthorisation(payload)
+	if err := c.complete(oxipayResponse, err, oxipay.Authorisation, payload.PurchaseAmount); err != nil {
+		return err
+	}
+
+	if c.response.Status != statusAccepted {
+		// declined receipts still show what was attempted
+		c.response.Amount = payload.PurchaseAmount
+	}
+	c.response.MerchantID = c.register.FxlSellerID
+	attachReceipt(c.response)
+	return nil
+}
+
+// adjust sends the refund to Oxipay
+func adjust(c *requestContext) error {
+	payload := &oxipay.SalesAdjustmentPayload{
+		Amount:            strings.Replace(c.session.Amount, "-", "", 1),
+		MerchantID:        c.register.FxlSellerID,
+		DeviceID:          c.register.FxlRegisterID,
+		FirmwareVersion:   "vend_integration_v0.0.1",
+		OperatorID:        "Vend",
+		PurchaseRef:       c.txn.PurchaseNumber,
+		PosTransactionRef: c.txn.ID,
+	}
+
+	// generate the plaintext for the signature
+	plainText := oxipay.GeneratePlainTextSignature(payload)
+	log.Infof("Oxipay plain text: %s \n", plainText)
+
+	// sign the message
+	payload.Signature = oxipay.SignMessage(plainText, c.register.FxlDeviceSigningKey)
+	log.Infof("Oxipay signature: %s \n", payload.Signature)
+
+	oxipayResponse, err := oxipayClient.ProcessSalesAdjustment(payload)
+	if err := c.complete(oxipayResponse, err, oxipay.Adjustment, payload.Amount); err != nil {
+		return err
+	}
+
+	// the receipt shows the amount refunded
+	c.response.Amount = c.session.Amount
+	c.response.MerchantID = c.register.FxlSellerID
+	attachReceipt(c.response)
+
+	c.response.Amount = "0" // this is set because the payload
+	return nil
+}
+
+// complete checks the response from Oxipay and records the outcome of the
+// transaction, whatever it is
+func (c *requestContext) complete(oxipayResponse *oxipay.Response, err error, responseType oxipay.ResponseType, amount string) error {
+	if err != nil {
+		// Oxipay may have processed the transaction
+		log.WithFields(logrus.Fields{
+			"module":         "proxy",
+			"transaction_id": c.txn.ID,
+		}).Warn("The outcome of the transaction is unknown")
+		recordOutcome(c.txn, nil, &Response{Status: statusUnknown})
+		return gatewayUnreachableError(err)
+	}
+
+	// ensure the response has come from Oxipay
+	if oxipayResponse.Code == oxipay.SignatureMismatch {
+		err = signatureMismatch(c.register)
+	} else {
+		err = authenticate(oxipayResponse, c.register.FxlDeviceSigningKey)
+	}
+	if err != nil {
+		recordOutcome(c.txn, oxipayResponse, &Response{Status: statusFailed})
+		return err
+	}
+
+	// Return a response to the browser based on the response from Oxipay
+	c.response = processOxipayResponse(oxipayResponse, responseType, amount, c.locale(), c.brand())
+	c.response.TransactionID = c.txn.ID
+	recordOutcome(c.txn, oxipayResponse, c.response)
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// portalDays is how many days of transactions the portal shows
+const portalDays = 7
+
+// portalPage is the data for portal.html
+type portalPage struct {
+	*Response
+	CSRF         string
+	Registers    []*portalRegister
+	Transactions []*transaction.Transaction
+}
+
+// portalRegister is a Vend register and its pairing, if it has been paired
+type portalRegister struct {
+	ID      string
+	Name    string
+	Outlet  string
+	Pairing *terminal.Register
+}
+
+// Dollars formats an amount in cents for display
+func (p *portalPage) Dollars(cents int64) string {
+	return formatDollars(cents)
+}
+
+// PortalHandler shows the store manager their Vend registers, which are
+// paired and the recent transactions. The manager signs in by connecting to
+// Vend, which only store admins can do
+func PortalHandler(w http.ResponseWriter, r *http.Request) {
+	session, origin := portalSession(w, r)
+	if session == nil {
+		return
+	}
+
+	writePortal(w, r, session, origin, &Response{HTTPStatus: http.StatusOK})
+}
+
+// PortalPairHandler pairs a Vend register with a device token from the
+// merchant portal, the same as /register does at the till
+func PortalPairHandler(w http.ResponseWriter, r *http.Request) {
+	session, origin := portalForm(w, r)
+	if session == nil {
+		return
+	}
+
+	registerID := r.FormValue("register_id")
+	locale, brand := requestLocale(r, nil), brandFor(r.FormValue("MerchantID"))
+
+	// only registers in the manager's own store can be paired
+	vendRegister, err := vendClient.Register(r.Context(), origin, registerID)
+	if err != nil {
+		err = fmt.Errorf("unable to find register %s in Vend for %s: %w", registerID, origin, err)
+		writePortal(w, r, session, origin, errorResponse(validationError("portal.not_in_store", err), locale, brand))
+		return
+	}
+
+	_, err = term.GetRegister(origin, registerID)
+	switch {
+	case err == nil || errors.Is(err, terminal.ErrAmbiguous):
+		err = fmt.Errorf("register %s is already paired for %s", registerID, origin)
+		writePortal(w, r, session, origin, errorResponse(validationError("portal.already_paired", err), locale, brand))
+		return
+	case !errors.Is(err, terminal.ErrNotFound):
+		writePortal(w, r, session, origin, errorResponse(internalError("", err), locale, brand))
+		return
+	}
+
+	registrationPayload, err := bindToRegistrationPayload(r)
+	if err == nil {
+		err = registrationPayload.Validate()
+	}
+	if err != nil {
+		writePortal(w, r, session, origin, errorResponse(validationError("error.registration", err), locale, brand))
+		return
+	}
+
+	registerLocale := r.FormValue("Locale")
+	if !messages.Supports(registerLocale) {
+		registerLocale = ""
+	}
+
+	register, browserResponse := pairRegister(registrationPayload, origin, registerID, vendRegister.OutletID, registerLocale, "vend-portal", &Response{
+		Locale: locale,
+		Brand:  brand,
+	})
+	if register == nil {
+		writePortal(w, r, session, origin, browserResponse)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"module":      "portal",
+		"origin":      origin,
+		"register_id": registerID,
+		"merchant_id": register.FxlSellerID,
+	}).Info("Register paired from the portal")
+
+	http.Redirect(w, r, "/portal", http.StatusSeeOther)
+}
+
+// PortalUnpairHandler removes the pairing so the register can no longer take
+// payments until it is paired again
+func PortalUnpairHandler(w http.ResponseWriter, r *http.Request) {
+	session, origin := portalForm(w, r)
+	if session == nil {
+		return
+	}
+
+	registerID := r.FormValue("register_id")
+	if err := term.Delete("vend-portal", origin, registerID); err != nil {
+		err = fmt.Errorf("unable to unpair register %s for %s: %w", registerID, origin, err)
+		if errors.Is(err, terminal.ErrNotFound) {
+			err = validationError("portal.not_paired", err)
+		}
+		writePortal(w, r, session, origin, errorResponse(err, requestLocale(r, nil), brandFor("")))
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"module":      "portal",
+		"origin":      origin,
+		"register_id": registerID,
+	}).Info("Register unpaired from the portal")
+
+	http.Redirect(w, r, "/portal", http.StatusSeeOther)
+}
+
+// portalText translates a message for when the portal itself can't be shown
+func portalText(r *http.Request, key string) string {
+	return brandFor("").Apply(messages.Translate(requestLocale(r, nil), key))
+}
+
+// portalFailure logs the error and tells the manager there was a problem,
+// for when the portal itself can't be shown
+func portalFailure(w http.ResponseWriter, r *http.Request, err error) {
+	response := errorResponse(err, requestLocale(r, nil), brandFor(""))
+	http.Error(w, response.Message, response.HTTPStatus)
+}
+
+// portalSession returns the session and the Vend origin the manager signed
+// in to. If they haven't signed in they are sent to connect to Vend and the
+// session is nil
+func portalSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, string) {
+	session, err := getSession(r, vendSessionName)
+	if err != nil {
+		portalFailure(w, r, err)
+		return nil, ""
+	}
+
+	origin, _ := session.Values["origin"].(string)
+	if origin == "" {
+		http.Redirect(w, r, "/vend/connect", http.StatusFound)
+		return nil, ""
+	}
+	return session, origin
+}
+
+// portalForm checks a form posted from the portal came from the portal
+func portalForm(w http.ResponseWriter, r *http.Request) (*sessions.Session, string) {
+	session, origin := portalSession(w, r)
+	if session == nil {
+		return nil, ""
+	}
+
+	if !validCSRF(r, session) {
+		http.Error(w, portalText(r, "portal.expired"), http.StatusForbidden)
+		return nil, ""
+	}
+	return session, origin
+}
+
+// validCSRF checks the form has the token the session's pages were given, so
+// another site can't post it for a signed in retailer
+func validCSRF(r *http.Request, session *sessions.Session) bool {
+	expected, _ := session.Values["csrf"].(string)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(expected)) == 1
+}
+
+// sessionCSRF returns the session's token for forms, creating it the first
+// time
+func sessionCSRF(w http.ResponseWriter, r *http.Request, session *sessions.Session) (string, error) {
+	if csrf, _ := session.Values["csrf"].(string); csrf != "" {
+		return csrf, nil
+	}
+
+	csrf, err := newState()
+	if err != nil {
+		return "", err
+	}
+	session.Values["csrf"] = csrf
+	if err := sessions.Save(r, w); err != nil {
+		log.Error(err)
+	}
+	return csrf, nil
+}
+
+// writePortal renders the portal with the response's message, if it has one
+func writePortal(w http.ResponseWriter, r *http.Request, session *sessions.Session, origin string, response *Response) {
+	csrf, err := sessionCSRF(w, r, session)
+	if err != nil {
+		portalFailure(w, r, err)
+		return
+	}
+
+	if response.Locale == "" {
+		response.Locale = requestLocale(r, nil)
+	}
+	if response.Brand.ProductName == "" {
+		response.Brand = brandFor("")
+	}
+	response.Origin = origin
+
+	page := &portalPage{Response: response, CSRF: csrf}
+
+	if page.Registers, err = portalRegisters(r.Context(), origin); err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			portalFailure(w, r, err)
+			return
+		}
+		log.WithField("origin", origin).Errorf("Unable to list the registers: %s", err)
+		http.Error(w, portalText(r, "portal.vend_unreachable"), http.StatusBadGateway)
+		return
+	}
+
+	page.Transactions, err = transactions.Search(transaction.Filter{
+		Origin: origin,
+		From:   time.Now().AddDate(0, 0, -portalDays),
+	})
+	if err != nil {
+		portalFailure(w, r, fmt.Errorf("unable to list the transactions for %s: %w", origin, err))
+		return
+	}
+
+	// newest first
+	for i, j := 0, len(page.Transactions)-1; i < j; i, j = i+1, j-1 {
+		page.Transactions[i], page.Transactions[j] = page.Transactions[j], page.Transactions[i]
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writePage(w, r, "portal.html", response.HTTPStatus, page)
+}
+
+// portalRegisters lists the retailer's registers from Vend with their
+// pairings. Pairings for registers that have since been deleted in Vend are
+// included so they can be unpaired. Failing to read the pairings is an
+// internal error, any other error is from Vend
+func portalRegisters(ctx context.Context, origin string) ([]*portalRegister, error) {
+	registers, err := vendClient.Registers(ctx, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	outlets, err := vendClient.Outlets(ctx, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	pairings, err := term.ListRegisters(origin)
+	if err != nil {
+		return nil, internalError("", fmt.Errorf("unable to list the pairings for %s: %w", origin, err))
+	}
+
+	return mergeRegisters(registers, outlets, pairings), nil
+}
+
+// mergeRegisters joins the Vend registers with their pairings, sorted by
+// outlet and name
+func mergeRegisters(registers []vend.Register, outlets []vend.Outlet, pairings []*terminal.Register) []*portalRegister {
+	outletNames := make(map[string]string, len(outlets))
+	for _, outlet := range outlets {
+		outletNames[outlet.ID] = outlet.Name
+	}
+
+	byID := make(map[string]*portalRegister, len(registers))
+	var merged []*portalRegister
+	for _, register := range registers {
+		p := &portalRegister{
+			ID:     register.ID,
+			Name:   register.Name,
+			Outlet: outletNames[register.OutletID],
+		}
+		byID[register.ID] = p
+		merged = append(merged, p)
+	}
+
+	for _, pairing := range pairings {
+		p, ok := byID[pairing.VendRegisterID]
+		if !ok {
+			p = &portalRegister{ID: pairing.VendRegisterID, Name: pairing.VendRegisterID}
+			merged = append(merged, p)
+		}
+		p.Pairing = pairing
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Outlet != merged[j].Outlet {
+			return merged[i].Outlet < merged[j].Outlet
+		}
+		return merged[i].Name < merged[j].Name
+	})
+	return merged
+}
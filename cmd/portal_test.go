@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+)
+
+func TestMergeRegisters(t *testing.T) {
+	registers := []vend.Register{
+		{ID: "r2", Name: "Front", OutletID: "o2"},
+		{ID: "r1", Name: "Back", OutletID: "o1"},
+		{ID: "r3", Name: "Front", OutletID: "o1"},
+	}
+	outlets := []vend.Outlet{{ID: "o1", Name: "Newmarket"}, {ID: "o2", Name: "Ponsonby"}}
+	pairings := []*terminal.Register{
+		{VendRegisterID: "r3", FxlSellerID: "30188105"},
+		{VendRegisterID: "deleted", FxlSellerID: "30188105"},
+	}
+
+	merged := mergeRegisters(registers, outlets, pairings)
+
+	var got []string
+	for _, register := range merged {
+		paired := ""
+		if register.Pairing != nil {
+			paired = "*"
+		}
+		got = append(got, register.Outlet+"/"+register.Name+paired)
+	}
+
+	expected := "/deleted* Newmarket/Back Newmarket/Front* Ponsonby/Front"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(got, " "))
+	}
+}
+
+func TestRenderPortal(t *testing.T) {
+	page := &portalPage{
+		Response: &Response{Locale: "mi-NZ", Brand: brandFor(""), Origin: "https://example.vendhq.com"},
+		CSRF:     "token",
+		Registers: []*portalRegister{
+			{ID: "r1", Name: "Front", Outlet: "Ponsonby"},
+			{ID: "r2", Name: "Back", Outlet: "Ponsonby", Pairing: &terminal.Register{FxlSellerID: "30188105"}},
+		},
+		Transactions: []*transaction.Transaction{
+			{ID: "t1", Type: transaction.TypeRefund, Amount: -4400, Status: statusAccepted, Created: time.Now()},
+		},
+	}
+
+	html, err := renderTemplate("portal.html", page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`action="/portal/pair"`, `action="/portal/unpair"`, `value="token"`, "30188105", "-$44.00"} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected the portal to contain %s", expected)
+		}
+	}
+}
+
+func TestVendDisconnectNeedsCSRF(t *testing.T) {
+	defer useFakes(nil, newMemoryRegisters(), nil, nil)()
+	DbSessionStore = &memorySessions{values: map[interface{}]interface{}{"origin": testOrigin, "csrf": "token"}}
+
+	// a page on another Vend store posting with the retailer's cookie
+	for _, form := range []url.Values{{}, {"csrf": {"guess"}}} {
+		r := httptest.NewRequest(http.MethodPost, "/vend/disconnect", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		VendDisconnectHandler(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%v: expected %d, got %d", form, http.StatusForbidden, w.Code)
+		}
+	}
+}
+
+func TestRenderVendConnected(t *testing.T) {
+	page := &portalPage{
+		Response: &Response{Status: statusConnected, Locale: "en-NZ", Brand: brandFor(""), Origin: testOrigin},
+		CSRF:     "token",
+	}
+
+	html, err := renderTemplate("vend_connect.html", page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(html), `action="/vend/disconnect"`) || !strings.Contains(string(html), `value="token"`) {
+		t.Errorf("expected the disconnect form to have the CSRF token, got %s", html)
+	}
+}
+
+func TestPortalMessages(t *testing.T) {
+	server := vendtest.NewServer("secret-token")
+	defer server.Close()
+	server.AddRegister(vend.Register{ID: "r1", Name: "Front"})
+	server.AddRegister(vend.Register{ID: "r2", Name: "Back"})
+
+	registers := newMemoryRegisters(terminal.NewRegister(testKey, "device-1", "30188105", server.URL, "r1"))
+	defer useFakes(nil, registers, &memoryTransactions{}, nil)()
+	savedClient := vendClient
+	defer func() { vendClient = savedClient }()
+	vendClient = vend.NewClient(server.Tokens(), log)
+	DbSessionStore = &memorySessions{values: map[interface{}]interface{}{"origin": server.URL, "csrf": "token"}}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		form     url.Values
+		lookup   error
+		expected int
+		message  string
+	}{
+		{"not in the store", PortalPairHandler, url.Values{"register_id": {"r9"}}, nil, http.StatusBadRequest, "portal.not_in_store"},
+		{"already paired", PortalPairHandler, url.Values{"register_id": {"r1"}}, nil, http.StatusBadRequest, "portal.already_paired"},
+		{"no device token", PortalPairHandler, url.Values{"register_id": {"r2"}, "MerchantID": {"30188105"}}, nil, http.StatusBadRequest, "error.registration"},
+		{"lookup fails", PortalPairHandler, url.Values{"register_id": {"r2"}}, errors.New("driver: bad connection"), errorOutcomes[kindInternal].httpStatus, "error.internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registers.err = tt.lookup
+			tt.form.Set("csrf", "token")
+			r := httptest.NewRequest(http.MethodPost, "/portal", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept-Language", "mi-NZ")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+
+			if w.Code != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, w.Code)
+			}
+
+			message := brandFor("").Apply(messages.Translate("mi-NZ", tt.message))
+			if !strings.Contains(w.Body.String(), message) || strings.Contains(w.Body.String(), "driver") {
+				t.Errorf("expected the page to say %q, got %s", message, w.Body)
+			}
+		})
+	}
+}
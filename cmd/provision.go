@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+var errVendDisabled = errors.New("the Vend API is not configured, set vend.clientid")
+
+// provisionPaymentType checks the retailer's payment type points at this
+// deployment and, when apply is set, creates or updates it
+func provisionPaymentType(ctx context.Context, vendConfig config.VendConfig, origin string, apply bool) (*vend.Provision, error) {
+	if vendClient == nil {
+		return nil, errVendDisabled
+	}
+
+	provision, err := vend.ProvisionPaymentType(ctx, vendClient, origin, brandFor("").ProductName, vendConfig.PaymentURL, apply)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"module":      "vend",
+		"origin":      origin,
+		"status":      provision.Status,
+		"gateway":     vendConfig.PaymentURL,
+		"previousurl": provision.PreviousURL,
+	}).Info("Checked the Vend payment type")
+	return provision, nil
+}
+
+// PaymentTypeHandler checks the retailer's payment type on GET and sets it up
+// on POST. It is part of the admin API
+func PaymentTypeHandler(w http.ResponseWriter, r *http.Request) {
+	if appConfig == nil || appConfig.Admin.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !authorisedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vendproxy"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	origin := r.FormValue("origin")
+	if origin == "" {
+		http.Error(w, "origin is required", http.StatusBadRequest)
+		return
+	}
+
+	provision, err := provisionPaymentType(r.Context(), appConfig.Vend, origin, r.Method == http.MethodPost)
+	switch {
+	case err == errVendDisabled:
+		http.NotFound(w, r)
+		return
+	case err == vend.ErrNoToken || err == vend.ErrUnauthorized:
+		http.Error(w, "The retailer needs to connect to Vend at /vend/connect", http.StatusConflict)
+		return
+	case err != nil:
+		log.Errorf("Unable to set up the payment type for %s: %s", origin, err)
+		http.Error(w, "Unable to reach Vend", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(provision)
+}
+
+func paymentTypeCommand(opts *options, origin string, apply bool, out io.Writer) int {
+	hostConfig, err := loadConfig(opts)
+	if err != nil {
+		logrus.Error(err)
+		return 1
+	}
+
+	// the payment type is named after the brand
+	appConfig = hostConfig
+
+	if !hostConfig.Vend.Enabled() {
+		fmt.Fprintln(os.Stderr, errVendDisabled)
+		return 1
+	}
+
+	db = connectToDatabase(hostConfig.Database)
+	defer db.Close()
+
+	if err := setupVend(hostConfig.Vend); err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	provision, err := provisionPaymentType(context.Background(), hostConfig.Vend, origin, apply)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	switch provision.Status {
+	case vend.ProvisionMissing:
+		fmt.Fprintf(out, "%s has no %s payment type, run vendproxy vend setup %s\n", origin, brandFor("").ProductName, origin)
+		return 1
+	case vend.ProvisionMismatch:
+		fmt.Fprintf(out, "%s payment type %s opens %s instead of %s\n", origin, provision.PaymentType.Name, provision.PreviousURL, hostConfig.Vend.PaymentURL)
+		return 1
+	}
+
+	fmt.Fprintf(out, "%s payment type %s opens %s (%s)\n", origin, provision.PaymentType.Name, provision.PaymentType.GatewayURL(), provision.Status)
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestPaymentTypeHandler(t *testing.T) {
+	savedConfig, savedLog, savedClient := appConfig, log, vendClient
+	defer func() { appConfig, log, vendClient = savedConfig, savedLog, savedClient }()
+
+	token := "0123456789abcdef0123456789abcdef"
+	appConfig = &config.HostConfig{
+		Admin: config.AdminConfig{Token: token},
+		Vend:  config.VendConfig{ClientID: "client-id", PaymentURL: "https://vend.shophumm.co.nz/"},
+	}
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	server := vendtest.NewServer("secret-token")
+	defer server.Close()
+	vendClient = vend.NewClient(server.Tokens(), log)
+
+	send := func(method string, origin string, auth string) (*httptest.ResponseRecorder, *vend.Provision) {
+		form := url.Values{"origin": {origin}}.Encode()
+		r := httptest.NewRequest(method, "/admin/vend/payment-type?"+form, nil)
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, "/admin/vend/payment-type", strings.NewReader(form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.Header.Set("Authorization", auth)
+
+		w := httptest.NewRecorder()
+		PaymentTypeHandler(w, r)
+
+		provision := new(vend.Provision)
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(provision); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, provision
+	}
+
+	if w, _ := send(http.MethodGet, server.URL, "Bearer nope"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", w.Code)
+	}
+
+	if w, _ := send(http.MethodGet, "https://unknown.vendhq.com", "Bearer "+token); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a retailer that hasn't connected, got %d", w.Code)
+	}
+
+	if _, provision := send(http.MethodGet, server.URL, "Bearer "+token); provision.Status != vend.ProvisionMissing {
+		t.Errorf("expected the payment type to be missing, got %+v", provision)
+	}
+
+	_, provision := send(http.MethodPost, server.URL, "Bearer "+token)
+	if provision.Status != vend.ProvisionCreated || provision.PaymentType.GatewayURL() != "https://vend.shophumm.co.nz/" {
+		t.Errorf("expected the payment type to be created, got %+v", provision)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/i18n"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// rekeyResult is the admin API response for a re-keyed register. The signing
+// key isn't included as it is a secret
+type rekeyResult struct {
+	Origin     string `json:"origin"`
+	RegisterID string `json:"register_id"`
+	MerchantID string `json:"merchant_id"`
+	DeviceID   string `json:"device_id"`
+}
+
+// rekeyRegister asks Oxipay for a new signing key for the register's device
+// and replaces the old key. The device ID doesn't change so the register stays
+// paired. The register is nil when it couldn't be re-keyed, the response says
+// why
+func rekeyRegister(register *terminal.Register, deviceToken string, user string, browserResponse *Response) (*terminal.Register, *Response) {
+	registrationPayload := newRegistrationPayload(register.FxlSellerID, deviceToken)
+	registrationPayload.DeviceID = register.FxlRegisterID
+
+	if err := registrationPayload.Validate(); err != nil {
+		return nil, errorResponse(validationError("error.registration", err), browserResponse.Locale, browserResponse.Brand)
+	}
+
+	response, browserResponse := createKey(registrationPayload, browserResponse)
+	if response == nil {
+		return nil, browserResponse
+	}
+
+	if err := term.Rekey(user, register, response.Key); err != nil {
+		return nil, errorResponse(err, browserResponse.Locale, browserResponse.Brand)
+	}
+
+	log.WithFields(logrus.Fields{
+		"module":      "terminal",
+		"origin":      register.Origin,
+		"register_id": register.VendRegisterID,
+		"device_id":   register.FxlRegisterID,
+		"user":        user,
+	}).Info("Register re-keyed")
+	return register, browserResponse
+}
+
+// signatureMismatch handles ESIG01, which Oxipay returns when it no longer
+// accepts the key stored for the register. The register is flagged so it can't
+// take payments until it is re-keyed, and the cashier is sent to re-key it.
+// The sale stays in the session so it can be retried straight after
+func signatureMismatch(register *terminal.Register) error {
+	log.WithFields(logrus.Fields{
+		"module":      "terminal",
+		"origin":      register.Origin,
+		"register_id": register.VendRegisterID,
+		"device_id":   register.FxlRegisterID,
+	}).Warn("Oxipay rejected the signing key, the register needs to be re-keyed")
+
+	if err := term.MarkNeedsRekey(register); err != nil {
+		log.Errorf("Unable to flag register %s for re-keying: %s", register.VendRegisterID, err)
+	}
+
+	err := fmt.Errorf("Oxipay returned %s for register %s", oxipay.SignatureMismatch, register.VendRegisterID)
+	return notRegisteredError("rekey.required", err)
+}
+
+// retryURL reopens the payment page for the sale that was pending when the
+// register was paired or re-keyed
+func retryURL(vReq *vend.PaymentRequest) string {
+	if vReq == nil || vReq.Origin == "" || vReq.RegisterID == "" {
+		return ""
+	}
+
+	return "/?" + url.Values{
+		"amount":      {vReq.Amount},
+		"origin":      {vReq.Origin},
+		"register_id": {vReq.RegisterID},
+	}.Encode()
+}
+
+// RekeyHandler replaces the signing key of the register the payment page was
+// opened from, using a new device token from the merchant portal
+func RekeyHandler(w http.ResponseWriter, r *http.Request) {
+	// an unpaired register is sent to pair it instead
+	runSteps(w, r, loadSession, findRegister, rekey)
+}
+
+// rekey replaces the signing key of the register
+func rekey(c *requestContext) error {
+	register, browserResponse := rekeyRegister(c.register, c.r.FormValue("DeviceToken"), "vend-proxy", &Response{
+		Locale: c.locale(),
+		Brand:  c.brand(),
+	})
+
+	// the response says why the register couldn't be re-keyed
+	c.response = browserResponse
+	if register != nil {
+		c.response.template = "register_success.html"
+		c.response.MerchantID = register.FxlSellerID
+		c.response.RegisterID = register.VendRegisterID
+		c.response.RetryURL = retryURL(c.session)
+	}
+	return nil
+}
+
+// AdminRekeyHandler replaces the signing key of a paired register e.g POST
+// /admin/registers/rekey with origin, register_id and device_token. It is part
+// of the admin API
+func AdminRekeyHandler(w http.ResponseWriter, r *http.Request) {
+	if appConfig == nil || appConfig.Admin.Token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !authorisedAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vendproxy"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	origin := r.FormValue("origin")
+	registerID := r.FormValue("register_id")
+	deviceToken := r.FormValue("device_token")
+	if origin == "" || registerID == "" || deviceToken == "" {
+		http.Error(w, "origin, register_id and device_token are required", http.StatusBadRequest)
+		return
+	}
+
+	register, err := lookupRegister(origin, registerID)
+	if err != nil {
+		response := errorResponse(err, i18n.DefaultLocale, brandFor(""))
+		http.Error(w, response.Message, response.HTTPStatus)
+		return
+	}
+
+	register, response := rekeyRegister(register, deviceToken, "admin-api", &Response{
+		Locale: i18n.DefaultLocale,
+		Brand:  brandFor(register.FxlSellerID),
+	})
+	if register == nil {
+		status := response.HTTPStatus
+		if status < http.StatusBadRequest {
+			// Oxipay declined the device token
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, response.Message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rekeyResult{
+		Origin:     register.Origin,
+		RegisterID: register.VendRegisterID,
+		MerchantID: register.FxlSellerID,
+		DeviceID:   register.FxlRegisterID,
+	})
+}
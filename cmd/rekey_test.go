@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAdminRekeyHandler(t *testing.T) {
+	savedConfig, savedLog := appConfig, log
+	defer func() { appConfig, log = savedConfig, savedLog }()
+
+	token := "0123456789abcdef0123456789abcdef"
+	appConfig = &config.HostConfig{Admin: config.AdminConfig{Token: token}}
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	complete := url.Values{
+		"origin":       {"https://example.vendhq.com"},
+		"register_id":  {"r1"},
+		"device_token": {"token"},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		auth     string
+		form     url.Values
+		expected int
+	}{
+		{"no token", http.MethodPost, "", complete, http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "Bearer nope", complete, http.StatusUnauthorized},
+		{"no device token", http.MethodPost, "Bearer " + token, url.Values{"origin": {"https://example.vendhq.com"}, "register_id": {"r1"}}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/admin/registers/rekey", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Authorization", tt.auth)
+
+			w := httptest.NewRecorder()
+			AdminRekeyHandler(w, r)
+
+			if w.Code != tt.expected {
+				t.Errorf("expected %d, got %d: %s", tt.expected, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestSignatureMismatch(t *testing.T) {
+	registers := newMemoryRegisters(pairedRegister())
+	defer useFakes(nil, registers, nil, nil)()
+
+	// a payment that started before the register was re-keyed
+	stale := pairedRegister()
+	stale.FxlDeviceSigningKey = "old-key"
+	signatureMismatch(stale)
+
+	if register, _ := registers.GetRegister(testOrigin, "r1"); register.NeedsRekey {
+		t.Error("expected the register with the new key to keep taking payments")
+	}
+
+	// or was paired with another device
+	other := terminal.NewRegister(testKey, "device-2", "30188105", testOrigin, "r1")
+	signatureMismatch(other)
+
+	if register, _ := registers.GetRegister(testOrigin, "r1"); register.NeedsRekey {
+		t.Error("expected the register paired with device-1 to keep taking payments")
+	}
+
+	signatureMismatch(pairedRegister())
+	if register, _ := registers.GetRegister(testOrigin, "r1"); !register.NeedsRekey {
+		t.Error("expected the register to need re-keying")
+	}
+}
+
+func TestRetryURL(t *testing.T) {
+	vReq := &vend.PaymentRequest{
+		Amount:     "4400",
+		Origin:     "https://example.vendhq.com",
+		RegisterID: "r1",
+	}
+
+	expected := "/?amount=4400&origin=https%3A%2F%2Fexample.vendhq.com&register_id=r1"
+	if got := retryURL(vReq); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	if got := retryURL(nil); got != "" {
+		t.Errorf("expected no retry without a sale, got %s", got)
+	}
+}
+
+func TestRenderRekeyPrompt(t *testing.T) {
+	response := &Response{
+		Locale:     "en-NZ",
+		MerchantID: "30188105",
+		NeedsRekey: true,
+	}
+
+	html, err := renderTemplate("register.html", response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := string(html)
+	for _, want := range []string{`action="/register/rekey"`, "no longer accepts the signing key", "30188105"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected the page to contain %q", want)
+		}
+	}
+
+	response = &Response{Locale: "en-NZ", RetryURL: retryURL(&vend.PaymentRequest{Amount: "4400", Origin: "https://example.vendhq.com", RegisterID: "r1"})}
+	if html, err = renderTemplate("register_success.html", response); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(html), `href="/?amount=4400&amp;origin=https%3A%2F%2Fexample.vendhq.com&amp;register_id=r1"`) {
+		t.Errorf("expected a link to retry the sale, got %s", html)
+	}
+}
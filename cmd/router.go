@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiPrefix is where the current version of the JSON API lives
+const apiPrefix = "/api/v1"
+
+// route is an endpoint of the webserver. Requests with any other method get a
+// 405
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+
+	// legacy is the path the endpoint had before the API was versioned, which
+	// still works for payment pages and scripts that use it
+	legacy string
+}
+
+// routes returns the endpoints of the webserver. The Vend endpoints are only
+// included when the Vend API is configured
+func routes(vendEnabled bool) []route {
+	routes := []route{
+		// pages
+		{method: http.MethodGet, path: "/", handler: Index},
+		{method: http.MethodGet, path: "/register", handler: RegisterHandler},
+		{method: http.MethodPost, path: "/register", handler: RegisterHandler},
+		{method: http.MethodPost, path: "/register/rekey", handler: RekeyHandler},
+
+		// the JSON API used by the payment page
+		{method: http.MethodPost, path: apiPrefix + "/payments", handler: PaymentHandler, legacy: "/pay"},
+		{method: http.MethodPost, path: apiPrefix + "/refunds", handler: RefundHandler, legacy: "/refund"},
+
+		// the admin API
+		{method: http.MethodGet, path: apiPrefix + "/admin/export", handler: ExportHandler, legacy: "/admin/export"},
+		{method: http.MethodGet, path: apiPrefix + "/admin/vend/payment-type", handler: PaymentTypeHandler, legacy: "/admin/vend/payment-type"},
+		{method: http.MethodPost, path: apiPrefix + "/admin/vend/payment-type", handler: PaymentTypeHandler, legacy: "/admin/vend/payment-type"},
+		{method: http.MethodPost, path: apiPrefix + "/admin/registers/import", handler: ImportRegistersHandler, legacy: "/admin/registers/import"},
+		{method: http.MethodPost, path: apiPrefix + "/admin/registers/rekey", handler: AdminRekeyHandler, legacy: "/admin/registers/rekey"},
+		{method: http.MethodGet, path: apiPrefix + "/admin/outlets", handler: OutletsHandler, legacy: "/admin/outlets"},
+		{method: http.MethodPost, path: apiPrefix + "/admin/outlets", handler: OutletsHandler, legacy: "/admin/outlets"},
+		{method: http.MethodDelete, path: apiPrefix + "/admin/outlets", handler: OutletsHandler, legacy: "/admin/outlets"},
+	}
+
+	if vendEnabled {
+		routes = append(routes,
+			route{method: http.MethodGet, path: "/vend/connect", handler: VendConnectHandler},
+			route{method: http.MethodGet, path: "/vend/callback", handler: VendCallbackHandler},
+			route{method: http.MethodPost, path: "/vend/disconnect", handler: VendDisconnectHandler},
+			route{method: http.MethodPost, path: "/vend/webhook", handler: VendWebhookHandler},
+			route{method: http.MethodGet, path: "/portal", handler: PortalHandler},
+			route{method: http.MethodPost, path: "/portal/pair", handler: PortalPairHandler},
+			route{method: http.MethodPost, path: "/portal/unpair", handler: PortalUnpairHandler},
+		)
+	}
+	return routes
+}
+
+// newRouter returns the routes wrapped in the middleware every request goes
+// through
+func newRouter(routes []route, timeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+
+	// We are hosting all of the assets, as the resources are required by the
+	// frontend.
+	fileServer := http.FileServer(http.FS(assetFS))
+	mux.Handle("/assets/", methods("/assets/", map[string]http.Handler{
+		http.MethodGet: http.StripPrefix("/assets/", fileServer),
+	}))
+
+	// the patterns are plain paths so they mean the same on every version of
+	// Go, the method is checked by methods
+	byPath := make(map[string]map[string]http.Handler)
+	var paths []string
+	add := func(path string, method string, handler http.Handler) {
+		if byPath[path] == nil {
+			byPath[path] = make(map[string]http.Handler)
+			paths = append(paths, path)
+		}
+		byPath[path][method] = handler
+	}
+
+	for _, route := range routes {
+		add(route.path, route.method, route.handler)
+		if route.legacy != "" {
+			add(route.legacy, route.method, route.handler)
+		}
+	}
+
+	for _, path := range paths {
+		mux.Handle(path, methods(path, byPath[path]))
+	}
+
+	return chain(mux,
+		requestID,
+		accessLog,
+		recoverPanic,
+		withTimeout(timeout),
+		securityHeaders,
+		vendCORS,
+	)
+}
+
+// methods sends the request to the handler for its method, or responds with a
+// 405 listing the methods the path accepts. GET handlers also answer HEAD, and
+// the index page doesn't answer for every path the way / does in a ServeMux
+func methods(path string, handlers map[string]http.Handler) http.Handler {
+	allowed := make([]string, 0, len(handlers)+1)
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	if _, ok := handlers[http.MethodGet]; ok {
+		if _, ok := handlers[http.MethodHead]; !ok {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	sort.Strings(allowed)
+	allow := strings.Join(allowed, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path == "/" && r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+
+		handler, ok := handlers[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			handler, ok = handlers[http.MethodGet]
+		}
+		if !ok {
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
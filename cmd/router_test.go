@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRouter(t *testing.T) {
+	savedConfig, savedLog := appConfig, log
+	defer func() { appConfig, log = savedConfig, savedLog }()
+	appConfig = nil
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	// every route can be registered alongside the others
+	newRouter(routes(true), 0)
+	router := newRouter(routes(false), 0)
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+		allow    string
+	}{
+		{http.MethodGet, "/api/v1/payments", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodPost, "/api/v1/payments", http.StatusBadRequest, ""},
+		{http.MethodPost, "/pay", http.StatusBadRequest, ""},
+		{http.MethodGet, "/refund", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodPut, "/api/v1/admin/outlets", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, POST"},
+		{http.MethodGet, "/api/v1/admin/outlets", http.StatusNotFound, ""},
+		{http.MethodDelete, "/register", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+		{http.MethodGet, "/vend/connect", http.StatusNotFound, ""},
+		{http.MethodGet, "/nothing-here", http.StatusNotFound, ""},
+		{http.MethodGet, "/assets/js/pay.js", http.StatusOK, ""},
+		{http.MethodHead, "/assets/js/pay.js", http.StatusOK, ""},
+		{http.MethodPost, "/assets/js/pay.js", http.StatusMethodNotAllowed, "GET, HEAD"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("amount=lots"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.expected, w.Code)
+		}
+
+		if allow := w.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.allow, allow)
+		}
+
+		// the middleware runs for every route, even ones that don't exist
+		if w.Header().Get(requestIDHeader) == "" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s %s: expected the middleware to run, got %v", tt.method, tt.path, w.Header())
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+)
+
+var (
+	templatesMu sync.Mutex
+	templates   *template.Template
+
+	// receiptTemplate replaces the built in receipt.html when the
+	// configuration names a receipt template of its own
+	receiptTemplate *template.Template
+)
+
+// loadTemplates parses every template in the assets. When the assets are
+// served from disk they are parsed on each render so changes show up without
+// a restart.
+func loadTemplates() (*template.Template, error) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+
+	if templates != nil && !reloadTemplates {
+		return templates, nil
+	}
+
+	parsed, err := template.New("").ParseFS(assetFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	templates = parsed
+	return templates, nil
+}
+
+// renderTemplate executes the named template with the data. Templates are
+// referred to by their file name e.g "declined.html"
+func renderTemplate(name string, data interface{}) ([]byte, error) {
+	tmpl, err := loadTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl.Lookup(name) == nil {
+		return nil, fmt.Errorf("template %s: %w", name, fs.ErrNotExist)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadReceiptTemplate parses a receipt template from disk. It is executed with
+// the same data as the built in receipt.html
+func loadReceiptTemplate(file string) (*template.Template, error) {
+	return template.New(filepath.Base(file)).ParseFiles(file)
+}
+
+// renderReceipt renders the receipt Vend prints for the transaction
+func renderReceipt(response *Response) ([]byte, error) {
+	if receiptTemplate == nil {
+		return renderTemplate("receipt.html", response)
+	}
+
+	var buf bytes.Buffer
+	if err := receiptTemplate.Execute(&buf, response); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// attachReceipt adds the receipt to approved, declined and failed
+// transactions. A receipt that can't be rendered is logged rather than
+// failing a transaction that has already been processed
+func attachReceipt(response *Response) {
+	switch response.Status {
+	case statusAccepted, statusDeclined, statusFailed:
+	default:
+		return
+	}
+
+	if response.Timestamp.IsZero() {
+		response.Timestamp = time.Now()
+	}
+
+	receipt, err := renderReceipt(response)
+	if err != nil {
+		log.Errorf("Unable to render the receipt: %s", err)
+		return
+	}
+	response.ReceiptHTML = string(receipt)
+}
+
+// outcomeTemplate returns the template used to explain the outcome of a
+// payment to the cashier, if there is one
+func outcomeTemplate(status string) string {
+	switch status {
+	case statusDeclined:
+		return "declined.html"
+	case statusFailed:
+		return "failed.html"
+	case statusTimeout:
+		return "timeout.html"
+	}
+	return ""
+}
+
+// FormattedAmount converts the amount in cents to dollars for display
+func (r *Response) FormattedAmount() string {
+	cents, err := strconv.ParseInt(r.Amount, 10, 64)
+	if err != nil {
+		return r.Amount
+	}
+	return formatDollars(cents)
+}
+
+// formatDollars formats an amount in cents for display e.g -6990 is -$69.90
+func formatDollars(cents int64) string {
+	if cents < 0 {
+		return "-$" + transaction.FormatAmount(-cents)
+	}
+	return "$" + transaction.FormatAmount(cents)
+}
+
+// T translates the message key into the locale of the response and fills in
+// the branding. Any args are formatted into the message
+func (r *Response) T(key string, args ...interface{}) string {
+	message := r.Brand.Apply(messages.Translate(r.Locale, key))
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// Locales are the languages the cashier can choose from
+func (r *Response) Locales() []string {
+	return messages.Locales()
+}
+
+// IsRefund returns true when the response is for a refund, which Vend sends
+// as a negative amount
+func (r *Response) IsRefund() bool {
+	return strings.HasPrefix(r.Amount, "-")
+}
+
+// PurchaseNumber is the Oxipay purchase number, which is the ID we send to
+// Vend for approved transactions
+func (r *Response) PurchaseNumber() string {
+	return r.ID
+}
+
+// writeTemplate renders the template for the response to the browser, or a
+// 404 if the template doesn't exist
+func writeTemplate(w http.ResponseWriter, r *http.Request, response *Response) {
+	writePage(w, r, response.template, response.HTTPStatus, response)
+}
+
+// writePage renders the named template with the data to the browser, or a 404
+// if the template doesn't exist
+func writePage(w http.ResponseWriter, r *http.Request, name string, status int, data interface{}) {
+	page, err := renderTemplate(name, data)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Unable to find template %s", name)
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Errorf("Unable to render %s: %s", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(page)
+}
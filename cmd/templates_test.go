@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/branding"
+)
+
+func TestRenderOutcomeEscapesMessage(t *testing.T) {
+	response := &Response{
+		Status:  statusDeclined,
+		Message: "<script>alert('declined')</script>",
+	}
+
+	html, err := renderTemplate(outcomeTemplate(response.Status), response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(html), "<script>") {
+		t.Errorf("expected the message to be escaped, got %s", html)
+	}
+
+	if !strings.Contains(string(html), "has been declined") {
+		t.Errorf("expected the status to be rendered, got %s", html)
+	}
+}
+
+func TestRenderTranslatedPages(t *testing.T) {
+	pages := []string{
+		"index.html",
+		"refund.html",
+		"register.html",
+		"register_success.html",
+		"declined.html",
+		"failed.html",
+		"timeout.html",
+		"receipt.html",
+		"vend_connect.html",
+	}
+
+	for _, page := range pages {
+		response := &Response{
+			Locale:     "mi-NZ",
+			Message:    "Kua whakakāhoretia",
+			MerchantID: "30188105",
+		}
+
+		html, err := renderTemplate(page, response)
+		if err != nil {
+			t.Errorf("unable to render %s: %s", page, err)
+			continue
+		}
+
+		if strings.Contains(string(html), "{{") {
+			t.Errorf("%s contains unrendered template actions", page)
+		}
+	}
+}
+
+func TestRenderUsesLocale(t *testing.T) {
+	response := &Response{Status: statusDeclined, Locale: "mi-NZ"}
+
+	html, err := renderTemplate("declined.html", response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(html), messages.Translate("mi-NZ", "declined.title")) {
+		t.Errorf("expected the page to be translated, got %s", html)
+	}
+}
+
+func TestRenderUsesBrand(t *testing.T) {
+	// the humm profile we ship, which only sets what humm needs
+	contents, err := os.ReadFile(filepath.Join("..", "configs", "vendproxy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shipped struct {
+		Branding branding.Config `json:"branding"`
+	}
+	if err := json.Unmarshal(contents, &shipped); err != nil {
+		t.Fatal(err)
+	}
+
+	humm := shipped.Branding.Resolve("")
+	if problems := shipped.Branding.Validate(); len(problems) != 0 {
+		t.Fatalf("expected the shipped branding to be valid, got %v", problems)
+	}
+
+	for _, page := range []string{"index.html", "register.html", "register_success.html", "declined.html", "failed.html"} {
+		response := &Response{
+			Locale:  "en-NZ",
+			Brand:   humm,
+			Message: humm.Apply("Please contact {product} at {support_email}"),
+		}
+
+		html, err := renderTemplate(page, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rendered := string(html)
+		if strings.Contains(strings.ToLower(rendered), "oxipay") || strings.Contains(rendered, "{product}") {
+			t.Errorf("%s: expected every mention of the brand to be humm, got %s", page, rendered)
+		}
+	}
+
+	html, err := renderTemplate("register.html", &Response{Locale: "en-NZ", Brand: humm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Pair humm with Vend", "/assets/images/humm.svg", "mailto:support@shophumm.co.nz"} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("expected the page to contain %q", want)
+		}
+	}
+}
+
+func TestAttachReceipt(t *testing.T) {
+	response := &Response{
+		ID:         "P1234",
+		Amount:     "4400",
+		Status:     statusAccepted,
+		MerchantID: "30188105",
+		Locale:     "en-NZ",
+		Timestamp:  time.Date(2018, 11, 5, 14, 30, 0, 0, time.UTC),
+		Brand: branding.Profile{
+			ProductName:   "humm",
+			ReceiptFooter: "Terms & conditions apply",
+		},
+	}
+
+	attachReceipt(response)
+
+	for _, want := range []string{"APPROVED", "humm Purchase #", "P1234", "$44.00", "30188105", "05/11/2018 14:30", "Terms &amp; conditions apply"} {
+		if !strings.Contains(response.ReceiptHTML, want) {
+			t.Errorf("expected the receipt to contain %q, got %s", want, response.ReceiptHTML)
+		}
+	}
+
+	refund := &Response{Amount: "-6990", Status: statusAccepted, Locale: "en-NZ"}
+	attachReceipt(refund)
+	if !strings.Contains(refund.ReceiptHTML, "REFUNDED") || !strings.Contains(refund.ReceiptHTML, "-$69.90") {
+		t.Errorf("expected a refund receipt, got %s", refund.ReceiptHTML)
+	}
+
+	timeout := &Response{Status: statusTimeout}
+	attachReceipt(timeout)
+	if timeout.ReceiptHTML != "" {
+		t.Errorf("expected no receipt for a timeout, got %s", timeout.ReceiptHTML)
+	}
+}
+
+func TestCustomReceiptTemplate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "receipt.html")
+	if err := os.WriteFile(file, []byte(`<p>{{.T "receipt.purchase_number"}} {{.PurchaseNumber}}</p>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := loadReceiptTemplate(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiptTemplate = tmpl
+	defer func() { receiptTemplate = nil }()
+
+	response := &Response{ID: "P1234", Status: statusAccepted, Locale: "en-NZ"}
+	attachReceipt(response)
+
+	if response.ReceiptHTML != "<p>Oxipay Purchase # P1234</p>" {
+		t.Errorf("expected the custom receipt, got %q", response.ReceiptHTML)
+	}
+}
+
+func TestRenderMissingTemplate(t *testing.T) {
+	_, err := renderTemplate("missing.html", &Response{})
+	if err == nil {
+		t.Error("expected an error for a missing template")
+	}
+}
+
+func TestFormattedAmount(t *testing.T) {
+	tests := map[string]string{
+		"4400":  "$44.00",
+		"5":     "$0.05",
+		"-6990": "-$69.90",
+		"":      "",
+	}
+
+	for cents, expected := range tests {
+		response := &Response{Amount: cents}
+		if got := response.FormattedAmount(); got != expected {
+			t.Errorf("FormattedAmount(%q) = %q, want %q", cents, got, expected)
+		}
+	}
+}
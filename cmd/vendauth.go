@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/secret"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// vendSessionName is the session used while connecting to Vend
+const vendSessionName = "vend"
+
+// The states of the connection shown on vend_connect.html
+const (
+	statusConnected    = "CONNECTED"
+	statusDisconnected = "DISCONNECTED"
+)
+
+var vendOAuth *vend.OAuthConfig
+
+var vendTokens *vend.TokenStore
+
+// vendClient calls the Vend API with the retailer's tokens. It is nil unless
+// the Vend API has been configured
+var vendClient vend.Client
+
+// setupVend creates the Vend API client from the configuration
+func setupVend(vendConfig config.VendConfig) error {
+	key, err := secret.ParseKey(vendConfig.TokenKey)
+	if err != nil {
+		return err
+	}
+
+	box, err := secret.NewBox(key)
+	if err != nil {
+		return err
+	}
+
+	vendOAuth = &vend.OAuthConfig{
+		ClientID:     vendConfig.ClientID,
+		ClientSecret: vendConfig.ClientSecret,
+		RedirectURL:  vendConfig.RedirectURL,
+		AuthURL:      vendConfig.AuthURL,
+		TokenURL:     vendConfig.TokenURL,
+	}
+	vendTokens = vend.NewTokenStore(db, box, vendOAuth)
+	vendClient = vend.NewClient(vendTokens, log)
+	return nil
+}
+
+// VendConnectHandler sends the retailer to Vend to give us access to their
+// store
+func VendConnectHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := getSession(r, vendSessionName)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	state, err := newState()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	session.Values["state"] = state
+	if err := sessions.Save(r, w); err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, vendOAuth.AuthCodeURL(state), http.StatusFound)
+}
+
+// VendCallbackHandler is where Vend sends the retailer back to with the code
+// we swap for their tokens
+func VendCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cxLog := log.WithFields(logrus.Fields{
+		"module": "vend",
+		"call":   "VendCallbackHandler",
+	})
+
+	session, err := getSession(r, vendSessionName)
+	if err != nil {
+		cxLog.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	// the state can only be used once
+	expected, _ := session.Values["state"].(string)
+	delete(session.Values, "state")
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		cxLog.Warnf("Retailer did not connect: %s", reason)
+		sessions.Save(r, w)
+		http.Redirect(w, r, "/vend/connect", http.StatusFound)
+		return
+	}
+
+	state := query.Get("state")
+	if expected == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		cxLog.Warn("OAuth state does not match the session")
+		http.Error(w, "This link has expired, please connect to Vend again", http.StatusBadRequest)
+		return
+	}
+
+	token, err := vendOAuth.Exchange(r.Context(), query.Get("code"), query.Get("domain_prefix"))
+	if err != nil {
+		cxLog.Errorf("Unable to exchange the code for a token: %s", err)
+		http.Error(w, "Unable to connect to Vend", http.StatusBadGateway)
+		return
+	}
+
+	if err := vendTokens.Save(token); err != nil {
+		cxLog.Errorf("Unable to save the token: %s", err)
+		http.Error(w, "Unable to connect to Vend", http.StatusServiceUnavailable)
+		return
+	}
+
+	// remember who connected so they can disconnect again
+	session.Values["origin"] = token.Origin
+	if err := sessions.Save(r, w); err != nil {
+		cxLog.Error(err)
+	}
+
+	cxLog.WithField("origin", token.Origin).Info("Retailer connected to Vend")
+
+	// the page has a form to disconnect again
+	csrf, err := sessionCSRF(w, r, session)
+	if err != nil {
+		cxLog.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writePage(w, r, "vend_connect.html", http.StatusOK, &portalPage{
+		Response: &Response{
+			Status: statusConnected,
+			Origin: token.Origin,
+			Locale: requestLocale(r, nil),
+			Brand:  brandFor(""),
+		},
+		CSRF: csrf,
+	})
+}
+
+// VendDisconnectHandler removes the retailer's tokens. Either the retailer who
+// connected in this session or an admin, who names the origin, can disconnect
+func VendDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := getSession(r, vendSessionName)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	// admins use a bearer token rather than the session, so only the
+	// retailer's form needs the session's CSRF token
+	origin, _ := session.Values["origin"].(string)
+	if authorisedAdmin(r) {
+		origin = r.FormValue("origin")
+	} else if !validCSRF(r, session) {
+		origin = ""
+	}
+
+	if origin == "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := vendTokens.Delete(origin); err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusServiceUnavailable)
+		return
+	}
+
+	delete(session.Values, "origin")
+	sessions.Save(r, w)
+
+	log.WithFields(logrus.Fields{"module": "vend", "origin": origin}).Info("Retailer disconnected from Vend")
+
+	sendResponse(w, r, &Response{
+		Status:     statusDisconnected,
+		Origin:     origin,
+		Locale:     requestLocale(r, nil),
+		Brand:      brandFor(""),
+		HTTPStatus: http.StatusOK,
+		template:   "vend_connect.html",
+	})
+}
+
+// newState returns a random value to tie the callback to the session that
+// started the connection
+func newState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
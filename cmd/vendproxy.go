@@ -7,21 +7,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
+	"github.com/oxipay/oxipay-vend/assets"
+	"github.com/oxipay/oxipay-vend/internal/pkg/branding"
 	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/i18n"
 	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
 	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
 	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
 	logrus "github.com/sirupsen/logrus"
 	"github.com/srinathgs/mysqlstore"
@@ -41,19 +46,31 @@ const (
 // Response We build a JSON response object that contains important information for
 // which step we should send back to Vend to guide the payment flow.
 type Response struct {
-	ID           string `json:"id,omitempty"`
-	Amount       string `json:"amount"`
-	RegisterID   string `json:"register_id"`
-	Status       string `json:"status"`
-	Signature    string `json:"-"`
-	TrackingData string `json:"tracking_data,omitempty"`
-	Message      string `json:"message,omitempty"`
-	HTTPStatus   int    `json:"-"`
-	file         string
+	ID            string           `json:"id,omitempty"`
+	TransactionID string           `json:"transaction_id,omitempty"`
+	Amount        string           `json:"amount"`
+	RegisterID    string           `json:"register_id"`
+	Status        string           `json:"status"`
+	Step          string           `json:"step,omitempty"` // the Vend step to take when the request failed
+	Signature     string           `json:"-"`
+	TrackingData  string           `json:"tracking_data,omitempty"`
+	Message       string           `json:"message,omitempty"`
+	HTML          string           `json:"html,omitempty"`
+	ReceiptHTML   string           `json:"receipt_html,omitempty"`
+	MerchantID    string           `json:"-"`
+	Origin        string           `json:"-"`
+	Locale        string           `json:"-"`
+	Brand         branding.Profile `json:"-"`
+	Timestamp     time.Time        `json:"-"`
+	HTTPStatus    int              `json:"-"`
+	RedirectURL   string           `json:"redirect_url,omitempty"` // the payment page goes here instead of showing the outcome
+	NeedsRekey    bool             `json:"-"`
+	RetryURL      string           `json:"-"` // reopens the payment page for the pending sale
+	template      string
 }
 
 // DbSessionStore is the database session storage manager
-var DbSessionStore *mysqlstore.MySQLStore
+var DbSessionStore sessions.Store
 
 var log *logrus.Logger
 
@@ -63,31 +80,63 @@ var oxipayClient oxipay.Client
 
 var db *sql.DB
 
-var term *terminal.Terminal
+// registerStore keeps the register pairings and outlet mappings. It is a
+// *terminal.Terminal outside of tests
+type registerStore interface {
+	GetRegister(originDomain string, vendRegisterID string) (*terminal.Register, error)
+	ListRegisters(originDomain string) ([]*terminal.Register, error)
+	Save(user string, register *terminal.Register) (bool, error)
+	Rekey(user string, register *terminal.Register, key string) error
+	MarkNeedsRekey(register *terminal.Register) error
+	Delete(user string, originDomain string, vendRegisterID string) error
+	SaveOutlet(user string, outlet *terminal.Outlet) error
+	OutletMerchant(originDomain string, vendOutletID string) (string, error)
+	ListOutlets(originDomain string) ([]*terminal.Outlet, error)
+	DeleteOutlet(originDomain string, vendOutletID string) error
+}
 
-func main() {
-	// default configuration file for prod
-	configurationFile := "/etc/vendproxy/vendproxy.json"
-	if os.Getenv("DEV") != "" {
-		// default configuration file for dev
-		configurationFile = "../configs/vendproxy.json"
-	}
+// transactionStore keeps the payments and refunds. It is a *transaction.Store
+// outside of tests
+type transactionStore interface {
+	Create(txn *transaction.Transaction) error
+	Complete(txn *transaction.Transaction) error
+	SetVendSaleStatus(id string, status string) error
+	ClaimVoidRefund(id string) (bool, error)
+	ReleaseVoidRefund(id string) error
+	Search(filter transaction.Filter) ([]*transaction.Transaction, error)
+	Each(filter transaction.Filter, fn func(*transaction.Transaction) error) error
+}
 
-	// load config
-	appConfig, err := config.ReadApplicationConfig(configurationFile)
-	if err != nil {
-		logrus.Fatal(err)
-	}
+var term registerStore
 
-	// init our logging framework
-	level, err := logrus.ParseLevel(appConfig.LogLevel)
-	if err != nil {
-		logrus.Fatalf("Level %s is not a valid log level. Try setting 'info' in production ", level)
-	}
+var transactions transactionStore
+
+// messages translates customer and cashier messages
+var messages = i18n.Default()
+
+// responseCodes decides how we treat each code returned by Oxipay
+var responseCodes = oxipay.DefaultResponseCatalogue()
+
+// assetFS contains the css, js, images and templates. They are compiled in
+// but can be overridden with a directory on disk for development
+var assetFS fs.FS = assets.FS
+
+// reloadTemplates is set when the assets come from disk
+var reloadTemplates bool
 
-	log = initLogger(level)
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// serve starts the webserver and blocks until it exits
+func serve(opts *options) int {
+	var err error
+
+	// load config
+	appConfig, err = loadConfig(opts)
 	if err != nil {
-		log.Fatalf("Configuration Error: %s ", err)
+		logrus.Error(err)
+		return 1
 	}
 
 	db = connectToDatabase(appConfig.Database)
@@ -101,34 +150,70 @@ func main() {
 		log,
 	)
 
-	term = terminal.NewTerminal(db)
+	term = terminal.NewCachedTerminal(db, appConfig.RegisterCacheTTL())
 
-	// We are hosting all of the content in ./assets, as the resources are
-	// required by the frontend.
-	fileServer := http.FileServer(http.Dir("../assets"))
-	http.Handle("/assets/", http.StripPrefix("/assets/", fileServer))
-	http.HandleFunc("/", Index)
-	http.HandleFunc("/pay", PaymentHandler)
-	http.HandleFunc("/register", RegisterHandler)
-	http.HandleFunc("/refund", RefundHandler)
+	transactions = transaction.NewStore(db)
 
-	// The default port is 500, but one can be specified as an env var if needed.
-	port := appConfig.Webserver.Port
+	messages, err = i18n.Load(appConfig.Locale)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
 
-	log.Infof("Starting webserver on port %s \n", port)
+	if appConfig.ReceiptTemplate != "" {
+		receiptTemplate, err = loadReceiptTemplate(appConfig.ReceiptTemplate)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		log.Infof("Loaded receipt template from %s", appConfig.ReceiptTemplate)
+	}
+
+	if appConfig.Oxipay.ResponseCodes != "" {
+		responseCodes, err = oxipay.LoadResponseCatalogue(appConfig.Oxipay.ResponseCodes)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		log.Infof("Loaded response codes from %s", appConfig.Oxipay.ResponseCodes)
+	}
+
+	if appConfig.Vend.Enabled() {
+		if err := setupVend(appConfig.Vend); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+
+	router := newRouter(routes(appConfig.Vend.Enabled()), appConfig.RequestTimeout())
+
+	// The port comes from the configuration unless we are told where to listen
+	listen := opts.listen
+	if listen == "" {
+		listen = ":" + appConfig.Webserver.Port
+	}
+
+	log.Infof("Starting webserver on %s \n", listen)
+
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
 
 	//defer sessionStore.Close()
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Error(server.ListenAndServe())
 
 	// @todo handle shutdowns
+	return 1
 }
 
-func initLogger(logLevel logrus.Level) *logrus.Logger {
+func initLogger(logLevel logrus.Level, out io.Writer) *logrus.Logger {
 
 	logger := logrus.New()
 	logger.Formatter = &logrus.JSONFormatter{}
 
-	logger.SetOutput(os.Stdout)
+	logger.SetOutput(out)
 
 	// Only log the warning severity or above.
 	logger.SetLevel(logLevel)
@@ -166,7 +251,8 @@ func connectToDatabase(params config.DbConnection) *sql.DB {
 		params.Timeout,
 	)
 
-	log.Infof("Attempting to connect to database %s\n", dsn)
+	// never log the password
+	log.Infof("Attempting to connect to database %s on %s as %s", params.Name, params.Host, params.Username)
 
 	// connect to the database
 	// @todo grab config
@@ -250,155 +336,261 @@ func getSession(r *http.Request, sessionName string) (*sessions.Session, error)
 
 // RegisterHandler GET request. Prompt for the Merchant ID and Device Token
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest(r)
-	browserResponse := &Response{}
-	switch r.Method {
-	case http.MethodPost:
+	if r.Method == http.MethodPost {
+		runSteps(w, r, bindRegistration, loadSession, pair)
+		return
+	}
 
-		// Bind the request from the browser to an Oxipay Registration Payload
-		registrationPayload, err := bindToRegistrationPayload(r)
+	browserResponse := &Response{
+		Locale:     requestLocale(r, nil),
+		Brand:      brandFor(""),
+		HTTPStatus: http.StatusOK,
+		template:   "register.html",
+	}
 
-		if err != nil {
-			browserResponse.HTTPStatus = http.StatusBadRequest
-			browserResponse.Message = err.Error()
-			sendResponse(w, r, browserResponse)
+	// a register that is already paired can be re-keyed instead
+	if vendPaymentRequest, err := getPaymentRequestFromSession(r); err == nil {
+		if register, err := term.GetRegister(vendPaymentRequest.Origin, vendPaymentRequest.RegisterID); err == nil {
+			browserResponse.MerchantID = register.FxlSellerID
+			browserResponse.RegisterID = register.VendRegisterID
+			browserResponse.NeedsRekey = register.NeedsRekey
 		}
+	}
+	sendResponse(w, r, browserResponse)
+}
 
-		err = registrationPayload.Validate()
-		if err != nil {
-			browserResponse.HTTPStatus = http.StatusBadRequest
-			browserResponse.Message = err.Error()
-			sendResponse(w, r, browserResponse)
-			return
-		}
+// bindRegistration reads the merchant ID and device token posted by the
+// cashier
+func bindRegistration(c *requestContext) error {
+	// Bind the request from the browser to an Oxipay Registration Payload
+	registrationPayload, err := bindToRegistrationPayload(c.r)
+	if err != nil {
+		return validationError("error.registration", err)
+	}
+	c.payload = registrationPayload
+
+	// the cashier can choose the language used at the register
+	if registerLocale := c.r.Form.Get("Locale"); messages.Supports(registerLocale) {
+		c.lang = registerLocale
+	}
+
+	if err := registrationPayload.Validate(); err != nil {
+		return validationError("error.registration", err)
+	}
+	return nil
+}
+
+// pair pairs the register the payment page was opened from
+func pair(c *requestContext) error {
+	outletID := registerOutlet(c.r.Context(), c.session.Origin, c.session.RegisterID)
+	register, browserResponse := pairRegister(c.payload, c.session.Origin, c.session.RegisterID, outletID, c.lang, "vend-proxy", &Response{
+		Locale: c.locale(),
+		Brand:  c.brand(),
+	})
+
+	// the response says why the register couldn't be paired
+	c.response = browserResponse
+	if register != nil {
+		c.response.template = "register_success.html"
+		c.response.MerchantID = register.FxlSellerID
+		c.response.RegisterID = register.VendRegisterID
+		c.response.RetryURL = retryURL(c.session)
+	}
+	return nil
+}
 
-		vendPaymentRequest, err := getPaymentRequestFromSession(r)
-		if err == nil {
-
-			// sign the message
-			registrationPayload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(registrationPayload), registrationPayload.DeviceToken)
-
-			// submit to oxipay
-			response, err := oxipayClient.RegisterPosDevice(registrationPayload)
-
-			if err != nil {
-				log.Error(err)
-				browserResponse.Message = "We are unable to process this request "
-				browserResponse.HTTPStatus = http.StatusBadGateway
-			}
-
-			// ensure the response came from Oxipay
-			signedResponse, err := response.Authenticate(registrationPayload.DeviceToken)
-			if !signedResponse || err != nil {
-				browserResponse.Message = "The signature returned from Oxipay does not match the expected signature"
-				browserResponse.HTTPStatus = http.StatusBadRequest
-			} else {
-				// process the response
-				browserResponse = processOxipayResponse(response, oxipay.Registration, "")
-				if browserResponse.Status == statusAccepted {
-					log.Info("Device Successfully Registered in Oxipay")
-
-					register := terminal.NewRegister(
-						response.Key,
-						registrationPayload.DeviceID,
-						registrationPayload.MerchantID,
-						vendPaymentRequest.Origin,
-						vendPaymentRequest.RegisterID,
-					)
-
-					_, err := term.Save("vend-proxy", register)
-					if err != nil {
-						log.Error(err)
-						browserResponse.Message = "Unable to process request"
-						browserResponse.HTTPStatus = http.StatusServiceUnavailable
-
-					} else {
-						browserResponse.file = "../assets/templates/register_success.html"
-					}
-				}
-			}
-		} else {
-			log.Error(err.Error())
-			browserResponse.Message = "Sorry. We are unable to process this registration. Please contact support"
-			browserResponse.HTTPStatus = http.StatusBadRequest
+// pairRegister registers the device with Oxipay and pairs it with the Vend
+// register. The register is nil when it couldn't be paired, the response says
+// why
+func pairRegister(registrationPayload *oxipay.RegistrationPayload, origin string, registerID string, outletID string, locale string, createdBy string, browserResponse *Response) (*terminal.Register, *Response) {
+	// check before the device token is used up
+	if err := checkOutletMerchant(origin, outletID, registrationPayload.MerchantID); err != nil {
+		if errorKindOf(err) == kindValidation {
+			log.WithField("origin", origin).Warnf("Unable to pair register %s: %s", registerID, err)
 		}
-	default:
-		browserResponse.HTTPStatus = http.StatusOK
-		browserResponse.file = "../assets/templates/register.html"
+		return nil, errorResponse(err, browserResponse.Locale, browserResponse.Brand)
 	}
 
-	log.Print(browserResponse.Message)
-	sendResponse(w, r, browserResponse)
-	return
+	response, browserResponse := createKey(registrationPayload, browserResponse)
+	if response == nil {
+		return nil, browserResponse
+	}
+	log.Info("Device Successfully Registered in Oxipay")
+
+	register := terminal.NewRegister(
+		response.Key,
+		registrationPayload.DeviceID,
+		registrationPayload.MerchantID,
+		origin,
+		registerID,
+	)
+	register.VendOutletID = outletID
+	register.Locale = locale
+
+	if _, err := term.Save(createdBy, register); err != nil {
+		return nil, errorResponse(err, browserResponse.Locale, browserResponse.Brand)
+	}
+	return register, browserResponse
+}
+
+// createKey registers the device with Oxipay and returns the response holding
+// the signing key. The response is nil when Oxipay didn't accept the device,
+// the browser response says why
+func createKey(registrationPayload *oxipay.RegistrationPayload, browserResponse *Response) (*oxipay.Response, *Response) {
+	// sign the message
+	registrationPayload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(registrationPayload), registrationPayload.DeviceToken)
+
+	// submit to oxipay
+	response, err := oxipayClient.RegisterPosDevice(registrationPayload)
+	if err != nil {
+		return nil, errorResponse(gatewayUnreachableError(err), browserResponse.Locale, browserResponse.Brand)
+	}
+
+	// ensure the response came from Oxipay
+	if err := authenticate(response, registrationPayload.DeviceToken); err != nil {
+		return nil, errorResponse(err, browserResponse.Locale, browserResponse.Brand)
+	}
+
+	// process the response
+	browserResponse = processOxipayResponse(response, oxipay.Registration, "", browserResponse.Locale, browserResponse.Brand)
+	if browserResponse.Status != statusAccepted {
+		return nil, browserResponse
+	}
+	return response, browserResponse
 }
 
-func processOxipayResponse(oxipayResponse *oxipay.Response, responseType oxipay.ResponseType, amount string) *Response {
+// authenticate checks the response was signed with the key, so it came from
+// Oxipay
+func authenticate(response *oxipay.Response, key string) error {
+	valid, err := response.Authenticate(key)
+	if err == nil && !valid {
+		err = errors.New("the signature does not match the expected signature")
+	}
+	if err != nil {
+		return signatureInvalidError(err)
+	}
+	return nil
+}
 
-	// Specify an external transaction ID. This value can be sent back to Vend with
-	// the "ACCEPT" step as the JSON key "transaction_id".
-	// shortID, _ := shortid.Generate()
+func processOxipayResponse(oxipayResponse *oxipay.Response, responseType oxipay.ResponseType, amount string, locale string, brand branding.Profile) *Response {
 
 	// Build our response content, including the amount approved and the Vend
 	// register that originally sent the payment.
-	response := &Response{}
+	response := &Response{
+		Locale:    locale,
+		Brand:     brand,
+		Timestamp: time.Now(),
+	}
+
+	oxipayResponseCode := responseCodes.Lookup(responseType, oxipayResponse.Code)
 
-	var oxipayResponseCode *oxipay.ResponseCode
-	switch responseType {
-	case oxipay.Authorisation:
-		oxipayResponseCode = oxipay.ProcessAuthorisationResponses()(oxipayResponse.Code)
-	case oxipay.Adjustment:
-		oxipayResponseCode = oxipay.ProcessSalesAdjustmentResponse()(oxipayResponse.Code)
-	case oxipay.Registration:
-		oxipayResponseCode = oxipay.ProcessRegistrationResponse()(oxipayResponse.Code)
+	if oxipayResponseCode.Unknown {
+		// make sure new codes stand out rather than looking like server errors
+		log.WithFields(logrus.Fields{
+			"module":        "proxy",
+			"response_type": responseType.String(),
+			"code":          oxipayResponse.Code,
+			"message":       oxipayResponse.Message,
+		}).Warn("Unknown Oxipay response code, add it to the response code catalogue")
 	}
 
-	if oxipayResponseCode == nil || oxipayResponseCode.TxnStatus == "" {
+	if oxipayResponseCode.TxnStatus == "" {
+		// Oxipay answered, the catalogue entry for the code is broken
+		err := fmt.Errorf("the response code catalogue has no transaction status for %q", oxipayResponse.Code)
+		return errorResponse(internalError("", err), locale, brand)
+	}
+
+	customerMessage := brand.Apply(translateResponseCode(responseType, oxipayResponse.Code, oxipayResponseCode, locale))
 
-		response.Message = "Unable to estabilish communication with Oxipay"
-		response.HTTPStatus = http.StatusBadRequest
-		return response
+	// the cashier can try again with codes we know are temporary
+	step := errorOutcomes[kindDeclined].step
+	if oxipayResponseCode.Retryable && !oxipayResponseCode.Unknown {
+		step = stepRetry
 	}
 
 	switch oxipayResponseCode.TxnStatus {
 	case oxipay.StatusApproved:
-		log.Infof("Status: %f", oxipayResponseCode.LogMessage)
+		log.Infof("Status: %s", oxipayResponseCode.LogMessage)
 		response.Amount = amount
 		response.ID = oxipayResponse.PurchaseNumber
 		response.Status = statusAccepted
 		response.HTTPStatus = http.StatusOK
-		response.Message = oxipayResponseCode.CustomerMessage
+		response.Message = customerMessage
 	case oxipay.StatusDeclined:
-		response.HTTPStatus = http.StatusOK
+		response.HTTPStatus = errorOutcomes[kindDeclined].httpStatus
 		response.ID = ""
 		response.Status = statusDeclined
-		response.Message = oxipayResponseCode.CustomerMessage
+		response.Step = step
+		response.Message = customerMessage
 	case oxipay.StatusFailed:
-		response.HTTPStatus = http.StatusOK
+		response.HTTPStatus = errorOutcomes[kindDeclined].httpStatus
 		response.ID = ""
 		response.Status = statusFailed
-		response.Message = oxipayResponseCode.CustomerMessage
+		response.Step = step
+		response.Message = customerMessage
 	default:
 		// default to fail...not sure if this is right
-		response.HTTPStatus = http.StatusOK
+		response.HTTPStatus = errorOutcomes[kindDeclined].httpStatus
 		response.ID = ""
 		response.Status = statusFailed
-		response.Message = oxipayResponseCode.CustomerMessage
+		response.Step = step
+		response.Message = customerMessage
 	}
 	return response
 }
 
+// translateResponseCode returns the customer message for the response code in
+// the locale. Codes from a response code file always use the message from the
+// file, and unknown codes get the server error message
+func translateResponseCode(responseType oxipay.ResponseType, code string, responseCode *oxipay.ResponseCode, locale string) string {
+	if responseCode.Custom {
+		return responseCode.CustomerMessage
+	}
+
+	if responseCode.Unknown {
+		code = oxipay.DefaultResponseCode
+	}
+
+	if message, ok := messages.Lookup(locale, responseType.String()+"."+code); ok {
+		return message
+	}
+	return responseCode.CustomerMessage
+}
+
+// brandFor returns the branding profile for the merchant, or the profile for
+// the region when we don't know who the merchant is
+func brandFor(merchantID string) branding.Profile {
+	if appConfig == nil {
+		return branding.Default()
+	}
+	return appConfig.Branding.Resolve(merchantID)
+}
+
+// requestLocale works out which language to talk to the cashier in. The
+// register setting wins, otherwise we use the browser's language
+func requestLocale(r *http.Request, register *terminal.Register) string {
+	if register != nil && messages.Supports(register.Locale) {
+		return register.Locale
+	}
+	return messages.Negotiate(r.Header.Get("Accept-Language"))
+}
+
 func bindToRegistrationPayload(r *http.Request) (*oxipay.RegistrationPayload, error) {
 
 	if err := r.ParseForm(); err != nil {
 		log.Errorf("Unable to bind registration payload: %s", err)
 		return nil, err
 	}
+	return newRegistrationPayload(r.Form.Get("MerchantID"), r.Form.Get("DeviceToken")), nil
+}
+
+// newRegistrationPayload builds the request to register a device with Oxipay.
+// Every device gets an ID of its own made from the device token
+func newRegistrationPayload(merchantID string, deviceToken string) *oxipay.RegistrationPayload {
 	uniqueID, _ := shortid.Generate()
-	deviceToken := r.Form.Get("DeviceToken")
-	merchantID := r.Form.Get("MerchantID")
 	FxlDeviceID := deviceToken + "-" + uniqueID
 
-	register := &oxipay.RegistrationPayload{
+	return &oxipay.RegistrationPayload{
 		MerchantID:      merchantID,
 		DeviceID:        FxlDeviceID,
 		DeviceToken:     deviceToken,
@@ -406,8 +598,6 @@ func bindToRegistrationPayload(r *http.Request) (*oxipay.RegistrationPayload, er
 		FirmwareVersion: "version " + oxipayClient.GetVersion(),
 		POSVendor:       "Vend-Proxy",
 	}
-
-	return register, nil
 }
 
 func logRequest(r *http.Request) {
@@ -431,12 +621,10 @@ func logRequest(r *http.Request) {
 // which outcome they would like the Pay Example to simulate.
 func Index(w http.ResponseWriter, r *http.Request) {
 
-	logRequest(r)
 	var err error
 
 	if err := r.ParseForm(); err != nil {
-		log.Errorf("Index error parsing form: %s", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		sendError(w, r, validationError("", err))
 		return
 	}
 
@@ -453,53 +641,79 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	vReq, err = validPaymentRequest(vReq)
 
 	if err != nil {
-		w.Write([]byte("Not a valid request"))
-		w.WriteHeader(http.StatusBadRequest)
+		sendError(w, r, validationError("", err))
 		return
 	}
 	// we just want to ensure there is a terminal available
-	_, err = term.GetRegister(vReq.Origin, vReq.RegisterID)
+	register, err := lookupRegister(vReq.Origin, vReq.RegisterID)
 
-	// register the device if needed
-	if err != nil {
-		saveToSession(w, r, vReq)
+	// register the device if needed, or re-key it if Oxipay rejected the key
+	if errorKindOf(err) == kindNotRegistered || (err == nil && register.NeedsRekey) {
+		if err := saveToSession(w, r, vReq); err != nil {
+			sendError(w, r, internalError("", err))
+			return
+		}
 
 		// redirect
 		http.Redirect(w, r, "/register", http.StatusFound)
 		return
 	}
 
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	browserResponse := &Response{
+		Amount:     vReq.Amount,
+		RegisterID: vReq.RegisterID,
+		Locale:     requestLocale(r, register),
+		Brand:      brandFor(register.FxlSellerID),
+		HTTPStatus: http.StatusOK,
+	}
+
+	// save the details of the original request, the payment is checked
+	// against them
+	if err := saveToSession(w, r, vReq); err != nil {
+		sendResponse(w, r, errorResponse(internalError("", err), browserResponse.Locale, browserResponse.Brand))
+		return
+	}
+
 	// refunds are triggered by a negative amount
 	if vReq.AmountFloat > 0 {
 		// payment
-		http.ServeFile(w, r, "../assets/templates/index.html")
+		browserResponse.template = "index.html"
 	} else {
-		// save the details of the original request
-		saveToSession(w, r, vReq)
-
 		// refund
-		http.ServeFile(w, r, "../assets/templates/refund.html")
+		browserResponse.template = "refund.html"
 	}
+	sendResponse(w, r, browserResponse)
 }
 
-func saveToSession(w http.ResponseWriter, r *http.Request, vReq *vend.PaymentRequest) {
-
+// saveToSession keeps the request Vend opened the payment page with. Payments
+// are checked against it, so the page can't be used if it isn't saved
+func saveToSession(w http.ResponseWriter, r *http.Request, vReq *vend.PaymentRequest) error {
 	session, err := getSession(r, "oxipay")
+	if session == nil {
+		return fmt.Errorf("unable to get the session: %w", err)
+	}
 	if err != nil {
-		log.Error(err)
+		// the store starts a new session when the old one can't be read
+		log.Warnf("Starting a new session: %s", err)
 	}
 
 	session.Values["vReq"] = vReq
-	err = sessions.Save(r, w)
-
-	if err != nil {
-		log.Error(err)
+	if err := sessions.Save(r, w); err != nil {
+		return fmt.Errorf("unable to save the session: %w", err)
 	}
 	log.Infof("Session initiated: %s ", session.ID)
+	return nil
 }
 
 func bindToPaymentPayload(r *http.Request) (*vend.PaymentRequest, error) {
-	r.ParseForm()
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
 	origin := r.Form.Get("origin")
 	origin, _ = url.PathUnescape(origin)
 
@@ -519,186 +733,67 @@ func bindToPaymentPayload(r *http.Request) (*vend.PaymentRequest, error) {
 
 // RefundHandler handles performing a refund
 func RefundHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	cxFields := logrus.Fields{
-		"module": "proxy",
-		"call":   "RefundHandler",
-	}
-	cxLog := log.WithFields(cxFields)
-
-	// create the default response so that we always have something to send to the browser
-	browserResponse := new(Response)
-	var err error
-
-	x, err := getPaymentRequestFromSession(r)
-	if err != nil {
-		cxLog.Error("Unable to get the Refund Request from the session")
-		cxLog.Error(err)
-		http.Error(w, "There was a problem processing the request", http.StatusBadRequest)
-		return
-	}
-
-	vReq := vend.RefundRequest{
-		Amount:         x.Amount,
-		Origin:         x.Origin,
-		SaleID:         strings.Trim(r.Form.Get("sale_id"), ""),
-		PurchaseNumber: strings.Trim(r.Form.Get("purchaseno"), ""),
-		RegisterID:     x.RegisterID,
-		AmountFloat:    x.AmountFloat,
-	}
-	cxFields["register_id"] = x.RegisterID
-	cxFields["origin"] = x.Origin
-
-	terminal := terminal.NewTerminal(db)
-
-	register, err := terminal.GetRegister(vReq.Origin, vReq.RegisterID)
-	if err != nil {
-		cxLog.Info("Register Not Found, redirecting to /register")
-		// redirect to registration page
-		http.Redirect(w, r, "/register", http.StatusFound)
-		return
-	}
-	cxFields["merchant_id"] = register.FxlSellerID
-
-	txnRef, err := shortid.Generate()
-	var oxipayPayload = &oxipay.SalesAdjustmentPayload{
-		Amount:            strings.Replace(vReq.Amount, "-", "", 1),
-		MerchantID:        register.FxlSellerID,
-		DeviceID:          register.FxlRegisterID,
-		FirmwareVersion:   "vend_integration_v0.0.1",
-		OperatorID:        "Vend",
-		PurchaseRef:       vReq.PurchaseNumber,
-		PosTransactionRef: txnRef, // @todo see if vend has a uniqueID for this also
-	}
-
-	// generate the plaintext for the signature
-	plainText := oxipay.GeneratePlainTextSignature(oxipayPayload)
-	log.Infof("Oxipay plain text: %s \n", plainText)
-
-	// sign the message
-	oxipayPayload.Signature = oxipay.SignMessage(plainText, register.FxlDeviceSigningKey)
-	log.Infof("Oxipay signature: %s \n", oxipayPayload.Signature)
-
-	// send authorisation to oxipay
-	oxipayResponse, err := oxipayClient.ProcessSalesAdjustment(oxipayPayload)
-
-	if err != nil {
-		// log the raw response
-		log.Errorf("Error Processing: %s", oxipayResponse)
-		return
-	}
-
-	// ensure the response has come from Oxipay
-	var validSignature bool
-	validSignature, err = oxipayResponse.Authenticate(register.FxlDeviceSigningKey)
-
-	if !validSignature || err != nil {
-		browserResponse.Message = "The signature does not match the expected signature"
-		browserResponse.HTTPStatus = http.StatusBadRequest
-	} else {
-		// Return a response to the browser bases on the response from Oxipay
-		browserResponse = processOxipayResponse(oxipayResponse, oxipay.Adjustment, oxipayPayload.Amount)
-		browserResponse.Amount = "0" // this is set because the payload
-	}
-
-	sendResponse(w, r, browserResponse)
-	return
+	runSteps(w, r, loadSession, findRegister, createRefund, adjust)
 }
 
 // PaymentHandler receives the payment request from Vend and sends it to the
 // payment gateway.
 func PaymentHandler(w http.ResponseWriter, r *http.Request) {
-	var vReq *vend.PaymentRequest
-	var err error
-	browserResponse := new(Response)
-
-	logRequest(r)
-
-	vReq, err = bindToPaymentPayload(r)
-	if err != nil {
-		log.Error(err)
-		http.Error(w, "There was a problem processing the request", http.StatusBadRequest)
-	}
-
-	// looks up the database to get the fake Oxipay terminal
-	// so that we can issue this against Oxipay
-	// if the seller has correctly configured the gateway they will not hit this
-	// directly but it's here as safeguard
-	terminal, err := term.GetRegister(vReq.Origin, vReq.RegisterID)
-	if err != nil {
-		// redirect
-		http.Redirect(w, r, "/register", http.StatusFound)
-		return
-	}
-	log.Infof("Processing Payment using Oxipay register %s ", terminal.FxlRegisterID)
+	runSteps(w, r, bindPayment, findRegister, verifySale, createPayment, authorise)
+}
 
-	// send off to Oxipay
-	//var oxipayPayload
-	var oxipayPayload = &oxipay.AuthorisationPayload{
-		DeviceID:          terminal.FxlRegisterID,
-		MerchantID:        terminal.FxlSellerID,
-		PosTransactionRef: vReq.SaleID,
-		FinanceAmount:     vReq.Amount,
-		FirmwareVersion:   "vend_integration_v0.0.1",
-		OperatorID:        "Vend",
-		PurchaseAmount:    vReq.Amount,
-		PreApprovalCode:   vReq.Code,
+// recordOutcome stores the outcome of the transaction. Oxipay has already
+// processed it by now, so a failure to save is logged rather than returned
+func recordOutcome(txn *transaction.Transaction, oxipayResponse *oxipay.Response, response *Response) {
+	txn.Status = response.Status
+	if txn.Status == "" {
+		txn.Status = statusFailed
 	}
 
-	// generate the plaintext for the signature
-	plainText := oxipay.GeneratePlainTextSignature(oxipayPayload)
-	log.Debugf("Oxipay plain text: %s \n", plainText)
-
-	// sign the message
-	oxipayPayload.Signature = oxipay.SignMessage(plainText, terminal.FxlDeviceSigningKey)
-	log.Debugf("Oxipay signature: %s \n", oxipayPayload.Signature)
-
-	// send authorisation to the Oxipay POS API
-	oxipayResponse, err := oxipayClient.ProcessAuthorisation(oxipayPayload)
-
-	if err != nil {
-		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
-		// log the raw response
-
-		msg := fmt.Sprintf("Error Processing: %s", oxipayResponse)
-		log.Error(msg)
-		return
+	if oxipayResponse != nil {
+		txn.ResponseCode = oxipayResponse.Code
+		if oxipayResponse.PurchaseNumber != "" {
+			txn.PurchaseNumber = oxipayResponse.PurchaseNumber
+		}
 	}
 
-	// ensure the response has come from Oxipay
-	validSignature, err := oxipayResponse.Authenticate(terminal.FxlDeviceSigningKey)
-	if !validSignature || err != nil {
-		browserResponse.Message = "The signature does not match the expected signature"
-		browserResponse.HTTPStatus = http.StatusBadRequest
-	} else {
-		// Return a response to the browser bases on the response from Oxipay
-		browserResponse = processOxipayResponse(oxipayResponse, oxipay.Authorisation, oxipayPayload.PurchaseAmount)
+	if err := transactions.Complete(txn); err != nil {
+		log.WithFields(logrus.Fields{
+			"module":          "proxy",
+			"transaction_id":  txn.ID,
+			"purchase_number": txn.PurchaseNumber,
+			"status":          txn.Status,
+		}).Errorf("Unable to record the outcome of the transaction: %s", err)
 	}
+}
 
-	sendResponse(w, r, browserResponse)
-	return
+// sendError sends the response for an error that happened before we know
+// which register the request is for
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
+	sendResponse(w, r, errorResponse(err, requestLocale(r, nil), brandFor("")))
 }
 
 func sendResponse(w http.ResponseWriter, r *http.Request, response *Response) {
 
-	if len(response.file) > 0 {
-		// serve up the success page
-		// @todo check file exists
+	if len(response.template) > 0 {
+		// serve up the page
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
-		absFile, err := filepath.Abs(response.file)
-		if err != nil {
-			log.Warnf("Unable to find file %s: %e", response.file, err)
-		} else {
-			log.Infof("Serving file : %s ", absFile)
-		}
-
-		http.ServeFile(w, r, response.file)
 
+		writeTemplate(w, r, response)
 		return
 	}
 
+	// explain declines and failures to the cashier
+	if outcome := outcomeTemplate(response.Status); outcome != "" {
+		html, err := renderTemplate(outcome, response)
+		if err != nil {
+			log.Errorf("Unable to render %s: %s", outcome, err)
+		}
+		response.HTML = string(html)
+	}
+
 	// Marshal our response into JSON.
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
@@ -1,372 +1,414 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"os"
 	"strings"
 	"testing"
 
-	uuid "github.com/nu7hatch/gouuid"
-	"github.com/oxipay/oxipay-vend/internal/pkg/config"
 	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
 	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
 	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
-
-	shortid "github.com/ventu-io/go-shortid"
+	"github.com/sirupsen/logrus"
 )
 
-var Db *sql.DB
-
-var appConfig config.HostConfig
-
-func TestMain(m *testing.M) {
-	appConfig, _ := config.ReadApplicationConfig("../configs/vendproxy.json")
-	// we need a"" database connection for most of the tests
-
-	Db = connectToDatabase(appConfig.Database)
-
-	defer Db.Close()
-
-	// add vars to the seesion to simulate a redirect
-	DbSessionStore = initSessionStore(Db, appConfig.Session)
-
-	terminal.Db = Db
-
-	// oxipay.GatewayURL = "https://testpos.oxipay.com.au/webapi/v1/Test"
-
-	returnCode := m.Run()
-
-	os.Exit(returnCode)
-}
-
-// TestTerminalSave tests saving a new terminal in the database for the registration phase
-func TestTerminalSave(t *testing.T) {
-	// { Success SCRK01 Success VK5NGgc7nFJp 481f1e4098465f5229b33d91e0687c6123b91078e5c727b6d8ebf9360af145e7}
-	var uniqueID, _ = shortid.Generate()
-
-	terminal := &terminal.Terminal{
-		FxlDeviceSigningKey: "VK5NGgc7nFJp",
-		FxlRegisterID:       "Oxipos",
-		FxlSellerID:         "30188105",
-		Origin:              "http://pos.example.com",
-		VendRegisterID:      uniqueID,
-	}
-	saved, err := terminal.Save("unit-test")
+const (
+	testOrigin = "https://example.vendhq.com"
+	testKey    = "VK5NGgc7nFJp"
+)
 
-	if err != nil || saved == false {
-		t.Fatal(err)
+// useFakes points the handlers at the fake gateway and in-memory stores, with
+// vReq in the session. It returns a function that puts everything back
+func useFakes(gateway *fakeGateway, registers *memoryRegisters, txns *memoryTransactions, vReq *vend.PaymentRequest) func() {
+	savedConfig, savedLog, savedClient := appConfig, log, oxipayClient
+	savedTerm, savedTransactions, savedSessions := term, transactions, DbSessionStore
+
+	gob.Register(&vend.PaymentRequest{})
+	appConfig = nil
+	log = logrus.New()
+	log.Out = ioutil.Discard
+	oxipayClient = gateway
+	term = registers
+	transactions = txns
+	DbSessionStore = &memorySessions{vReq: vReq}
+
+	return func() {
+		appConfig, log, oxipayClient = savedConfig, savedLog, savedClient
+		term, transactions, DbSessionStore = savedTerm, savedTransactions, savedSessions
 	}
 }
 
-// TestTerminalUniqueSave ensures that we get an error if we try to save the same terminal twice
-func TestTerminalUniqueSave(t *testing.T) {
-	// { Success SCRK01 Success VK5NGgc7nFJp 481f1e4098465f5229b33d91e0687c6123b91078e5c727b6d8ebf9360af145e7}
-
-	terminal := &terminal.Terminal{
-		FxlDeviceSigningKey: "VK5NGgc7nFJp",
-		FxlRegisterID:       "Oxipos",
-		FxlSellerID:         "30188105",
-		Origin:              "http://pos.oxipay.com.au",
-		VendRegisterID:      "0d33b6af-7d33-4913-a310-7cd187ad4756",
-	}
-	// insert the same record twice so that we know it's erroring
-	saved, err := terminal.Save("unit-test")
-	saved, err = terminal.Save("unit-test")
+// pairedRegister is register r1, paired with merchant 30188105
+func pairedRegister() *terminal.Register {
+	return terminal.NewRegister(testKey, "device-1", "30188105", testOrigin, "r1")
+}
 
-	if err != nil && saved != false {
-		t.Fatal(err)
+// sendForm posts the form to the handler and decodes the JSON response. The
+// response is nil when the handler rendered a page instead
+func sendForm(handler http.HandlerFunc, path string, form url.Values) (*httptest.ResponseRecorder, *Response) {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
 
+	response := new(Response)
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+		return w, nil
 	}
+	return w, response
 }
 
-// TestRegisterHandler  generating oxipay payload
-
-func TestRegisterHandler(t *testing.T) {
-
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	form := url.Values{}
-	form.Add("MerchantID", "30188105")
-	form.Add("DeviceToken", "01SUCCES") // for this to work against sandbox or prod it needs a real token
+// outcome is what a handler is expected to send and record
+type outcome struct {
+	code     int
+	status   string // empty when a page is rendered
+	step     string
+	redirect string
+	txn      string // the recorded status, empty when nothing is recorded
+	calls    int    // requests sent to Oxipay
+}
 
-	req, err := http.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+func (expected outcome) check(t *testing.T, name string, w *httptest.ResponseRecorder, response *Response, txns *memoryTransactions, gateway *fakeGateway) {
+	t.Helper()
 
-	if err != nil {
-		t.Fatal(err)
+	if w.Code != expected.code {
+		t.Errorf("%s: expected %d, got %d %s", name, expected.code, w.Code, w.Body)
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	guid, _ := uuid.NewV4()
-	vReq := &vend.PaymentRequest{
-		RegisterID: guid.String(),
-		Origin:     "http://testpos.oxipay.com.au",
+	switch {
+	case expected.status == "" && response != nil:
+		t.Errorf("%s: expected a page, got %s", name, w.Body)
+	case expected.status != "" && response == nil:
+		t.Errorf("%s: expected JSON, got %s", name, w.Body)
+	case response != nil:
+		if response.Status != expected.status || response.Step != expected.step || response.RedirectURL != expected.redirect {
+			t.Errorf("%s: expected %s %q %q, got %s %q %q", name, expected.status, expected.step, expected.redirect,
+				response.Status, response.Step, response.RedirectURL)
+		}
+		if response.Message == "" {
+			t.Errorf("%s: expected a message for the cashier", name)
+		}
 	}
-	rr := httptest.NewRecorder()
-
-	session, err := getSession(req, "oxipay")
-
-	session.Values["vReq"] = vReq
-	err = session.Save(req, rr)
 
-	if err != nil {
-		log.Fatal(err)
+	txn := txns.last()
+	switch {
+	case expected.txn == "" && txn != nil:
+		t.Errorf("%s: expected nothing to be recorded, got %+v", name, txn)
+	case expected.txn != "" && txn == nil:
+		t.Errorf("%s: expected a %s transaction to be recorded", name, expected.txn)
+	case txn != nil && txn.Status != expected.txn:
+		t.Errorf("%s: expected the transaction to be recorded as %s, got %s", name, expected.txn, txn.Status)
 	}
 
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	if gateway.calls != expected.calls {
+		t.Errorf("%s: expected %d requests to Oxipay, got %d", name, expected.calls, gateway.calls)
+	}
+}
 
-	handler := http.HandlerFunc(RegisterHandler)
+func TestIndexWithoutSession(t *testing.T) {
+	restore := useFakes(&fakeGateway{key: testKey}, newMemoryRegisters(pairedRegister()), &memoryTransactions{}, nil)
+	defer restore()
+	DbSessionStore = nil
 
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+	form := url.Values{"amount": {"44.00"}, "origin": {testOrigin}, "register_id": {"r1"}}
+	w, response := sendForm(Index, "/", form)
 
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %d want %d",
-			status, http.StatusOK)
+	if outcome := errorOutcomes[kindInternal]; w.Code != outcome.httpStatus || response == nil || response.Status != statusFailed {
+		t.Errorf("expected an internal error, got %d %s", w.Code, w.Body)
 	}
 }
 
-// TestGeneratePayload generating oxipay payload assumes a registered device
-// with both Oxipay and the local database
-func TestProcessAuthorisationHandler(t *testing.T) {
-
-	var uniqueID, _ = uuid.NewV4()
-	log.Printf("Generated RegisterID of %s \n", uniqueID)
-	terminal := &terminal.Terminal{
-		FxlDeviceSigningKey: "1234567890", // use hardcoded signing key for dummy endpoint
-		FxlRegisterID:       "Oxipos",
-		FxlSellerID:         "30188105",
-		Origin:              "http://pos.example.com",
-		VendRegisterID:      uniqueID.String(),
+func TestPaymentHandler(t *testing.T) {
+	payment := url.Values{
+		"amount":      {"44.00"},
+		"origin":      {testOrigin},
+		"register_id": {"r1"},
+		"sale_id":     {"sale-1"},
+		"paymentcode": {"123456"},
 	}
-
-	// we do this to ensure that it's registered already,
-	// otherwise we are going to get a 302
-	saved, err := terminal.Save("unit-test")
-	if saved != true {
-		t.Error("Unable to save register")
-		return
+	with := func(key string, value string) url.Values {
+		form := url.Values{}
+		for k, v := range payment {
+			form[k] = v
+		}
+		form.Set(key, value)
+		return form
 	}
-
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	form := url.Values{}
-	form.Add("amount", "4400")
-	form.Add("origin", "http://pos.example.com")
-	form.Add("paymentcode", "01APPROV") // needs a real payment code to succeed against sandbox / prod
-	form.Add("register_id", uniqueID.String())
-
-	req, err := http.NewRequest(http.MethodPost, "/pay", strings.NewReader(form.Encode()))
-
-	if err != nil {
-		t.Fatal(err)
+	session := &vend.PaymentRequest{Amount: "4400", Origin: testOrigin, RegisterID: "r1"}
+	approved := oxipay.Response{Code: "SPRA01", Status: "Success", Message: "Approved", PurchaseNumber: "52011913"}
+
+	tests := []struct {
+		name      string
+		form      url.Values
+		session   *vend.PaymentRequest
+		lookupErr error
+		txnErr    error
+		gateway   fakeGateway
+		expected  outcome
+	}{
+		{"invalid amount", with("amount", "lots"), session, nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}},
+		{"missing amount", with("amount", ""), session, nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}},
+		{"unpaired register", with("register_id", "r2"), session, nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusNotFound, statusFailed, stepExit, "/register", "", 0}},
+		{"ambiguous register", payment, session, fmt.Errorf("%w: register r1 is paired with merchants 1, 2", terminal.ErrAmbiguous), nil, fakeGateway{response: approved},
+			outcome{http.StatusServiceUnavailable, statusFailed, stepDecline, "", "", 0}},
+		{"lookup fails", payment, session, errors.New("driver: bad connection"), nil, fakeGateway{response: approved},
+			outcome{http.StatusServiceUnavailable, statusFailed, stepDecline, "", "", 0}},
+		{"no session", payment, nil, nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusOK, statusDeclined, stepDecline, "", "", 0}},
+		{"amount changed", with("amount", "1.00"), session, nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusOK, statusDeclined, stepDecline, "", "", 0}},
+		{"not recorded", payment, session, nil, errors.New("driver: bad connection"), fakeGateway{response: approved},
+			outcome{http.StatusServiceUnavailable, statusFailed, stepDecline, "", "", 0}},
+		{"gateway unreachable", payment, session, nil, nil, fakeGateway{err: errors.New("connection refused")},
+			outcome{http.StatusBadGateway, statusFailed, stepRetry, "", statusUnknown, 1}},
+		{"signing key rejected", payment, session, nil, nil, fakeGateway{response: oxipay.Response{Code: oxipay.SignatureMismatch, Status: "Error"}},
+			outcome{http.StatusNotFound, statusFailed, stepExit, "/register", statusFailed, 1}},
+		{"invalid signature", payment, session, nil, nil, fakeGateway{response: oxipay.Response{Code: "SPRA01", Status: "Success", Signature: "forged"}},
+			outcome{http.StatusBadGateway, statusFailed, stepDecline, "", statusFailed, 1}},
+		{"declined", payment, session, nil, nil, fakeGateway{response: oxipay.Response{Code: "FPRA01", Status: "Failed"}},
+			outcome{http.StatusOK, statusDeclined, stepDecline, "", statusDeclined, 1}},
+		{"approved", payment, session, nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusOK, statusAccepted, "", "", statusAccepted, 1}},
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(PaymentHandler)
+	for _, tt := range tests {
+		gateway := tt.gateway
+		gateway.key = testKey
+		registers := newMemoryRegisters(pairedRegister())
+		registers.err = tt.lookupErr
+		txns := &memoryTransactions{err: tt.txnErr}
 
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+		restore := useFakes(&gateway, registers, txns, tt.session)
+		w, response := sendForm(PaymentHandler, "/pay", tt.form)
+		restore()
 
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %d want %d",
-			status, http.StatusOK)
-		return
-	}
+		tt.expected.check(t, tt.name, w, response, txns, &gateway)
 
-	// Check the response body is what we expect.
-
-	response := new(Response)
-	body, _ := ioutil.ReadAll(rr.Body)
-	err = json.Unmarshal(body, response)
-
-	if response.Status != "ACCEPTED" {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), "ACCEPTED")
+		if response != nil && tt.expected.txn != "" && response.TransactionID != txns.last().ID {
+			t.Errorf("%s: expected transaction %s, got %q", tt.name, txns.last().ID, response.TransactionID)
+		}
 	}
 }
 
-func TestProcessAuthorisationRedirect(t *testing.T) {
-
-	var uniqueID, _ = uuid.NewV4()
+func TestPaymentHandlerFlagsRegisterForRekey(t *testing.T) {
+	gateway := &fakeGateway{key: testKey, response: oxipay.Response{Code: oxipay.SignatureMismatch, Status: "Error"}}
+	registers := newMemoryRegisters(pairedRegister())
+	session := &vend.PaymentRequest{Amount: "4400", Origin: testOrigin, RegisterID: "r1"}
 
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	form := url.Values{}
-	form.Add("amount", "4400")
-	form.Add("origin", "http://nonexistent.oxipay.com.au")
-	form.Add("paymentcode", "012344")
-	form.Add("register_id", uniqueID.String())
+	defer useFakes(gateway, registers, &memoryTransactions{}, session)()
+	sendForm(PaymentHandler, "/pay", url.Values{"amount": {"44.00"}, "origin": {testOrigin}, "register_id": {"r1"}, "paymentcode": {"123456"}})
 
-	req, err := http.NewRequest(http.MethodPost, "/pay", strings.NewReader(form.Encode()))
-
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(PaymentHandler)
-
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
-
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusFound {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusFound)
-	}
-
-	if location := rr.HeaderMap.Get("Location"); location != "/register" {
-		t.Errorf("Function redirects but redirects to %s rather than /register", location)
+	if register, _ := registers.GetRegister(testOrigin, "r1"); !register.NeedsRekey {
+		t.Error("expected the register to need re-keying")
 	}
 }
 
-func TestProcessSalesAdjustmentHandler(t *testing.T) {
-
-	var uniqueID, _ = uuid.NewV4()
-	log.Printf("Generated Refund TxID of : %s \n", uniqueID)
-
-	vendRegisterID := "0afa8de1-1442-11e8-edec-94863fd13a3c"
-	origin := "https://amtest.vendhq.com"
-
-	// establish the session and save the amount and the register in the session
-	vReq := &vend.PaymentRequest{
-		Amount:     "4401",
-		Origin:     origin,
-		RegisterID: vendRegisterID,
+func TestRefundHandler(t *testing.T) {
+	refund := url.Values{"sale_id": {"sale-1"}, "purchaseno": {"52011913"}}
+	session := &vend.PaymentRequest{Amount: "-4400", Origin: testOrigin, RegisterID: "r1"}
+	unpaired := &vend.PaymentRequest{Amount: "-4400", Origin: testOrigin, RegisterID: "r2"}
+	malformed := &vend.PaymentRequest{Amount: "-44.00", Origin: testOrigin, RegisterID: "r1"}
+	approved := oxipay.Response{Code: "SPSA01", Status: "Success", Message: "Approved"}
+
+	tests := []struct {
+		name     string
+		session  *vend.PaymentRequest
+		txnErr   error
+		gateway  fakeGateway
+		expected outcome
+	}{
+		{"no session", nil, nil, fakeGateway{response: approved},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}},
+		{"unpaired register", unpaired, nil, fakeGateway{response: approved},
+			outcome{http.StatusNotFound, statusFailed, stepExit, "/register", "", 0}},
+		{"malformed amount", malformed, nil, fakeGateway{response: approved},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}},
+		{"not recorded", session, errors.New("driver: bad connection"), fakeGateway{response: approved},
+			outcome{http.StatusServiceUnavailable, statusFailed, stepDecline, "", "", 0}},
+		{"gateway unreachable", session, nil, fakeGateway{err: errors.New("connection refused")},
+			outcome{http.StatusBadGateway, statusFailed, stepRetry, "", statusUnknown, 1}},
+		{"signing key rejected", session, nil, fakeGateway{response: oxipay.Response{Code: oxipay.SignatureMismatch, Status: "Error"}},
+			outcome{http.StatusNotFound, statusFailed, stepExit, "/register", statusFailed, 1}},
+		{"invalid signature", session, nil, fakeGateway{response: oxipay.Response{Code: "SPSA01", Status: "Success", Signature: "forged"}},
+			outcome{http.StatusBadGateway, statusFailed, stepDecline, "", statusFailed, 1}},
+		{"declined", session, nil, fakeGateway{response: oxipay.Response{Code: "FPSA01", Status: "Failed"}},
+			outcome{http.StatusOK, statusDeclined, stepDecline, "", statusDeclined, 1}},
+		{"approved", session, nil, fakeGateway{response: approved},
+			outcome{http.StatusOK, statusAccepted, "", "", statusAccepted, 1}},
 	}
 
-	// posTerminal, err := terminal.GetRegisteredTerminal("http://pos.example.com", vendRegisterID)
-
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	form := url.Values{}
-	form.Add("purchasenumber", "01APPROV") // needs a real payment code to succeed against sandbox / prod
+	for _, tt := range tests {
+		gateway := tt.gateway
+		gateway.key = testKey
+		txns := &memoryTransactions{err: tt.txnErr}
 
-	req, err := http.NewRequest(http.MethodPost, "/refund", strings.NewReader(form.Encode()))
-	session, err := getSession(req, "oxipay")
+		restore := useFakes(&gateway, newMemoryRegisters(pairedRegister()), txns, tt.session)
+		w, response := sendForm(RefundHandler, "/refund", refund)
+		restore()
 
-	if err != nil {
-		t.Error("Can't get the session")
-	}
-
-	session.Values["vReq"] = vReq
+		tt.expected.check(t, tt.name, w, response, txns, &gateway)
 
-	if err != nil {
-		t.Fatal(err)
+		if txn := txns.last(); txn != nil && (txn.Amount != -4400 || txn.PurchaseNumber != "52011913") {
+			t.Errorf("%s: expected a refund of -4400 for 52011913, got %+v", tt.name, txn)
+		}
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(RefundHandler)
-
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+}
 
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %d want %d",
-			status, http.StatusOK)
-		return
+func TestRegisterHandler(t *testing.T) {
+	registration := url.Values{"MerchantID": {"30188105"}, "DeviceToken": {"01SUCCES"}, "Locale": {"mi-NZ"}}
+	session := &vend.PaymentRequest{Amount: "4400", Origin: testOrigin, RegisterID: "r2"}
+	created := oxipay.Response{Code: "SCRK01", Status: "Success", Message: "Success", Key: "new-key"}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		session  *vend.PaymentRequest
+		saveErr  error
+		gateway  fakeGateway
+		expected outcome
+		paired   bool
+	}{
+		{"no device token", url.Values{"MerchantID": {"30188105"}}, session, nil, fakeGateway{response: created},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}, false},
+		{"no session", registration, nil, nil, fakeGateway{response: created},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}, false},
+		{"gateway unreachable", registration, session, nil, fakeGateway{err: errors.New("connection refused")},
+			outcome{http.StatusBadGateway, statusFailed, stepRetry, "", "", 1}, false},
+		{"invalid signature", registration, session, nil, fakeGateway{response: oxipay.Response{Code: "SCRK01", Status: "Success", Key: "new-key", Signature: "forged"}},
+			outcome{http.StatusBadGateway, statusFailed, stepDecline, "", "", 1}, false},
+		{"device token used", registration, session, nil, fakeGateway{response: oxipay.Response{Code: "FCRK02", Status: "Failed"}},
+			outcome{http.StatusOK, statusFailed, stepDecline, "", "", 1}, false},
+		{"not saved", registration, session, errors.New("driver: bad connection"), fakeGateway{response: created},
+			outcome{http.StatusServiceUnavailable, statusFailed, stepDecline, "", "", 1}, false},
+		{"paired", registration, session, nil, fakeGateway{response: created},
+			outcome{http.StatusOK, "", "", "", "", 1}, true},
 	}
 
-	// Check the response body is what we expect.
-	response := new(Response)
-	body, _ := ioutil.ReadAll(rr.Body)
-	err = json.Unmarshal(body, response)
-
-	if response.Status != "ACCEPTED" {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), "ACCEPTED")
+	for _, tt := range tests {
+		gateway := tt.gateway
+		gateway.key = "01SUCCES"
+		registers := newMemoryRegisters(pairedRegister())
+		registers.saveErr = tt.saveErr
+		txns := &memoryTransactions{}
+
+		restore := useFakes(&gateway, registers, txns, tt.session)
+		w, response := sendForm(RegisterHandler, "/register", tt.form)
+		restore()
+
+		tt.expected.check(t, tt.name, w, response, txns, &gateway)
+
+		register, err := registers.GetRegister(testOrigin, "r2")
+		if tt.paired != (err == nil) {
+			t.Errorf("%s: expected paired to be %t, got %v", tt.name, tt.paired, err)
+		}
+		if register != nil && (register.FxlDeviceSigningKey != "new-key" || register.Locale != "mi-NZ") {
+			t.Errorf("%s: expected the new key and the cashier's language, got %+v", tt.name, register)
+		}
 	}
 }
 
-func TestProcessAuthorisationResponse(t *testing.T) {
-
-	terminal, err := terminal.GetRegisteredTerminal("https://amtest.vendhq.com", "0afa8de1-1442-11e8-edec-94863fd13a3c")
-	if err != nil {
-		t.Error(err)
+func TestRekeyHandler(t *testing.T) {
+	rekey := url.Values{"DeviceToken": {"01SUCCES"}}
+	session := &vend.PaymentRequest{Amount: "4400", Origin: testOrigin, RegisterID: "r1"}
+	unpaired := &vend.PaymentRequest{Amount: "4400", Origin: testOrigin, RegisterID: "r2"}
+	created := oxipay.Response{Code: "SCRK01", Status: "Success", Message: "Success", Key: "new-key"}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		session  *vend.PaymentRequest
+		gateway  fakeGateway
+		expected outcome
+		key      string
+	}{
+		{"no session", rekey, nil, fakeGateway{response: created},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}, testKey},
+		{"unpaired register", rekey, unpaired, fakeGateway{response: created},
+			outcome{http.StatusNotFound, statusFailed, stepExit, "/register", "", 0}, testKey},
+		{"no device token", url.Values{}, session, fakeGateway{response: created},
+			outcome{http.StatusBadRequest, statusFailed, stepRetry, "", "", 0}, testKey},
+		{"gateway unreachable", rekey, session, fakeGateway{err: errors.New("connection refused")},
+			outcome{http.StatusBadGateway, statusFailed, stepRetry, "", "", 1}, testKey},
+		{"rekeyed", rekey, session, fakeGateway{response: created},
+			outcome{http.StatusOK, "", "", "", "", 1}, "new-key"},
 	}
 
-	reponse := `{"x_purchase_number":"52011913","x_status":"Success","x_code":"SPRA01","x_message":"Approved","signature":"3b715be8fdd67decd299cbb14ceeec3c76667d48e3468e4d3f343602d9b7d690","tracking_data":null}`
+	for _, tt := range tests {
+		gateway := tt.gateway
+		gateway.key = "01SUCCES"
+		registers := newMemoryRegisters(pairedRegister())
+		txns := &memoryTransactions{}
 
-	oxipayResponse := new(oxipay.OxipayResponse)
-	err = json.Unmarshal([]byte(reponse), oxipayResponse)
-	if err != nil {
-		t.Error(err)
-	}
-	isValid := oxipayResponse.Authenticate(terminal.FxlDeviceSigningKey)
+		restore := useFakes(&gateway, registers, txns, tt.session)
+		w, response := sendForm(RekeyHandler, "/register/rekey", tt.form)
+		restore()
 
-	if isValid == false {
-		t.Error("Not a valid request")
-	}
-	browserResponse := processOxipayResponse(oxipayResponse, oxipay.Authorisation, "4000")
+		tt.expected.check(t, tt.name, w, response, txns, &gateway)
 
-	if browserResponse.Status != statusAccepted {
-		t.Error("Expecting for the transaction to be accepted")
+		if register, _ := registers.GetRegister(testOrigin, "r1"); register.FxlDeviceSigningKey != tt.key {
+			t.Errorf("%s: expected the key to be %s, got %s", tt.name, tt.key, register.FxlDeviceSigningKey)
+		}
 	}
 }
 
-func TestRegistrationResponse(t *testing.T) {
-	rawResponse := `{
-		"x_key": "1234567890",
-		"x_status": "Success",
-		"x_code": "SCRK01",
-		"x_message": "Success",
-		"signature": "ff05ed059e8008a3e8e1210faee30ce0064e492f34709151804a32725d8441db",
-		"tracking_data": null
-	 }`
-
-	oxipayResponse := new(oxipay.OxipayResponse)
-	err := json.Unmarshal([]byte(rawResponse), oxipayResponse)
-	if err != nil {
-		t.Error(err)
+func TestProcessOxipayResponse(t *testing.T) {
+	savedLog := log
+	defer func() { log = savedLog }()
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	tests := []struct {
+		code     string
+		status   string
+		step     string
+		expected int
+	}{
+		{"SPRA01", statusAccepted, "", http.StatusOK},
+		{"FPRA01", statusDeclined, stepDecline, http.StatusOK},
+		{"FPRA03", statusFailed, stepRetry, http.StatusOK},
+		{"NOPE99", statusFailed, stepDecline, http.StatusOK},
 	}
-	isValid := oxipayResponse.Authenticate("Voh4ig3eepeedai8")
 
-	if isValid == false {
-		t.Error("Not a valid request")
+	for _, tt := range tests {
+		response := processOxipayResponse(&oxipay.Response{Code: tt.code, PurchaseNumber: "52011913"}, oxipay.Authorisation, "4400", "en-NZ", brandFor(""))
+		if response.Status != tt.status || response.Step != tt.step || response.HTTPStatus != tt.expected {
+			t.Errorf("%s: expected %s %q %d, got %s %q %d", tt.code, tt.status, tt.step, tt.expected, response.Status, response.Step, response.HTTPStatus)
+		}
 	}
-	browserResponse := processOxipayResponse(oxipayResponse, oxipay.Registration, "4000")
 
-	if browserResponse.Status != statusAccepted {
-		t.Error("Expecting for the transaction to be accepted")
-	}
+	// a catalogue entry without a status is our mistake, not Oxipay's
+	savedCodes := responseCodes
+	defer func() { responseCodes = savedCodes }()
+	responseCodes = &oxipay.ResponseCatalogue{Authorisation: map[string]*oxipay.ResponseCode{"SPRA01": {LogMessage: "Approved"}}}
 
+	response := processOxipayResponse(&oxipay.Response{Code: "SPRA01"}, oxipay.Authorisation, "4400", "en-NZ", brandFor(""))
+	if outcome := errorOutcomes[kindInternal]; response.Status != statusFailed || response.HTTPStatus != outcome.httpStatus || response.Step != outcome.step {
+		t.Errorf("expected an internal error, got %s %q %d", response.Status, response.Step, response.HTTPStatus)
+	}
 }
 
-func TestGeneratePayload(t *testing.T) {
-
-	log.Print("hello")
-	oxipayPayload := oxipay.OxipayPayload{
-		DeviceID:        "foobar",
-		MerchantID:      "3342342",
-		FinanceAmount:   "1000",
-		FirmwareVersion: "version 4.0",
-		OperatorID:      "John",
-		PurchaseAmount:  "1000",
-		PreApprovalCode: "1234",
+func TestTranslateResponseCode(t *testing.T) {
+	catalogue := oxipay.DefaultResponseCatalogue()
+	builtIn := catalogue.Lookup(oxipay.Authorisation, "FPRA01")
+	if message := translateResponseCode(oxipay.Authorisation, "FPRA01", builtIn, "mi-NZ"); message != "Kaua e ngana anō" {
+		t.Errorf("expected the built in code to be translated, got %q", message)
 	}
 
-	var plainText = oxipay.GeneratePlainTextSignature(oxipayPayload)
-	t.Log("Plaintext", plainText)
-
-	signature := oxipay.SignMessage(plainText, "TEST")
-	correctSig := "7dfd655530d41cee284b3e4cb7d08a058edf7b5641dffd15fdf1b61ff6a8699b"
-
-	if signature != correctSig {
-		t.Fatalf("expected %s but got %s", correctSig, signature)
+	custom := *builtIn
+	custom.CustomerMessage = "Please ask for another form of payment"
+	custom.Custom = true
+	for _, locale := range []string{"en-NZ", "mi-NZ"} {
+		if message := translateResponseCode(oxipay.Authorisation, "FPRA01", &custom, locale); message != custom.CustomerMessage {
+			t.Errorf("%s: expected the message from the response code file, got %q", locale, message)
+		}
 	}
 }
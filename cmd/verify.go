@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+)
+
+var (
+	// errNoPaymentContext is returned when the payment wasn't started by Vend
+	// opening Index in this session
+	errNoPaymentContext = errors.New("no payment was started from Vend in this session")
+
+	errAmountMismatch   = errors.New("the amount does not match the sale")
+	errRegisterMismatch = errors.New("the register does not match the sale")
+	errNoSale           = errors.New("the sale ID is missing")
+	errSaleClosed       = errors.New("the sale has already been closed or voided")
+)
+
+// salesClient returns the Vend client used to verify sales, or nil when sale
+// verification is turned off
+func salesClient() vend.Client {
+	if appConfig == nil || !appConfig.Vend.VerifySales {
+		return nil
+	}
+	return vendClient
+}
+
+// verifyPayment checks the payment posted by the browser against the request
+// Vend sent to Index, which is kept in the session, so the browser can't
+// change the amount or the register. When sales is set the sale is also
+// fetched from Vend, it must still be open and the payment must fit what is
+// left to pay on it
+func verifyPayment(ctx context.Context, expected *vend.PaymentRequest, vReq *vend.PaymentRequest, sales vend.Client) error {
+	if expected == nil {
+		return errNoPaymentContext
+	}
+
+	if vReq.Origin != expected.Origin || vReq.RegisterID != expected.RegisterID {
+		return errRegisterMismatch
+	}
+
+	if vReq.AmountFloat <= 0 || vReq.Amount != expected.Amount {
+		return errAmountMismatch
+	}
+
+	if sales == nil {
+		return nil
+	}
+
+	if vReq.SaleID == "" {
+		return errNoSale
+	}
+
+	sale, err := sales.Sale(ctx, vReq.Origin, vReq.SaleID)
+	if err != nil {
+		return fmt.Errorf("unable to fetch sale %s from Vend: %w", vReq.SaleID, err)
+	}
+
+	if sale.RegisterID != vReq.RegisterID {
+		return errRegisterMismatch
+	}
+
+	if !sale.Open() {
+		return errSaleClosed
+	}
+
+	amount, err := strconv.ParseInt(vReq.Amount, 10, 64)
+	if err != nil {
+		return errAmountMismatch
+	}
+
+	// a sale can be split across several payments
+	if amount > sale.Balance() {
+		return errAmountMismatch
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+	"github.com/sirupsen/logrus"
+)
+
+func paymentRequest(origin string, registerID string, amount string) *vend.PaymentRequest {
+	vReq, _ := validPaymentRequest(&vend.PaymentRequest{
+		Origin:     origin,
+		RegisterID: registerID,
+		SaleID:     "s1",
+		Amount:     amount,
+	})
+	return vReq
+}
+
+func TestVerifyPaymentAgainstSession(t *testing.T) {
+	expected := paymentRequest("https://example.vendhq.com", "r1", "44.00")
+
+	tests := []struct {
+		name     string
+		expected *vend.PaymentRequest
+		vReq     *vend.PaymentRequest
+		err      error
+	}{
+		{"matches", expected, paymentRequest("https://example.vendhq.com", "r1", "44"), nil},
+		{"no session", nil, paymentRequest("https://example.vendhq.com", "r1", "44"), errNoPaymentContext},
+		{"different amount", expected, paymentRequest("https://example.vendhq.com", "r1", "4.40"), errAmountMismatch},
+		{"different register", expected, paymentRequest("https://example.vendhq.com", "r2", "44"), errRegisterMismatch},
+		{"different origin", expected, paymentRequest("https://other.vendhq.com", "r1", "44"), errRegisterMismatch},
+		{"refund as a payment", paymentRequest("https://example.vendhq.com", "r1", "-44"), paymentRequest("https://example.vendhq.com", "r1", "-44"), errAmountMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyPayment(context.Background(), tt.expected, tt.vReq, nil); err != tt.err {
+				t.Errorf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyPaymentAgainstVend(t *testing.T) {
+	server := vendtest.NewServer("secret-token")
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	sales := vend.NewClient(server.Tokens(), logger)
+
+	// $44 with $10 already paid in cash
+	server.AddSale(vend.Sale{
+		ID:         "s1",
+		RegisterID: "r1",
+		TotalPrice: 38.26,
+		TotalTax:   5.74,
+		Payments:   []vend.SalePayment{{Amount: 10}},
+	})
+	server.AddSale(vend.Sale{ID: "voided", RegisterID: "r1", Status: vend.SaleStatusVoided, TotalPrice: 44})
+	server.AddSale(vend.Sale{ID: "closed", RegisterID: "r1", Status: vend.SaleStatusClosed, TotalPrice: 44})
+	server.AddSale(vend.Sale{ID: "layby", RegisterID: "r1", Status: "LAYBY_CLOSED", TotalPrice: 44})
+	server.AddSale(vend.Sale{ID: "saved", RegisterID: "r1", Status: "SAVED", TotalPrice: 44})
+
+	tests := []struct {
+		name   string
+		amount string
+		sale   string
+		err    error
+	}{
+		{"balance", "34", "s1", nil},
+		{"part of the balance", "20", "s1", nil},
+		{"more than the balance", "44", "s1", errAmountMismatch},
+		{"no sale", "34", "", errNoSale},
+		{"voided sale", "34", "voided", errSaleClosed},
+		{"closed sale", "34", "closed", errSaleClosed},
+		{"closed layby", "34", "layby", errSaleClosed},
+		{"saved sale", "34", "saved", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vReq := paymentRequest(server.URL, "r1", tt.amount)
+			vReq.SaleID = tt.sale
+
+			if err := verifyPayment(context.Background(), paymentRequest(server.URL, "r1", tt.amount), vReq, sales); err != tt.err {
+				t.Errorf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	vReq := paymentRequest(server.URL, "r1", "34")
+	vReq.SaleID = "missing"
+	if err := verifyPayment(context.Background(), vReq, vReq, sales); !errors.Is(err, vend.ErrNotFound) {
+		t.Errorf("expected sales missing from Vend to be refused, got %v", err)
+	}
+
+	server.AddSale(vend.Sale{ID: "s2", RegisterID: "r2", TotalPrice: 34})
+	vReq.SaleID = "s2"
+	if err := verifyPayment(context.Background(), vReq, vReq, sales); err != errRegisterMismatch {
+		t.Errorf("expected a sale from another register to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/i18n"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// saleStatusReturned flags payments on sales that have been returned. Vend
+// doesn't change the status of the original sale, the return is a new sale
+const saleStatusReturned = "RETURNED"
+
+var errInvalidOxipaySignature = errors.New("the signature does not match the expected signature")
+
+// VendWebhookHandler receives sale.update webhooks from Vend so that humm
+// payments on sales that are voided or returned afterwards aren't missed
+func VendWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	cxLog := log.WithFields(logrus.Fields{
+		"module": "vend",
+		"call":   "VendWebhookHandler",
+	})
+
+	hook, err := vend.ParseWebhook(r, appConfig.Vend.ClientSecret)
+	if err == vend.ErrInvalidSignature {
+		cxLog.Warn(err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		cxLog.Warn(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if hook.Type != vend.WebhookSaleUpdate {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	sale, err := hook.Sale()
+	if err != nil {
+		cxLog.Warn(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Vend sends the webhook again if we fail, which is what we want if
+	// the database is unavailable
+	if err := saleUpdated(hook.Origin(), sale); err != nil {
+		cxLog.WithField("sale_id", sale.ID).Errorf("Unable to process the sale update: %s", err)
+		http.Error(w, "There was a problem processing the request", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// saleUpdated flags the approved humm payments on a voided or returned sale
+// and, if configured, refunds them when the sale was voided
+func saleUpdated(origin string, sale *vend.WebhookSale) error {
+	saleID, status := sale.ID, sale.Status
+	switch {
+	case sale.Status == vend.SaleStatusVoided:
+	case sale.ReturnFor != "":
+		saleID, status = sale.ReturnFor, saleStatusReturned
+	default:
+		return nil
+	}
+
+	txns, err := transactions.Search(transaction.Filter{Query: saleID, Origin: origin})
+	if err != nil {
+		return err
+	}
+
+	for _, payment := range txns {
+		if payment.Type != transaction.TypePayment || payment.Status != statusAccepted || payment.VendSaleID != saleID {
+			continue
+		}
+
+		cxLog := log.WithFields(logrus.Fields{
+			"module":          "vend",
+			"origin":          origin,
+			"sale_id":         saleID,
+			"transaction_id":  payment.ID,
+			"purchase_number": payment.PurchaseNumber,
+		})
+
+		if payment.VendSaleStatus != status {
+			if err := transactions.SetVendSaleStatus(payment.ID, status); err != nil {
+				return err
+			}
+			cxLog.Warnf("humm payment is on a sale that was %s in Vend", status)
+		}
+
+		if status != vend.SaleStatusVoided || appConfig == nil || !appConfig.Vend.VoidRefunds {
+			continue
+		}
+
+		// the webhook can arrive more than once and the payment may have
+		// been refunded already
+		related, err := transactions.Search(transaction.Filter{Query: payment.PurchaseNumber, Origin: origin})
+		if err != nil {
+			return err
+		}
+
+		amount := unrefunded(payment, related)
+		if amount <= 0 {
+			continue
+		}
+
+		// the search above can't see a refund another webhook is about to
+		// make, so the payment is claimed before anything is sent to Oxipay
+		claimed, err := transactions.ClaimVoidRefund(payment.ID)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		refund, err := refundVoidedPayment(payment, amount)
+		if refund != nil {
+			cxLog = cxLog.WithFields(logrus.Fields{"refund_id": refund.ID, "status": refund.Status})
+		}
+
+		switch {
+		case err == nil && refund.Status == statusAccepted:
+			cxLog.Info("Refunded the humm payment on a voided sale")
+		case refund != nil && (refund.Status == statusUnknown || err == errInvalidOxipaySignature):
+			// Oxipay may have made the refund, so it isn't tried again
+			cxLog.Errorf("Unable to tell if the voided sale was refunded, check the refund with Oxipay: %v", err)
+		default:
+			// nothing was refunded, Vend sends the webhook again when we fail
+			if releaseErr := transactions.ReleaseVoidRefund(payment.ID); releaseErr != nil {
+				return releaseErr
+			}
+			if err == nil {
+				err = fmt.Errorf("the refund was %s", refund.Status)
+			}
+			cxLog.Errorf("Unable to refund the voided sale, it will be tried again: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// unrefunded returns how much of the payment hasn't been refunded, counting
+// refunds that are still pending so we never refund twice
+func unrefunded(payment *transaction.Transaction, related []*transaction.Transaction) int64 {
+	amount := payment.Amount
+	for _, txn := range related {
+		if txn.Type != transaction.TypeRefund || txn.PurchaseNumber != payment.PurchaseNumber {
+			continue
+		}
+		if txn.Status == statusAccepted || txn.Status == transaction.StatusPending || txn.Status == statusUnknown {
+			amount += txn.Amount // refunds are negative
+		}
+	}
+	return amount
+}
+
+// refundVoidedPayment issues a sales adjustment for the payment, the same as a
+// refund from the register. The refund is nil when it couldn't be recorded,
+// otherwise its status is the outcome from Oxipay
+func refundVoidedPayment(payment *transaction.Transaction, amount int64) (*transaction.Transaction, error) {
+	register, err := term.GetRegister(payment.Origin, payment.VendRegisterID)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := &transaction.Transaction{
+		Type:           transaction.TypeRefund,
+		Origin:         payment.Origin,
+		VendRegisterID: payment.VendRegisterID,
+		VendSaleID:     payment.VendSaleID,
+		MerchantID:     register.FxlSellerID,
+		PurchaseNumber: payment.PurchaseNumber,
+		Amount:         -amount,
+	}
+	if err := transactions.Create(refund); err != nil {
+		return nil, err
+	}
+
+	var oxipayPayload = &oxipay.SalesAdjustmentPayload{
+		Amount:            strconv.FormatInt(amount, 10),
+		MerchantID:        register.FxlSellerID,
+		DeviceID:          register.FxlRegisterID,
+		FirmwareVersion:   "vend_integration_v0.0.1",
+		OperatorID:        "Vend",
+		PurchaseRef:       payment.PurchaseNumber,
+		PosTransactionRef: refund.ID,
+	}
+	oxipayPayload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(oxipayPayload), register.FxlDeviceSigningKey)
+
+	oxipayResponse, err := oxipayClient.ProcessSalesAdjustment(oxipayPayload)
+	if err != nil {
+		recordOutcome(refund, nil, &Response{Status: statusUnknown})
+		return refund, err
+	}
+
+	if validSignature, err := oxipayResponse.Authenticate(register.FxlDeviceSigningKey); !validSignature || err != nil {
+		recordOutcome(refund, oxipayResponse, &Response{Status: statusFailed})
+		return refund, errInvalidOxipaySignature
+	}
+
+	response := processOxipayResponse(oxipayResponse, oxipay.Adjustment, oxipayPayload.Amount, i18n.DefaultLocale, brandFor(register.FxlSellerID))
+	recordOutcome(refund, oxipayResponse, response)
+	return refund, nil
+}
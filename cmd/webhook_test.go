@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestVendWebhookHandler(t *testing.T) {
+	savedConfig, savedLog := appConfig, log
+	defer func() { appConfig, log = savedConfig, savedLog }()
+
+	appConfig = &config.HostConfig{Vend: config.VendConfig{ClientID: "client-id", ClientSecret: "client-secret"}}
+	log = logrus.New()
+	log.Out = ioutil.Discard
+
+	tests := []struct {
+		name     string
+		request  *http.Request
+		expected int
+	}{
+		{"wrong secret", vendtest.NewWebhook("someone-else", vend.WebhookSaleUpdate, "example", map[string]string{"id": "s1"}), http.StatusUnauthorized},
+		{"bad domain prefix", vendtest.NewWebhook("client-secret", vend.WebhookSaleUpdate, "example.com/", map[string]string{"id": "s1"}), http.StatusBadRequest},
+		{"other webhooks", vendtest.NewWebhook("client-secret", "product.update", "example", map[string]string{"id": "p1"}), http.StatusOK},
+		{"sale still open", vendtest.NewWebhook("client-secret", vend.WebhookSaleUpdate, "example", map[string]string{"id": "s1", "status": "CLOSED"}), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			VendWebhookHandler(w, tt.request)
+
+			if w.Code != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestUnrefunded(t *testing.T) {
+	payment := &transaction.Transaction{Type: transaction.TypePayment, PurchaseNumber: "P1", Amount: 4400, Status: statusAccepted}
+
+	refund := func(amount int64, status string) *transaction.Transaction {
+		return &transaction.Transaction{Type: transaction.TypeRefund, PurchaseNumber: "P1", Amount: amount, Status: status}
+	}
+
+	tests := []struct {
+		name     string
+		related  []*transaction.Transaction
+		expected int64
+	}{
+		{"no refunds", []*transaction.Transaction{payment}, 4400},
+		{"partly refunded", []*transaction.Transaction{payment, refund(-1000, statusAccepted)}, 3400},
+		{"refund pending", []*transaction.Transaction{payment, refund(-4400, transaction.StatusPending)}, 0},
+		{"refund declined", []*transaction.Transaction{payment, refund(-4400, statusDeclined)}, 4400},
+		{"other purchase", []*transaction.Transaction{payment, {Type: transaction.TypeRefund, PurchaseNumber: "P2", Amount: -4400, Status: statusAccepted}}, 4400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unrefunded(payment, tt.related); got != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+// lockedGateway lets the fake gateway be called from more than one goroutine
+type lockedGateway struct {
+	mu sync.Mutex
+	*fakeGateway
+}
+
+func (g *lockedGateway) ProcessSalesAdjustment(payload *oxipay.SalesAdjustmentPayload) (*oxipay.Response, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.fakeGateway.ProcessSalesAdjustment(payload)
+}
+
+func TestSaleUpdatedRefundsOnce(t *testing.T) {
+	gateway := &fakeGateway{key: testKey, response: oxipay.Response{Code: "SPSA01", Status: "Success", Message: "Approved"}}
+	txns := &memoryTransactions{txns: []*transaction.Transaction{
+		{ID: "t1", Type: transaction.TypePayment, Origin: testOrigin, VendRegisterID: "r1", VendSaleID: "s1", PurchaseNumber: "P1", Amount: 4400, Status: statusAccepted},
+	}}
+
+	defer useFakes(gateway, newMemoryRegisters(pairedRegister()), txns, nil)()
+	oxipayClient = &lockedGateway{fakeGateway: gateway}
+	appConfig = &config.HostConfig{Vend: config.VendConfig{VoidRefunds: true}}
+
+	// Vend can send the webhook again before the first one has finished, so
+	// both look for refunds before either has made one
+	var searching sync.WaitGroup
+	searching.Add(2)
+	txns.searched = func(filter transaction.Filter) {
+		if filter.Query == "P1" {
+			searching.Done()
+			searching.Wait()
+		}
+	}
+
+	sale := &vend.WebhookSale{ID: "s1", Status: vend.SaleStatusVoided}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- saleUpdated(testOrigin, sale)
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	txns.searched = nil
+
+	refunds, _ := txns.Search(transaction.Filter{Query: "P1"})
+	if gateway.calls != 1 || len(refunds) != 2 {
+		t.Errorf("expected the payment to be refunded once, got %d requests to Oxipay and %v", gateway.calls, refunds)
+	}
+
+	// and not again when the webhook is retried later
+	if err := saleUpdated(testOrigin, sale); err != nil || gateway.calls != 1 {
+		t.Errorf("expected the retry to be ignored, got %v and %d requests to Oxipay", err, gateway.calls)
+	}
+}
+
+func TestSaleUpdatedRetriesFailedRefunds(t *testing.T) {
+	gateway := &fakeGateway{key: testKey, response: oxipay.Response{Code: "FPSA01", Status: "Failed", Message: "Declined"}}
+	txns := &memoryTransactions{txns: []*transaction.Transaction{
+		{ID: "t1", Type: transaction.TypePayment, Origin: testOrigin, VendRegisterID: "r1", VendSaleID: "s1", PurchaseNumber: "P1", Amount: 4400, Status: statusAccepted},
+	}}
+
+	defer useFakes(gateway, newMemoryRegisters(pairedRegister()), txns, nil)()
+	appConfig = &config.HostConfig{Vend: config.VendConfig{VoidRefunds: true}}
+	sale := &vend.WebhookSale{ID: "s1", Status: vend.SaleStatusVoided}
+
+	// nothing was refunded, so Vend is asked to send the webhook again
+	if err := saleUpdated(testOrigin, sale); err == nil {
+		t.Fatal("expected an error when Oxipay refuses the refund")
+	}
+
+	gateway.response = oxipay.Response{Code: "SPSA01", Status: "Success", Message: "Approved"}
+	if err := saleUpdated(testOrigin, sale); err != nil || gateway.calls != 2 {
+		t.Fatalf("expected the refund to be tried again, got %v and %d requests to Oxipay", err, gateway.calls)
+	}
+	if refund := txns.last(); refund.Type != transaction.TypeRefund || refund.Status != statusAccepted {
+		t.Errorf("expected an accepted refund, got %+v", refund)
+	}
+}
+
+func TestSaleUpdatedKeepsUnknownRefunds(t *testing.T) {
+	gateway := &fakeGateway{key: testKey, err: errors.New("timeout")}
+	txns := &memoryTransactions{txns: []*transaction.Transaction{
+		{ID: "t1", Type: transaction.TypePayment, Origin: testOrigin, VendRegisterID: "r1", VendSaleID: "s1", PurchaseNumber: "P1", Amount: 4400, Status: statusAccepted},
+	}}
+
+	defer useFakes(gateway, newMemoryRegisters(pairedRegister()), txns, nil)()
+	appConfig = &config.HostConfig{Vend: config.VendConfig{VoidRefunds: true}}
+	sale := &vend.WebhookSale{ID: "s1", Status: vend.SaleStatusVoided}
+
+	// Oxipay may have made the refund, so it is left for someone to check
+	if err := saleUpdated(testOrigin, sale); err != nil {
+		t.Fatal(err)
+	}
+	if refund := txns.last(); refund.Status != statusUnknown {
+		t.Errorf("expected the refund to be recorded as unknown, got %+v", refund)
+	}
+
+	gateway.err = nil
+	if err := saleUpdated(testOrigin, sale); err != nil || gateway.calls != 1 {
+		t.Errorf("expected the refund not to be sent again, got %v and %d requests to Oxipay", err, gateway.calls)
+	}
+}
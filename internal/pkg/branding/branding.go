@@ -0,0 +1,158 @@
+// Package branding describes how the proxy presents itself to cashiers and
+// customers, so the same deployment can be white-labelled per region or per
+// merchant e.g humm in New Zealand and Oxipay in Australia
+package branding
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultProfile is the name of the built in profile
+const DefaultProfile = "oxipay"
+
+// Profile is a single brand
+type Profile struct {
+	ProductName    string `json:"productname"`
+	Logo           string `json:"logo"` // relative to the assets e.g images/oxipay-orange.svg
+	SupportEmail   string `json:"supportemail"`
+	SupportPhone   string `json:"supportphone"`
+	MerchantPortal string `json:"merchantportal"`
+	PrimaryColour  string `json:"primarycolour"`
+	AccentColour   string `json:"accentcolour"`
+	ReceiptFooter  string `json:"receiptfooter"`
+}
+
+// Config selects a profile per merchant, falling back to the profile for the
+// region of the deployment and then the default profile
+type Config struct {
+	Default   string             `json:"default"`
+	Region    string             `json:"region"`
+	Profiles  map[string]Profile `json:"profiles"`
+	Regions   map[string]string  `json:"regions"`   // region e.g NZ to profile name
+	Merchants map[string]string  `json:"merchants"` // Oxipay merchant ID to profile name
+}
+
+var colour = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Default returns the built in Oxipay profile
+func Default() Profile {
+	return Profile{
+		ProductName:    "Oxipay",
+		Logo:           "images/oxipay-orange.svg",
+		SupportEmail:   "pit@oxipay.com.au",
+		SupportPhone:   "+61 884641835",
+		MerchantPortal: "https://portals.oxipay.com.au/merchantarea#/login",
+		PrimaryColour:  "#f26e21",
+		AccentColour:   "#4a4a4a",
+	}
+}
+
+// Resolve returns the profile for the merchant, which may be empty if we don't
+// know who the merchant is yet
+func (c Config) Resolve(merchantID string) Profile {
+	if name, ok := c.Merchants[merchantID]; ok && merchantID != "" {
+		if profile, ok := c.profile(name); ok {
+			return profile
+		}
+	}
+
+	if name, ok := c.Regions[strings.ToUpper(c.Region)]; ok {
+		if profile, ok := c.profile(name); ok {
+			return profile
+		}
+	}
+
+	if profile, ok := c.profile(c.Default); ok {
+		return profile
+	}
+	return Default()
+}
+
+func (c Config) profile(name string) (Profile, bool) {
+	profile, ok := c.Profiles[name]
+	if !ok && name == DefaultProfile {
+		return Default(), true
+	}
+	return profile.withDefaults(), ok
+}
+
+// Validate returns a description of each problem with the branding config
+func (c Config) Validate() []string {
+	var problems []string
+
+	exists := func(name string) bool {
+		_, ok := c.Profiles[name]
+		return ok || name == DefaultProfile
+	}
+
+	if c.Default != "" && !exists(c.Default) {
+		problems = append(problems, fmt.Sprintf("default profile %q is not defined", c.Default))
+	}
+
+	for region, name := range c.Regions {
+		if !exists(name) {
+			problems = append(problems, fmt.Sprintf("region %s uses profile %q which is not defined", region, name))
+		}
+	}
+
+	for merchant, name := range c.Merchants {
+		if !exists(name) {
+			problems = append(problems, fmt.Sprintf("merchant %s uses profile %q which is not defined", merchant, name))
+		}
+	}
+
+	for name, profile := range c.Profiles {
+		if name != DefaultProfile {
+			// these are never taken from the default profile, as a cashier
+			// would be sent to another brand for help
+			required := []struct{ field, value string }{
+				{"productname", profile.ProductName},
+				{"logo", profile.Logo},
+				{"supportemail", profile.SupportEmail},
+			}
+			for _, r := range required {
+				if r.value == "" {
+					problems = append(problems, fmt.Sprintf("profile %s has no %s", name, r.field))
+				}
+			}
+		}
+
+		for _, value := range []string{profile.PrimaryColour, profile.AccentColour} {
+			if value != "" && !colour.MatchString(value) {
+				problems = append(problems, fmt.Sprintf("profile %s has colour %q, use a hex colour e.g #f26e21", name, value))
+			}
+		}
+	}
+
+	return problems
+}
+
+// withDefaults fills in the colours the profile doesn't set from the default
+// profile. Names, contacts and links belong to the brand so they are never
+// filled in, and a profile that sets nothing at all is the default profile
+func (p Profile) withDefaults() Profile {
+	d := Default()
+	if p == (Profile{}) {
+		return d
+	}
+	if p.PrimaryColour == "" {
+		p.PrimaryColour = d.PrimaryColour
+	}
+	if p.AccentColour == "" {
+		p.AccentColour = d.AccentColour
+	}
+	return p
+}
+
+// Apply replaces the {product}, {support_email} and {support_phone}
+// placeholders in a message with the values for the profile
+func (p Profile) Apply(message string) string {
+	p = p.withDefaults()
+	return strings.NewReplacer(
+		"{product}", p.ProductName,
+		"{support_email}", p.SupportEmail,
+		"{support_phone}", p.SupportPhone,
+	).Replace(message)
+}
@@ -0,0 +1,89 @@
+package branding
+
+import (
+	"testing"
+)
+
+func testConfig() Config {
+	return Config{
+		Default: "oxipay",
+		Region:  "nz",
+		Profiles: map[string]Profile{
+			"humm": {
+				ProductName:  "humm",
+				Logo:         "images/humm.svg",
+				SupportEmail: "support@example.co.nz",
+			},
+			"partner": {
+				ProductName:    "Partner Pay",
+				Logo:           "images/partner.svg",
+				SupportEmail:   "help@partner.example",
+				MerchantPortal: "https://partner.example/merchants",
+			},
+		},
+		Regions: map[string]string{
+			"NZ": "humm",
+		},
+		Merchants: map[string]string{
+			"30188105": "partner",
+		},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c := testConfig()
+
+	if got := c.Resolve("30188105").ProductName; got != "Partner Pay" {
+		t.Errorf("expected the merchant profile, got %s", got)
+	}
+
+	if got := c.Resolve("").ProductName; got != "humm" {
+		t.Errorf("expected the region profile, got %s", got)
+	}
+
+	c.Region = "AU"
+	if got := c.Resolve("1234").ProductName; got != "Oxipay" {
+		t.Errorf("expected the default profile, got %s", got)
+	}
+
+	if got := (Config{}).Resolve("").ProductName; got != "Oxipay" {
+		t.Errorf("expected an empty config to use the built in profile, got %s", got)
+	}
+}
+
+func TestResolveFillsInDefaults(t *testing.T) {
+	humm := testConfig().Resolve("")
+	if humm.PrimaryColour != Default().PrimaryColour {
+		t.Errorf("expected the default colour, got %q", humm.PrimaryColour)
+	}
+
+	// another brand's contacts would send the cashier to the wrong place
+	if humm.MerchantPortal != "" || humm.SupportPhone != "" {
+		t.Errorf("expected the contacts the profile doesn't set to be empty, got %+v", humm)
+	}
+}
+
+func TestApply(t *testing.T) {
+	humm := testConfig().Resolve("")
+	got := humm.Apply("Please contact {product} at {support_email}")
+	if got != "Please contact humm at support@example.co.nz" {
+		t.Errorf("unexpected message %q", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if problems := testConfig().Validate(); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	c := testConfig()
+	c.Default = "missing"
+	c.Regions["AU"] = "missing"
+	c.Merchants["1"] = "missing"
+	c.Profiles["bad"] = Profile{ProductName: "Bad", Logo: "images/bad.svg", SupportEmail: "bad@example.com", PrimaryColour: "orange"}
+	c.Profiles["empty"] = Profile{}
+
+	if problems := c.Validate(); len(problems) != 7 {
+		t.Errorf("expected 7 problems, got %v", problems)
+	}
+}
@@ -0,0 +1,252 @@
+// Package bulk pairs many Vend registers with Oxipay at once from a CSV file,
+// so large retailers don't have to visit /register at every till
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// The outcome of pairing a row
+const (
+	Paired  = "paired"
+	Failed  = "failed"
+	Skipped = "skipped"
+)
+
+// DefaultConcurrency is how many registers are paired at the same time
+const DefaultConcurrency = 4
+
+// MaxConcurrency stops an upload from flooding Oxipay with registrations
+const MaxConcurrency = 16
+
+// Row is a register to pair
+type Row struct {
+	Line        int
+	Origin      string
+	RegisterID  string
+	MerchantID  string
+	DeviceToken string
+	Locale      string // optional
+}
+
+// Result is the outcome of pairing a row. The device token isn't included as
+// it is a secret
+type Result struct {
+	Line       int    `json:"line"`
+	Origin     string `json:"origin"`
+	RegisterID string `json:"register_id"`
+	MerchantID string `json:"merchant_id"`
+	Status     string `json:"status"`
+	DeviceID   string `json:"device_id,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// Summary counts the results with each status
+type Summary map[string]int
+
+// Report is the result of an upload
+type Report struct {
+	Summary Summary  `json:"summary"`
+	Results []Result `json:"results"`
+}
+
+// the columns we look for in the file, the first match wins. They are checked
+// in this order so a file missing more than one always gets the same error
+var columns = []struct {
+	field string
+	names []string
+}{
+	{"origin", []string{"origin", "vend origin", "domain"}},
+	{"register", []string{"register_id", "register id", "vend register id", "vend_register_id"}},
+	{"merchant", []string{"merchant_id", "merchant id", "merchant", "merchant number"}},
+	{"token", []string{"device_token", "device token", "token"}},
+}
+
+// optional columns
+var localeColumns = []string{"locale", "language"}
+
+// ReadRows parses the CSV. The file must have a header row containing origin,
+// register ID, merchant ID and device token columns in any order, and may have
+// a locale column
+func ReadRows(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header: %s", err)
+	}
+
+	index := make(map[string]int)
+	for _, column := range columns {
+		if i := find(header, column.names); i >= 0 {
+			index[column.field] = i
+			continue
+		}
+		return nil, fmt.Errorf("the file has no %s column, expected one of %s", column.field, strings.Join(column.names, ", "))
+	}
+	localeIndex := find(header, localeColumns)
+
+	var rows []Row
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		row := Row{
+			Line:        line,
+			Origin:      strings.TrimRight(strings.TrimSpace(record[index["origin"]]), "/"),
+			RegisterID:  strings.TrimSpace(record[index["register"]]),
+			MerchantID:  strings.TrimSpace(record[index["merchant"]]),
+			DeviceToken: strings.TrimSpace(record[index["token"]]),
+		}
+		if localeIndex >= 0 {
+			row.Locale = strings.TrimSpace(record[localeIndex])
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Run pairs the rows, at most concurrency at a time, and reports on each in
+// the order of the file. Rows missing a value and registers that appear more
+// than once are skipped rather than sent to Oxipay
+func Run(rows []Row, concurrency int, pair func(Row) Result) Report {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > MaxConcurrency {
+		concurrency = MaxConcurrency
+	}
+
+	results := make([]Result, len(rows))
+	seen := make(map[string]int)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for i, row := range rows {
+		if msg := check(row); msg != "" {
+			results[i] = skip(row, msg)
+			continue
+		}
+
+		key := row.Origin + " " + row.RegisterID
+		if first, ok := seen[key]; ok {
+			results[i] = skip(row, fmt.Sprintf("the register is already on line %d", first))
+			continue
+		}
+		seen[key] = row.Line
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, row Row) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := pair(row)
+			result.Line = row.Line
+			result.Origin = row.Origin
+			result.RegisterID = row.RegisterID
+			result.MerchantID = row.MerchantID
+			results[i] = result
+		}(i, row)
+	}
+	wg.Wait()
+
+	summary := Summary{Paired: 0, Failed: 0, Skipped: 0}
+	for _, result := range results {
+		summary[result.Status]++
+	}
+	return Report{Summary: summary, Results: results}
+}
+
+func check(row Row) string {
+	var missing []string
+	if row.Origin == "" {
+		missing = append(missing, "origin")
+	}
+	if row.RegisterID == "" {
+		missing = append(missing, "register ID")
+	}
+	if row.MerchantID == "" {
+		missing = append(missing, "merchant ID")
+	}
+	if row.DeviceToken == "" {
+		missing = append(missing, "device token")
+	}
+	if len(missing) > 0 {
+		return "missing " + strings.Join(missing, ", ")
+	}
+	return ""
+}
+
+func skip(row Row, message string) Result {
+	return Result{
+		Line:       row.Line,
+		Origin:     row.Origin,
+		RegisterID: row.RegisterID,
+		MerchantID: row.MerchantID,
+		Status:     Skipped,
+		Message:    message,
+	}
+}
+
+// WriteCSV writes the report as CSV
+func WriteCSV(w io.Writer, report Report) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"line",
+		"origin",
+		"register_id",
+		"merchant_id",
+		"status",
+		"device_id",
+		"message",
+	})
+
+	for _, r := range report.Results {
+		out.Write([]string{
+			fmt.Sprint(r.Line),
+			r.Origin,
+			r.RegisterID,
+			r.MerchantID,
+			r.Status,
+			r.DeviceID,
+			r.Message,
+		})
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// WriteJSON writes the report as indented JSON
+func WriteJSON(w io.Writer, report Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// find returns the index of the first column with one of the names, or -1
+func find(header []string, names []string) int {
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		for _, name := range names {
+			if column == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
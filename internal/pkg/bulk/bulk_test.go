@@ -0,0 +1,105 @@
+package bulk
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const upload = `Vend Origin,Register ID,Merchant ID,Device Token,Locale
+https://example.vendhq.com/,r1,30188105,token1,mi-NZ
+https://example.vendhq.com,r2,30188105,token2,
+https://example.vendhq.com,r1,30188105,token3,
+https://example.vendhq.com,r3,30188105,,
+`
+
+func TestReadRows(t *testing.T) {
+	rows, err := ReadRows(strings.NewReader(upload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 rows, got %d", len(rows))
+	}
+
+	expected := Row{Line: 2, Origin: "https://example.vendhq.com", RegisterID: "r1", MerchantID: "30188105", DeviceToken: "token1", Locale: "mi-NZ"}
+	if rows[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, rows[0])
+	}
+}
+
+func TestReadRowsNeedsColumns(t *testing.T) {
+	_, err := ReadRows(strings.NewReader("origin,register_id,merchant_id\n"))
+	if err == nil || !strings.Contains(err.Error(), "token") {
+		t.Errorf("expected a missing device token column, got %v", err)
+	}
+
+	// the first missing column is reported, every time
+	for i := 0; i < 10; i++ {
+		_, err := ReadRows(strings.NewReader("locale\n"))
+		if err == nil || !strings.HasPrefix(err.Error(), "the file has no origin column") {
+			t.Fatalf("expected a missing origin column, got %v", err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	rows, err := ReadRows(strings.NewReader(upload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := Run(rows, 2, func(row Row) Result {
+		if row.DeviceToken == "token2" {
+			return Result{Status: Failed, Message: "Device token provided has already been used"}
+		}
+		return Result{Status: Paired, DeviceID: row.DeviceToken + "-1"}
+	})
+
+	statuses := []string{Paired, Failed, Skipped, Skipped}
+	for i, result := range report.Results {
+		if result.Status != statuses[i] || result.Line != i+2 {
+			t.Errorf("line %d: expected %s, got %+v", i+2, statuses[i], result)
+		}
+	}
+
+	if report.Summary[Paired] != 1 || report.Summary[Failed] != 1 || report.Summary[Skipped] != 2 {
+		t.Errorf("unexpected summary %v", report.Summary)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "token2,") {
+		t.Error("the device token should not be in the report")
+	}
+}
+
+func TestRunLimitsConcurrency(t *testing.T) {
+	var rows []Row
+	for i := 0; i < 20; i++ {
+		rows = append(rows, Row{Line: i + 2, Origin: "https://example.vendhq.com", RegisterID: string(rune('a' + i)), MerchantID: "1", DeviceToken: "t"})
+	}
+
+	var running, most int32
+	Run(rows, 3, func(row Row) Result {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return Result{Status: Paired}
+	})
+
+	if most > 3 {
+		t.Errorf("expected at most 3 at a time, got %d", most)
+	}
+}
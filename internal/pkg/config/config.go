@@ -2,16 +2,54 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	micro "github.com/micro/go-config"
 	"github.com/micro/go-config/source/env"
 	"github.com/micro/go-config/source/file"
+	"github.com/oxipay/oxipay-vend/internal/pkg/branding"
+	"github.com/oxipay/oxipay-vend/internal/pkg/i18n"
+	"github.com/oxipay/oxipay-vend/internal/pkg/secret"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultOxipayVersion is the version of the Oxipay POS API we talk to
+	// when the configuration file doesn't specify one
+	DefaultOxipayVersion = "1.1"
+
+	// MinSessionSecretLength is the shortest session secret we will accept
+	MinSessionSecretLength = 16
+
+	// MinAdminTokenLength is the shortest admin token we will accept
+	MinAdminTokenLength = 32
+
+	// EnvironmentProduction is the default environment
+	EnvironmentProduction = "production"
+
+	// DefaultRegisterCache is how long registers are cached when the
+	// configuration file doesn't say. It is short so that a register unpaired
+	// or re-keyed by another webserver is soon seen by this one. "0" turns the
+	// cache off
+	DefaultRegisterCache = "5s"
+
+	// DefaultRequestTimeout is how long a request may take when the
+	// configuration file doesn't say
+	DefaultRequestTimeout = "60s"
 )
 
 // WebserverConfig configuration for the webserver
 type WebserverConfig struct {
 	Port    string `json:"port"`
 	Address string `json:"address"`
+
+	// Timeout is how long a request may take before the calls it makes to
+	// Vend are given up on e.g "60s"
+	Timeout string `json:"timeout"`
 }
 
 // SessionConfig configuration for the session
@@ -35,18 +73,98 @@ type DbConnection struct {
 
 // HostConfig data structure that represent a valid configuration file
 type HostConfig struct {
-	Webserver  WebserverConfig `json:"webserver"`
-	Database   DbConnection    `json:"database"`
-	Session    SessionConfig   `json:"session"`
-	Oxipay     OxipayConfig    `json:"oxipay"`
-	Background bool            `json:"background"`
-	LogLevel   string          `json:"loglevel"`
+	Webserver   WebserverConfig `json:"webserver"`
+	Database    DbConnection    `json:"database"`
+	Session     SessionConfig   `json:"session"`
+	Oxipay      OxipayConfig    `json:"oxipay"`
+	Background  bool            `json:"background"`
+	LogLevel    string          `json:"loglevel"`
+	Environment string          `json:"environment"`
+	Locale      string          `json:"locale"`
+	Branding    branding.Config `json:"branding"`
+	Admin       AdminConfig     `json:"admin"`
+	Vend        VendConfig      `json:"vend"`
+
+	// ReceiptTemplate is an optional html/template file that replaces the
+	// built in receipt
+	ReceiptTemplate string `json:"receipttemplate"`
+
+	// RegisterCache is how long a register is kept in memory after it is
+	// looked up e.g "30s", DefaultRegisterCache when it isn't set. "0" looks
+	// the register up on every request
+	RegisterCache string `json:"registercache"`
+}
+
+// AdminConfig configures the API used by staff e.g the transaction export
+type AdminConfig struct {
+	// Token must be sent as a bearer token. The admin API is disabled
+	// when it isn't set
+	Token string `json:"token"`
+}
+
+// VendConfig is the application registered with Vend, used to call the Vend
+// API on behalf of the retailers that connect to it
+type VendConfig struct {
+	ClientID     string `json:"clientid"`
+	ClientSecret string `json:"clientsecret"`
+	RedirectURL  string `json:"redirecturl"`
+
+	// PaymentURL is the address of this deployment that Vend opens to take
+	// a payment. It defaults to the host of the redirect URL
+	PaymentURL string `json:"paymenturl"`
+
+	// TokenKey encrypts the retailers' tokens in the database. It is 32
+	// bytes encoded as hex or base64
+	TokenKey string `json:"tokenkey"`
+
+	// AuthURL and TokenURL override the Vend endpoints, for testing
+	AuthURL  string `json:"authurl"`
+	TokenURL string `json:"tokenurl"`
+
+	// VerifySales fetches the sale from Vend before a payment is authorised
+	// and refuses the payment if it doesn't match
+	VerifySales bool `json:"verifysales"`
+
+	// VoidRefunds refunds humm payments on sales that are voided in Vend.
+	// Otherwise the payments are only flagged
+	VoidRefunds bool `json:"voidrefunds"`
+}
+
+// Enabled returns true if the Vend API has been configured
+func (v VendConfig) Enabled() bool {
+	return v.ClientID != ""
 }
 
 // OxipayConfig data structure that represents a valid Oxipay configuration file entry
 type OxipayConfig struct {
 	GatewayURL string `json:"gatewayurl"`
-	Version    string
+	Version    string `json:"version"`
+
+	// ResponseCodes is an optional file that extends the built in response
+	// code catalogue
+	ResponseCodes string `json:"responsecodes"`
+}
+
+// FieldError describes a single configuration value that is invalid
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Errors is returned when the configuration fails validation. It holds every
+// problem that was found so they can all be fixed in one go
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(msgs, "; "))
 }
 
 // ReadApplicationConfig will load the application configuration from known places on the disk or environment
@@ -68,33 +186,183 @@ func ReadApplicationConfig(configFile string) (HostConfig, error) {
 
 	errs := validate(conf)
 	if len(errs) > 0 {
-		return hostConfiguration, errs[0]
+		return hostConfiguration, errs
 	}
+
 	err = conf.Scan(&hostConfiguration)
+	if err != nil {
+		return hostConfiguration, err
+	}
+
+	hostConfiguration.setDefaults()
 
-	// hardcode this for now
-	// should load from a non-config file
-	hostConfiguration.Oxipay.Version = "1.1"
+	return hostConfiguration, hostConfiguration.Validate()
+}
+
+// setDefaults fills in values that are optional in the configuration file
+func (c *HostConfig) setDefaults() {
+	if c.Oxipay.Version == "" {
+		c.Oxipay.Version = DefaultOxipayVersion
+	}
+
+	if c.Environment == "" {
+		c.Environment = EnvironmentProduction
+	}
+
+	if c.Locale == "" {
+		c.Locale = i18n.DefaultLocale
+	}
+
+	if c.RegisterCache == "" {
+		c.RegisterCache = DefaultRegisterCache
+	}
+
+	if c.Webserver.Timeout == "" {
+		c.Webserver.Timeout = DefaultRequestTimeout
+	}
+
+	if c.Vend.PaymentURL == "" {
+		if redirect, err := url.Parse(c.Vend.RedirectURL); err == nil && redirect.Host != "" {
+			c.Vend.PaymentURL = redirect.Scheme + "://" + redirect.Host + "/"
+		}
+	}
+}
 
-	return hostConfiguration, err
+// RegisterCacheTTL returns how long registers are cached for, zero when they
+// aren't
+func (c HostConfig) RegisterCacheTTL() time.Duration {
+	ttl, _ := time.ParseDuration(c.RegisterCache)
+	return ttl
+}
+
+// RequestTimeout returns how long a request may take
+func (c HostConfig) RequestTimeout() time.Duration {
+	timeout, _ := time.ParseDuration(c.Webserver.Timeout)
+	return timeout
+}
+
+// IsProduction returns true if we are running against real customers
+func (c HostConfig) IsProduction() bool {
+	return c.Environment == EnvironmentProduction
+}
+
+// Validate checks every field of the configuration and returns an Errors
+// containing all of the problems found, or nil if the configuration is usable
+func (c HostConfig) Validate() error {
+	var errs Errors
+
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	port, err := strconv.Atoi(c.Webserver.Port)
+	if err != nil || port < 1 || port > 65535 {
+		invalid("webserver.port", "%q must be a number between 1 and 65535", c.Webserver.Port)
+	}
+
+	if timeout, err := time.ParseDuration(c.Webserver.Timeout); c.Webserver.Timeout != "" && (err != nil || timeout <= 0) {
+		invalid("webserver.timeout", "%q is not a valid duration, try something like \"60s\"", c.Webserver.Timeout)
+	}
+
+	if strings.TrimSpace(c.Database.Host) == "" {
+		invalid("database.host", "must not be empty, use host:port e.g 127.0.0.1:3306")
+	}
+
+	if strings.TrimSpace(c.Database.Name) == "" {
+		invalid("database.name", "must not be empty")
+	}
+
+	if _, err := time.ParseDuration(c.Database.Timeout); err != nil {
+		invalid("database.timeout", "%q is not a valid duration, try something like \"20s\"", c.Database.Timeout)
+	}
+
+	if ttl, err := time.ParseDuration(c.RegisterCache); c.RegisterCache != "" && (err != nil || ttl < 0) {
+		invalid("registercache", "%q is not a valid duration, try something like \"30s\" or \"0\" to turn it off", c.RegisterCache)
+	}
+
+	if len(c.Session.Secret) < MinSessionSecretLength {
+		invalid("session.secret", "must be at least %d characters long", MinSessionSecretLength)
+	}
+
+	if c.Admin.Token != "" && len(c.Admin.Token) < MinAdminTokenLength {
+		invalid("admin.token", "must be at least %d characters long", MinAdminTokenLength)
+	}
+
+	if c.Vend.Enabled() {
+		if c.Vend.ClientSecret == "" {
+			invalid("vend.clientsecret", "must not be empty when vend.clientid is set")
+		}
+		if redirect, err := url.Parse(c.Vend.RedirectURL); err != nil || redirect.Scheme == "" || redirect.Host == "" {
+			invalid("vend.redirecturl", "%q is not a valid URL, it should end in /vend/callback", c.Vend.RedirectURL)
+		}
+		if payment, err := url.Parse(c.Vend.PaymentURL); c.Vend.PaymentURL != "" && (err != nil || payment.Scheme != "https" || payment.Host == "") {
+			invalid("vend.paymenturl", "%q is not a valid https URL", c.Vend.PaymentURL)
+		}
+		if _, err := secret.ParseKey(c.Vend.TokenKey); err != nil {
+			invalid("vend.tokenkey", "must be %d random bytes encoded as hex or base64", secret.KeyLength)
+		}
+	} else {
+		if c.Vend.VerifySales {
+			invalid("vend.verifysales", "needs the Vend API, set vend.clientid")
+		}
+		if c.Vend.VoidRefunds {
+			invalid("vend.voidrefunds", "needs the Vend API, set vend.clientid")
+		}
+	}
+
+	gateway, err := url.Parse(c.Oxipay.GatewayURL)
+	switch {
+	case c.Oxipay.GatewayURL == "":
+		invalid("oxipay.gatewayurl", "must not be empty")
+	case err != nil || gateway.Scheme == "" || gateway.Host == "":
+		invalid("oxipay.gatewayurl", "%q is not a valid URL", c.Oxipay.GatewayURL)
+	case c.IsProduction() && gateway.Scheme != "https":
+		invalid("oxipay.gatewayurl", "%q must use https in production", c.Oxipay.GatewayURL)
+	}
+
+	if c.Oxipay.ResponseCodes != "" {
+		if _, err := os.Stat(c.Oxipay.ResponseCodes); err != nil {
+			invalid("oxipay.responsecodes", "unable to read %q: %s", c.Oxipay.ResponseCodes, err)
+		}
+	}
+
+	if c.ReceiptTemplate != "" {
+		if _, err := os.Stat(c.ReceiptTemplate); err != nil {
+			invalid("receipttemplate", "unable to read %q: %s", c.ReceiptTemplate, err)
+		}
+	}
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		invalid("loglevel", "%q is not a valid log level, try \"info\" in production", c.LogLevel)
+	}
+
+	if !i18n.Default().Supports(c.Locale) {
+		invalid("locale", "%q is not supported, use one of %s", c.Locale, strings.Join(i18n.Default().Locales(), ", "))
+	}
+
+	for _, problem := range c.Branding.Validate() {
+		invalid("branding", "%s", problem)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
-// Validate ensure we have some basic validation of the configuration
-func validate(myconfig micro.Config) []error {
+// validate ensures the required sections exist before we attempt to scan them
+func validate(myconfig micro.Config) Errors {
 	required := [3]string{"webserver", "database", "session"}
-	var errs []error
+	var errs Errors
 
-	// We need to do more error checking here but let's at least make an
-	// attempt
 	for _, entry := range required {
 		var tmpMap map[string]string
 		configValue := myconfig.Get(entry).StringMap(tmpMap)
 		if configValue == nil {
-			newErr := fmt.Errorf("Config is missing a definition for %s", entry)
+			newErr := &FieldError{Field: entry, Message: "config is missing a definition for this section"}
 			errs = append(errs, newErr)
 		}
 	}
 
-	// check the ensure the log level works
 	return errs
 }
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -10,5 +12,106 @@ func TestLoadConfig(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	_ = myconfig
+
+	if ttl := myconfig.RegisterCacheTTL(); ttl != 5*time.Second {
+		t.Errorf("expected registers to be cached for 5s by default, got %s", ttl)
+	}
+}
+
+func validConfig() HostConfig {
+	return HostConfig{
+		Webserver: WebserverConfig{Port: "5000"},
+		Database: DbConnection{
+			Host:    "127.0.0.1:3306",
+			Name:    "vend",
+			Timeout: "20s",
+		},
+		Session: SessionConfig{
+			Secret: "SxXcr8n9xFzsfUowQsyMUaou",
+		},
+		Oxipay: OxipayConfig{
+			GatewayURL: "https://sandboxpos.oxipay.com.au/webapi/v1/",
+			Version:    DefaultOxipayVersion,
+		},
+		LogLevel:    "info",
+		Environment: EnvironmentProduction,
+		Locale:      "en-NZ",
+	}
+}
+
+func TestValidateValidConfig(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Errorf("expected a valid config, got %s", err)
+	}
+}
+
+func TestValidateReportsEveryField(t *testing.T) {
+	tests := []struct {
+		name   string
+		field  string
+		mutate func(c *HostConfig)
+	}{
+		{"port not a number", "webserver.port", func(c *HostConfig) { c.Webserver.Port = "http" }},
+		{"port out of range", "webserver.port", func(c *HostConfig) { c.Webserver.Port = "70000" }},
+		{"empty db host", "database.host", func(c *HostConfig) { c.Database.Host = " " }},
+		{"bad db timeout", "database.timeout", func(c *HostConfig) { c.Database.Timeout = "20" }},
+		{"short session secret", "session.secret", func(c *HostConfig) { c.Session.Secret = "secret" }},
+		{"bad request timeout", "webserver.timeout", func(c *HostConfig) { c.Webserver.Timeout = "soon" }},
+		{"zero request timeout", "webserver.timeout", func(c *HostConfig) { c.Webserver.Timeout = "0" }},
+		{"bad register cache", "registercache", func(c *HostConfig) { c.RegisterCache = "soon" }},
+		{"negative register cache", "registercache", func(c *HostConfig) { c.RegisterCache = "-1s" }},
+		{"malformed gateway", "oxipay.gatewayurl", func(c *HostConfig) { c.Oxipay.GatewayURL = "sandboxpos" }},
+		{"http gateway in production", "oxipay.gatewayurl", func(c *HostConfig) { c.Oxipay.GatewayURL = "http://sandboxpos.oxipay.com.au" }},
+		{"bad log level", "loglevel", func(c *HostConfig) { c.LogLevel = "loud" }},
+		{"unsupported locale", "locale", func(c *HostConfig) { c.Locale = "fr-FR" }},
+		{"short admin token", "admin.token", func(c *HostConfig) { c.Admin.Token = "admin" }},
+		{"vend without token key", "vend.tokenkey", func(c *HostConfig) {
+			c.Vend = VendConfig{ClientID: "id", ClientSecret: "secret", RedirectURL: "https://example.com/vend/callback", TokenKey: "short"}
+		}},
+		{"vend payment url", "vend.paymenturl", func(c *HostConfig) {
+			c.Vend = VendConfig{ClientID: "id", ClientSecret: "secret", RedirectURL: "https://example.com/vend/callback", PaymentURL: "http://example.com/", TokenKey: strings.Repeat("ab", 32)}
+		}},
+		{"verify sales without vend", "vend.verifysales", func(c *HostConfig) { c.Vend.VerifySales = true }},
+		{"void refunds without vend", "vend.voidrefunds", func(c *HostConfig) { c.Vend.VoidRefunds = true }},
+		{"unknown branding profile", "branding", func(c *HostConfig) { c.Branding.Default = "missing" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.mutate(&c)
+
+			errs, ok := c.Validate().(Errors)
+			if !ok || len(errs) != 1 {
+				t.Fatalf("expected exactly one error, got %v", errs)
+			}
+
+			fieldErr, ok := errs[0].(*FieldError)
+			if !ok || fieldErr.Field != tt.field {
+				t.Errorf("expected an error for %s, got %s", tt.field, errs[0])
+			}
+		})
+	}
+}
+
+func TestValidateReturnsAllErrors(t *testing.T) {
+	c := validConfig()
+	c.Webserver.Port = ""
+	c.Database.Host = ""
+	c.LogLevel = ""
+
+	errs, ok := c.Validate().(Errors)
+	if !ok || len(errs) != 3 {
+		t.Errorf("expected 3 errors, got %v", errs)
+	}
+}
+
+func TestValidateAllowsHTTPGatewayOutsideProduction(t *testing.T) {
+	c := validConfig()
+	c.Environment = "development"
+	c.Oxipay.GatewayURL = "http://localhost:8080/webapi/v1/"
+
+	if err := c.Validate(); err != nil {
+		t.Errorf("expected http gateway to be allowed in development, got %s", err)
+	}
 }
@@ -0,0 +1,151 @@
+// Package export writes the transactions recorded by the proxy as CSV or
+// newline delimited JSON, one transaction at a time so that large exports
+// don't have to fit in memory
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+)
+
+// The supported formats
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Writer writes transactions in one of the export formats
+type Writer interface {
+	Write(txn *transaction.Transaction) error
+	// Flush writes anything that has been buffered
+	Flush() error
+}
+
+// Record is a transaction as it appears in the export
+type Record struct {
+	Created        time.Time `json:"created"`
+	TransactionID  string    `json:"transaction_id"`
+	Type           string    `json:"type"`
+	Status         string    `json:"status"`
+	Origin         string    `json:"origin"`
+	VendRegisterID string    `json:"vend_register_id"`
+	VendSaleID     string    `json:"vend_sale_id,omitempty"`
+	MerchantID     string    `json:"merchant_id"`
+	PurchaseNumber string    `json:"purchase_number,omitempty"`
+	Amount         int64     `json:"amount"` // cents
+	ResponseCode   string    `json:"response_code,omitempty"`
+}
+
+// NewRecord converts a transaction to a record
+func NewRecord(txn *transaction.Transaction) Record {
+	return Record{
+		Created:        txn.Created,
+		TransactionID:  txn.ID,
+		Type:           txn.Type,
+		Status:         txn.Status,
+		Origin:         txn.Origin,
+		VendRegisterID: txn.VendRegisterID,
+		VendSaleID:     txn.VendSaleID,
+		MerchantID:     txn.MerchantID,
+		PurchaseNumber: txn.PurchaseNumber,
+		Amount:         txn.Amount,
+		ResponseCode:   txn.ResponseCode,
+	}
+}
+
+// ContentType returns the MIME type of the format
+func ContentType(format string) string {
+	if format == FormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// NewWriter returns a writer for the format
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return &csvWriter{out: csv.NewWriter(w)}, nil
+	case FormatNDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use %s or %s", format, FormatCSV, FormatNDJSON)
+}
+
+var header = []string{
+	"created",
+	"transaction_id",
+	"type",
+	"status",
+	"origin",
+	"vend_register_id",
+	"vend_sale_id",
+	"merchant_id",
+	"purchase_number",
+	"amount",
+	"response_code",
+}
+
+type csvWriter struct {
+	out           *csv.Writer
+	headerWritten bool
+}
+
+// Write writes the transaction with the amount in dollars, the header is
+// written before the first transaction
+func (c *csvWriter) Write(txn *transaction.Transaction) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	r := NewRecord(txn)
+	return c.out.Write([]string{
+		r.Created.Format(time.RFC3339),
+		r.TransactionID,
+		r.Type,
+		r.Status,
+		r.Origin,
+		r.VendRegisterID,
+		r.VendSaleID,
+		r.MerchantID,
+		r.PurchaseNumber,
+		transaction.FormatAmount(r.Amount),
+		r.ResponseCode,
+	})
+}
+
+// Flush makes sure an empty export still has a header
+func (c *csvWriter) Flush() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.out.Flush()
+	return c.out.Error()
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	return c.out.Write(header)
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+// Write writes the transaction as a single line of JSON with the amount in cents
+func (n *ndjsonWriter) Write(txn *transaction.Transaction) error {
+	return n.encoder.Encode(NewRecord(txn))
+}
+
+// Flush does nothing as every line is written straight away
+func (n *ndjsonWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+)
+
+var txn = &transaction.Transaction{
+	ID:             "t1",
+	Type:           transaction.TypeRefund,
+	Origin:         "https://example.vendhq.com",
+	VendRegisterID: "register-1",
+	VendSaleID:     "sale-1",
+	MerchantID:     "30188105",
+	PurchaseNumber: "P100",
+	Amount:         -6990,
+	Status:         "ACCEPTED",
+	ResponseCode:   "SPSA01",
+	Created:        time.Date(2018, 11, 5, 14, 30, 0, 0, time.UTC),
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatCSV, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Write(txn); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a header and one row, got %q", buf.String())
+	}
+
+	expected := "2018-11-05T14:30:00Z,t1,refund,ACCEPTED,https://example.vendhq.com,register-1,sale-1,30188105,P100,-69.90,SPSA01"
+	if lines[1] != expected {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+}
+
+func TestEmptyCSVHasHeader(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(FormatCSV, &buf)
+	w.Flush()
+
+	if !strings.HasPrefix(buf.String(), "created,transaction_id,") {
+		t.Errorf("expected a header, got %q", buf.String())
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatNDJSON, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write(txn)
+	w.Write(txn)
+	w.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per transaction, got %q", buf.String())
+	}
+
+	var record Record
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Amount != -6990 || record.PurchaseNumber != "P100" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,186 @@
+// Package i18n holds the message catalogues used to talk to customers and
+// cashiers in their own language. Catalogues are keyed by locale e.g en-NZ
+// and then by message key e.g authorisation.FPRA01 or declined.title
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLocale is used when we can't work out which locale to use
+const DefaultLocale = "en-NZ"
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// Catalogue holds the messages for every supported locale
+type Catalogue struct {
+	fallback string
+	messages map[string]map[string]string
+}
+
+type catalogueFile struct {
+	Locale   string            `json:"locale"`
+	Messages map[string]string `json:"messages"`
+}
+
+var (
+	defaultOnce      sync.Once
+	defaultCatalogue *Catalogue
+)
+
+// Default returns the catalogue compiled into the binary
+func Default() *Catalogue {
+	defaultOnce.Do(func() {
+		var err error
+		defaultCatalogue, err = Load(DefaultLocale)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return defaultCatalogue
+}
+
+// Load reads the embedded catalogues. The fallback locale is used for any
+// message that hasn't been translated
+func Load(fallback string) (*Catalogue, error) {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Catalogue{
+		fallback: fallback,
+		messages: make(map[string]map[string]string),
+	}
+
+	for _, file := range files {
+		contents, err := locales.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var catalogue catalogueFile
+		if err := json.Unmarshal(contents, &catalogue); err != nil {
+			return nil, fmt.Errorf("unable to load %s: %s", file.Name(), err)
+		}
+		c.messages[canonical(catalogue.Locale)] = catalogue.Messages
+	}
+
+	if _, ok := c.messages[canonical(fallback)]; !ok {
+		return nil, fmt.Errorf("there is no catalogue for the fallback locale %s", fallback)
+	}
+	return c, nil
+}
+
+// Locales returns the supported locales
+func (c *Catalogue) Locales() []string {
+	var supported []string
+	for locale := range c.messages {
+		supported = append(supported, locale)
+	}
+	sort.Strings(supported)
+	return supported
+}
+
+// Supports returns true if there is a catalogue for the locale
+func (c *Catalogue) Supports(locale string) bool {
+	_, ok := c.messages[canonical(locale)]
+	return ok
+}
+
+// Lookup returns the message for the key in the locale, falling back to the
+// default locale if it hasn't been translated
+func (c *Catalogue) Lookup(locale string, key string) (string, bool) {
+	if message, ok := c.messages[canonical(locale)][key]; ok {
+		return message, true
+	}
+	message, ok := c.messages[canonical(c.fallback)][key]
+	return message, ok
+}
+
+// Translate returns the message for the key, or the key itself if there is
+// no message so that missing translations are obvious
+func (c *Catalogue) Translate(locale string, key string) string {
+	if message, ok := c.Lookup(locale, key); ok {
+		return message
+	}
+	return key
+}
+
+// Negotiate picks the best supported locale from an Accept-Language header,
+// returning the fallback locale if none of them are supported
+func (c *Catalogue) Negotiate(acceptLanguage string) string {
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if c.Supports(tag) {
+			return canonical(tag)
+		}
+
+		// settle for the same language in another region e.g mi matches mi-NZ
+		language := strings.SplitN(tag, "-", 2)[0] + "-"
+		if strings.HasPrefix(canonical(c.fallback), language) {
+			return canonical(c.fallback)
+		}
+		for _, locale := range c.Locales() {
+			if strings.HasPrefix(locale, language) {
+				return locale
+			}
+		}
+	}
+
+	return canonical(c.fallback)
+}
+
+// parseAcceptLanguage returns the language tags in order of preference
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			tags = append(tags, weighted{tag: strings.ToLower(tag), quality: quality})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].quality > tags[j].quality })
+
+	ordered := make([]string, len(tags))
+	for i, t := range tags {
+		ordered[i] = t.tag
+	}
+	return ordered
+}
+
+// canonical formats a locale as language-REGION e.g en-nz becomes en-NZ
+func canonical(locale string) string {
+	parts := strings.SplitN(strings.Replace(locale, "_", "-", -1), "-", 2)
+	if len(parts) == 1 {
+		return strings.ToLower(parts[0])
+	}
+	return strings.ToLower(parts[0]) + "-" + strings.ToUpper(parts[1])
+}
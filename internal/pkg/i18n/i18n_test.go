@@ -0,0 +1,62 @@
+package i18n
+
+import (
+	"testing"
+)
+
+func TestCataloguesAreComplete(t *testing.T) {
+	c := Default()
+	fallback := c.messages[DefaultLocale]
+
+	for _, locale := range c.Locales() {
+		for key := range fallback {
+			if _, ok := c.messages[locale][key]; !ok {
+				t.Errorf("%s is missing a translation for %s", locale, key)
+			}
+		}
+		for key := range c.messages[locale] {
+			if _, ok := fallback[key]; !ok {
+				t.Errorf("%s has %s which isn't in %s", locale, key, DefaultLocale)
+			}
+		}
+	}
+}
+
+func TestSupportedLocales(t *testing.T) {
+	for _, locale := range []string{"en-NZ", "en-AU", "mi-NZ", "mi-nz"} {
+		if !Default().Supports(locale) {
+			t.Errorf("expected %s to be supported", locale)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                            DefaultLocale,
+		"mi-NZ,en;q=0.8":              "mi-NZ",
+		"mi":                          "mi-NZ",
+		"en-AU":                       "en-AU",
+		"en-US,en;q=0.9":              "en-NZ",
+		"fr-FR,mi;q=0.5,en-AU;q=0.4":  "mi-NZ",
+		"de-DE":                       DefaultLocale,
+		"en-au;q=0.1, en-nz;q=0.9, *": "en-NZ",
+	}
+
+	for header, expected := range tests {
+		if got := Default().Negotiate(header); got != expected {
+			t.Errorf("Negotiate(%q) = %s, want %s", header, got, expected)
+		}
+	}
+}
+
+func TestTranslateFallsBack(t *testing.T) {
+	c := Default()
+
+	if got := c.Translate("fr-FR", "authorisation.SPRA01"); got != "APPROVED" {
+		t.Errorf("expected unsupported locales to use %s, got %s", DefaultLocale, got)
+	}
+
+	if got := c.Translate("mi-NZ", "no.such.key"); got != "no.such.key" {
+		t.Errorf("expected missing keys to be returned as is, got %s", got)
+	}
+}
@@ -0,0 +1,133 @@
+package migrate
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migration is a single schema change, applied in version order
+type Migration struct {
+	Version string
+	SQL     string
+}
+
+// Migrations returns every migration compiled into the binary in the order
+// they need to be applied
+func Migrations() ([]Migration, error) {
+	files, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Migration
+	for _, file := range files {
+		contents, err := migrations.ReadFile(path.Join("migrations", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, Migration{
+			Version: strings.TrimSuffix(file.Name(), ".sql"),
+			SQL:     string(contents),
+		})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all, nil
+}
+
+// Up applies any migration that hasn't been recorded in schema_migrations and
+// returns the versions that were applied
+func Up(db *sql.DB) ([]string, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version varchar(255) NOT NULL,
+		applied_date datetime DEFAULT CURRENT_TIMESTAMP,
+		primary key(version)
+	) engine=InnoDB`)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for _, m := range all {
+		if applied[m.Version] {
+			continue
+		}
+
+		for _, statement := range Statements(m.SQL) {
+			if _, err := db.Exec(statement); err != nil {
+				return done, fmt.Errorf("migration %s failed: %s", m.Version, err)
+			}
+		}
+
+		_, err := db.Exec("INSERT INTO schema_migrations (version) VALUES (?)", m.Version)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+
+	return done, nil
+}
+
+func appliedVersions(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Statements splits a migration into individual statements as the driver
+// won't execute more than one at a time. Statements must end with a ; at the
+// end of a line and comment lines are dropped.
+func Statements(script string) []string {
+	var statements []string
+	var current strings.Builder
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
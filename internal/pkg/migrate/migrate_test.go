@@ -0,0 +1,40 @@
+package migrate
+
+import (
+	"testing"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) == 0 {
+		t.Fatal("expected migrations to be embedded")
+	}
+
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Version >= all[i].Version {
+			t.Errorf("migration %s is out of order", all[i].Version)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	script := `-- a comment
+CREATE TABLE a (
+    id int
+);
+
+CREATE INDEX b ON a (id);
+`
+	statements := Statements(script)
+	if len(statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %v", len(statements), statements)
+	}
+
+	if statements[1] != "CREATE INDEX b ON a (id)" {
+		t.Errorf("unexpected statement %q", statements[1])
+	}
+}
@@ -0,0 +1,17 @@
+-- create the table to map the vend registers to oxipay
+CREATE TABLE IF NOT EXISTS oxipay_vend_map (
+    id int NOT NULL  auto_increment,
+    fxl_register_id varchar(255) NOT NULL COMMENT 'i.e oxipay/ezi-pay Device ID',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    fxl_device_signing_key varchar(255) COMMENT 'i.e Device specific signing key allocated by CreateKey',
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin provided in the initial request',
+    vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    created_by text NOT NULL ,
+    modified_date datetime,
+    modified_by text,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_registration USING HASH
+ON oxipay_vend_map (vend_register_id, fxl_seller_id, origin_domain);
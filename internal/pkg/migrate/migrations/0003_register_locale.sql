@@ -0,0 +1,3 @@
+-- the locale used for customer and cashier messages at the register
+ALTER TABLE oxipay_vend_map
+    ADD COLUMN IF NOT EXISTS locale varchar(16) COMMENT 'i.e en-NZ, empty to use the browser language';
@@ -0,0 +1,30 @@
+-- every payment and refund attempted through the proxy, so that Vend payments
+-- can be joined with the Oxipay settlement
+CREATE TABLE IF NOT EXISTS oxipay_vend_transaction (
+    id int NOT NULL auto_increment,
+    transaction_id varchar(32) NOT NULL COMMENT 'Proxy transaction ID sent to Vend as transaction_id',
+    type varchar(16) NOT NULL COMMENT 'payment or refund',
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin provided in the initial request',
+    vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    vend_sale_id varchar(255) COMMENT 'Client sale ID from Vend',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    fxl_purchase_number varchar(255) COMMENT 'Purchase number returned by oxipay/ezi-pay',
+    amount bigint NOT NULL COMMENT 'In cents, negative for refunds',
+    status varchar(16) NOT NULL,
+    response_code varchar(16),
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_transaction
+ON oxipay_vend_transaction (transaction_id);
+
+CREATE INDEX IF NOT EXISTS transaction_purchase_number
+ON oxipay_vend_transaction (fxl_purchase_number);
+
+CREATE INDEX IF NOT EXISTS transaction_sale
+ON oxipay_vend_transaction (vend_sale_id);
+
+CREATE INDEX IF NOT EXISTS transaction_created
+ON oxipay_vend_transaction (created_date);
@@ -0,0 +1,16 @@
+-- the Vend API tokens granted by each retailer, encrypted with the key in the
+-- configuration
+CREATE TABLE IF NOT EXISTS vend_oauth_token (
+    id int NOT NULL auto_increment,
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin, the same as oxipay_vend_map',
+    domain_prefix varchar(255) NOT NULL COMMENT 'i.e example for example.vendhq.com',
+    access_token text NOT NULL COMMENT 'AES-GCM encrypted',
+    refresh_token text NOT NULL COMMENT 'AES-GCM encrypted',
+    expires_date datetime,
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_vend_oauth_origin
+ON vend_oauth_token (origin_domain);
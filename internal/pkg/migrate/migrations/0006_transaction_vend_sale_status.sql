@@ -0,0 +1,3 @@
+-- flags payments whose sale was voided or returned in Vend after it was paid
+ALTER TABLE oxipay_vend_transaction
+    ADD COLUMN IF NOT EXISTS vend_sale_status varchar(32) COMMENT 'i.e VOIDED when the sale was voided in Vend after it was paid';
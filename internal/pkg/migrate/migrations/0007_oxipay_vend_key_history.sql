@@ -0,0 +1,16 @@
+-- signing keys replaced by re-keying a register, kept so payments signed with
+-- an old key can still be investigated
+CREATE TABLE IF NOT EXISTS oxipay_vend_key_history (
+    id int NOT NULL auto_increment,
+    fxl_register_id varchar(255) NOT NULL COMMENT 'i.e oxipay/ezi-pay Device ID',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    fxl_device_signing_key varchar(255) COMMENT 'the key that was replaced',
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin, the same as oxipay_vend_map',
+    vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'when the key was replaced',
+    created_by text NOT NULL,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE INDEX IF NOT EXISTS key_history_register
+ON oxipay_vend_key_history (origin_domain, vend_register_id);
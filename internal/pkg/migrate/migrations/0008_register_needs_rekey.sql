@@ -0,0 +1,3 @@
+-- set when Oxipay rejects the signing key of the register with ESIG01
+ALTER TABLE oxipay_vend_map
+    ADD COLUMN IF NOT EXISTS needs_rekey tinyint(1) NOT NULL DEFAULT 0 COMMENT '1 when the register must be re-keyed before taking payments';
@@ -0,0 +1,20 @@
+-- maps Vend outlets to the oxipay merchant their registers take payments with,
+-- for retailers with a merchant ID per store
+CREATE TABLE IF NOT EXISTS oxipay_vend_outlet (
+    id int NOT NULL auto_increment,
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin, the same as oxipay_vend_map',
+    vend_outlet_id varchar(255) NOT NULL COMMENT 'Unique Outlet ID from Vend',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    created_by text NOT NULL,
+    modified_date datetime,
+    modified_by text,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_vend_outlet
+ON oxipay_vend_outlet (origin_domain, vend_outlet_id);
+
+-- the outlet of the register when it was paired
+ALTER TABLE oxipay_vend_map
+    ADD COLUMN IF NOT EXISTS vend_outlet_id varchar(255) COMMENT 'Outlet ID from Vend, when known';
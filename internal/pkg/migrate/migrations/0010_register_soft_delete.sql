@@ -0,0 +1,9 @@
+-- unpaired registers are kept so the payments they took can still be traced
+ALTER TABLE oxipay_vend_map
+    ADD COLUMN IF NOT EXISTS deleted_date datetime COMMENT 'when the register was unpaired',
+    ADD COLUMN IF NOT EXISTS deleted_by text,
+    ADD COLUMN IF NOT EXISTS active tinyint(1) AS (IF(deleted_date IS NULL, 1, NULL)) STORED COMMENT '1 until the register is unpaired, NULL after so it can be paired again';
+
+-- only pairings that haven't been deleted need to be unique
+CREATE OR REPLACE UNIQUE INDEX unique_registration USING HASH
+ON oxipay_vend_map (vend_register_id, fxl_seller_id, origin_domain, active);
@@ -0,0 +1,4 @@
+-- marks payments that have been refunded because their sale was voided, so
+-- the refund is only sent once when Vend sends the webhook more than once
+ALTER TABLE oxipay_vend_transaction
+    ADD COLUMN IF NOT EXISTS void_refund_date datetime COMMENT 'when the payment was refunded because its sale was voided in Vend';
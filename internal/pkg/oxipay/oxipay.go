@@ -22,7 +22,13 @@ import (
 //HTTPClientTimout default http client timeout
 const HTTPClientTimout = 0
 
-const defaultResponseCode = "EISE01"
+// DefaultResponseCode is the response code used when Oxipay returns a code we
+// don't know about
+const DefaultResponseCode = "EISE01"
+
+// SignatureMismatch is the response code Oxipay returns when the request
+// wasn't signed with the key it holds for the device
+const SignatureMismatch = "ESIG01"
 
 // Client exposes an interface to Oxipay
 type Client interface {
@@ -97,9 +103,17 @@ type SalesAdjustmentPayload struct {
 
 // ResponseCode maps the oxipay response code to a generic ACCEPT/DECLINE
 type ResponseCode struct {
-	TxnStatus       string
-	LogMessage      string
-	CustomerMessage string
+	TxnStatus       string `json:"txn_status"`
+	LogMessage      string `json:"log_message"`
+	CustomerMessage string `json:"customer_message"`
+	Retryable       bool   `json:"retryable"`
+
+	// Unknown is set when Oxipay returned a code that isn't in the catalogue
+	Unknown bool `json:"-"`
+
+	// Custom is set for codes from a response code file, whose customer
+	// message is used instead of the translations of the built in codes
+	Custom bool `json:"-"`
 }
 
 const (
@@ -123,6 +137,18 @@ const (
 	Registration ResponseType = iota
 )
 
+func (t ResponseType) String() string {
+	switch t {
+	case Adjustment:
+		return "adjustment"
+	case Authorisation:
+		return "authorisation"
+	case Registration:
+		return "registration"
+	}
+	return "unknown"
+}
+
 // Ping returns pong
 func Ping() string {
 	return "pong"
@@ -219,6 +245,12 @@ func (payload *RegistrationPayload) Validate() error {
 	if payload == nil {
 		return errors.New("payload is empty")
 	}
+	if payload.MerchantID == "" {
+		return errors.New("MerchantID is required")
+	}
+	if payload.DeviceToken == "" {
+		return errors.New("DeviceToken is required")
+	}
 	return nil
 }
 
@@ -293,252 +325,3 @@ func CheckMAC(message []byte, messageMAC []byte, key []byte) (bool, error) {
 
 	return isGood, err
 }
-
-// ProcessRegistrationResponse provides a function to map an Oxipay CreateKey response to something we can pass back to the client
-func ProcessRegistrationResponse() func(string) *ResponseCode {
-	innerMap := map[string]*ResponseCode{
-		"SCRK01": &ResponseCode{
-			TxnStatus:       StatusApproved,
-			LogMessage:      "SUCCESS",
-			CustomerMessage: "SUCCESS",
-		},
-		"FCRK01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Device token provided could not be found",
-			CustomerMessage: "Device token provided could not be found",
-		},
-		"FCRK02": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Device token provided has already been used",
-			CustomerMessage: "Device token provided has already been used",
-		},
-		"EVAL01": &ResponseCode{
-			TxnStatus:  StatusFailed,
-			LogMessage: "Request is invalid",
-			CustomerMessage: `The request to Oxipay was invalid. 
-			You can try again with a different Payment Code. 
-			Please contact pit@oxipay.com.au for further support`,
-		},
-		"ESIG01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Signature mismatch error. Has the terminal changed, try removing the key for the device? ",
-			CustomerMessage: `Please contact pit@oxipay.com.au for further support`,
-		},
-		"EISE01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Server Error",
-			CustomerMessage: "Please contact pit@oxipay.com.au for further support",
-		},
-	}
-
-	return func(key string) *ResponseCode {
-		// check to make sure we know what the response is
-		ret := innerMap[key]
-
-		if ret == nil {
-			return innerMap[defaultResponseCode]
-		}
-		return ret
-	}
-}
-
-// ProcessAuthorisationResponses provides a guarded response type based on the response code from the Oxipay request
-func ProcessAuthorisationResponses() func(string) *ResponseCode {
-
-	innerMap := map[string]*ResponseCode{
-		"SPRA01": &ResponseCode{
-			TxnStatus:       StatusApproved,
-			LogMessage:      "APPROVED",
-			CustomerMessage: "APPROVED",
-		},
-		"FPRA01": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined due to internal risk assessment against the customer",
-			CustomerMessage: "Do not try again",
-		},
-		"FPRA02": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined due to insufficient funds for the deposit",
-			CustomerMessage: "Please call customer support",
-		},
-		"FPRA03": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Declined as communication to the bank is currently unavailable",
-			CustomerMessage: "Please try again shortly. Communication to the bank is unavailable",
-		},
-		"FPRA04": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined because the customer limit has been exceeded",
-			CustomerMessage: "Please contact Oxipay customer support",
-		},
-		"FPRA05": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined due to negative payment history for the customer",
-			CustomerMessage: "Please contact Oxipay customer support for more information",
-		},
-		"FPRA06": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined because the credit-card used for the deposit is expired",
-			CustomerMessage: "Declined because the credit-card used for the deposit is expired",
-		},
-		"FPRA07": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined because supplied POSTransactionRef has already been processed",
-			CustomerMessage: "We have seen this Transaction ID before, please try again",
-		},
-		"FPRA08": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined because the instalment amount was below the minimum threshold",
-			CustomerMessage: "Transaction below minimum",
-		},
-		"FPRA09": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Declined because purchase amount exceeded pre-approved amount",
-			CustomerMessage: "Please contact Oxipay customer support",
-		},
-		"FPRA21": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "The Payment Code was not found",
-			CustomerMessage: "This is not a valid Payment Code.",
-		},
-		"FPRA22": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "The Payment Code has already been used",
-			CustomerMessage: "The Payment Code has already been used",
-		},
-		"FPRA23": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "The Payment Code has expired",
-			CustomerMessage: "The Payment Code has expired",
-		},
-		"FPRA24": &ResponseCode{
-			TxnStatus:  StatusDeclined,
-			LogMessage: "The Payment Code has been cancelled",
-			CustomerMessage: `Payment Code has been cancelled. 
-			Please try again with a new Payment Code`,
-		},
-		"FPRA99": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "DECLINED by Oxipay Gateway",
-			CustomerMessage: "Transaction has been declined by the Oxipay Gateway",
-		},
-		"EVAL02": &ResponseCode{
-			TxnStatus:  StatusFailed,
-			LogMessage: "Request is invalid",
-			CustomerMessage: `The request to Oxipay was invalid. 
-			You can try again with a different Payment Code. 
-			Please contact pit@oxipay.com.au for further support`,
-		},
-		"ESIG01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Signature mismatch error. Has the terminal changed, try removing the key for the device? ",
-			CustomerMessage: `Please contact pit@oxipay.com.au for further support`,
-		},
-		"EISE01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Server Error",
-			CustomerMessage: `Please contact pit@oxipay.com.au for further support`,
-		},
-	}
-
-	return func(key string) *ResponseCode {
-		// check to make sure we know what the response is
-		ret := innerMap[key]
-
-		if ret == nil {
-			return innerMap[defaultResponseCode]
-		}
-		return ret
-	}
-}
-
-// ProcessSalesAdjustmentResponse provides a guarded response type based on the response code from the Oxipay request
-func ProcessSalesAdjustmentResponse() func(string) *ResponseCode {
-
-	innerMap := map[string]*ResponseCode{
-		"SPSA01": &ResponseCode{
-			TxnStatus:       StatusApproved,
-			LogMessage:      "APPROVED",
-			CustomerMessage: "APPROVED",
-		},
-		"FPSA01": &ResponseCode{
-			TxnStatus:       StatusDeclined,
-			LogMessage:      "Unable to find the specified POS transaction reference",
-			CustomerMessage: "Unable to find the specified POS transaction reference",
-		},
-		"FPSA02": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "This contract has already been completed",
-			CustomerMessage: "This contract has already been completed",
-		},
-		"FPSA03": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "This Oxipay contract has previously been cancelled and all payments collected have been refunded to the customer",
-			CustomerMessage: "This Oxipay contract has previously been cancelled and all payments collected have been refunded to the customer",
-		},
-		"FPSA04": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Sales adjustment cannot be processed for this amount",
-			CustomerMessage: "Sales adjustment cannot be processed for this amount",
-		},
-		"FPSA05": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Unable to process a sales adjustment for this contract. Please contact Merchant Services during business hours for further information",
-			CustomerMessage: "Unable to process a sales adjustment for this contract. Please contact Merchant Services during business hours for further information",
-		},
-		"FPSA06": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Sales adjustment cannot be processed. Please call Oxipay Collections",
-			CustomerMessage: "Sales adjustment cannot be processed. Please call Oxipay Collections",
-		},
-		"FPSA07": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Sales adjustment cannot be processed at this store",
-			CustomerMessage: "Sales adjustment cannot be processed at this store",
-		},
-		"FPSA08": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Sales adjustment cannot be processed for this transaction. Duplicate receipt number found.",
-			CustomerMessage: "Sales adjustment cannot be processed for this transaction. Duplicate receipt number found.",
-		},
-		"FPSA09": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Amount must be greater than 0.",
-			CustomerMessage: "Amount must be greater than 0.",
-		},
-		"EAUT01": &ResponseCode{
-			TxnStatus:  StatusFailed,
-			LogMessage: "Authentication to gateway error",
-			CustomerMessage: `The request to Oxipay was not what we were expecting. 
-			You can try again with a different Payment Code. 
-			Please contact pit@oxipay.com.au for further support`,
-		},
-		"EVAL01": &ResponseCode{
-			TxnStatus:  StatusFailed,
-			LogMessage: "Request is invalid",
-			CustomerMessage: `The request to Oxipay was what we were expecting. 
-			You can try again with a different Payment Code. 
-			Please contact pit@oxipay.com.au for further support`,
-		},
-		"ESIG01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Signature mismatch error. Has the terminal changed, try removing the key for the device? ",
-			CustomerMessage: `Please contact pit@oxipay.com.au for further support`,
-		},
-		"EISE01": &ResponseCode{
-			TxnStatus:       StatusFailed,
-			LogMessage:      "Server Error",
-			CustomerMessage: `Please contact pit@oxipay.com.au for further support`,
-		},
-	}
-
-	return func(key string) *ResponseCode {
-		// check to make sure we know what the response is
-		ret := innerMap[key]
-
-		if ret == nil {
-			return innerMap[defaultResponseCode]
-		}
-		return ret
-	}
-}
@@ -23,7 +23,7 @@ func TestProcessAuthorisationResponse(t *testing.T) {
 func TestGenerateSignature(t *testing.T) {
 
 	responsePayload := `{"x_key":"hEz3dnWwEWuo","x_status":"Success","x_code":"SCRK01","x_message":"Success","signature":"5385041e76753e1b6e7ac09d52c6363854f1df4e79a7aa01c44f2d4618063483","tracking_data":null}`
-	oxipayResponse := new(OxipayResponse)
+	oxipayResponse := new(Response)
 
 	err := json.Unmarshal([]byte(responsePayload), oxipayResponse)
 	if err != nil {
@@ -45,13 +45,39 @@ func TestGenerateSignature(t *testing.T) {
 func TestAuthenticate(t *testing.T) {
 
 	responsePayload := `{"x_key":"hEz3dnWwEWuo","x_status":"Success","x_code":"SCRK01","x_message":"Success","signature":"5385041e76753e1b6e7ac09d52c6363854f1df4e79a7aa01c44f2d4618063483","tracking_data":null}`
-	oxipayResponse := new(OxipayResponse)
+	oxipayResponse := new(Response)
 
 	err := json.Unmarshal([]byte(responsePayload), oxipayResponse)
 	if err != nil {
 		t.Error("Unable to unmarshall response")
 	}
-	if oxipayResponse.Authenticate("szUb4YwzQNXn") == false {
+	if valid, _ := oxipayResponse.Authenticate("szUb4YwzQNXn"); valid == false {
 		t.Error("Authenticate failed and should be true")
 	}
 }
+
+// TestGeneratePayload pins the plain text and signature of a payment request.
+// The fields are signed sorted by name, skipping those that are empty
+func TestGeneratePayload(t *testing.T) {
+	oxipayPayload := &AuthorisationPayload{
+		DeviceID:        "foobar",
+		MerchantID:      "3342342",
+		FinanceAmount:   "1000",
+		FirmwareVersion: "version 4.0",
+		OperatorID:      "John",
+		PurchaseAmount:  "1000",
+		PreApprovalCode: "1234",
+	}
+
+	plainText := GeneratePlainTextSignature(oxipayPayload)
+	expectedPlainText := "x_device_idfoobarx_finance_amount1000x_firmware_versionversion 4.0x_merchant_id3342342x_operator_idJohnx_pre_approval_code1234x_purchase_amount1000"
+	if plainText != expectedPlainText {
+		t.Errorf("Expected %s, got %s", expectedPlainText, plainText)
+	}
+
+	signature := SignMessage(plainText, "TEST")
+	expectedSignature := "db48103e40011d084b48f3772b8448ed77ac8597b78c97eb9574e05f67973892"
+	if signature != expectedSignature {
+		t.Errorf("Expected %s, got %s", expectedSignature, signature)
+	}
+}
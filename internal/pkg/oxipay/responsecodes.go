@@ -0,0 +1,376 @@
+package oxipay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// ResponseCatalogueVersion is the newest catalogue file format we understand
+const ResponseCatalogueVersion = 1
+
+// ResponseCatalogue maps the codes returned by Oxipay to how we treat them.
+// The built in catalogue can be extended or overridden with a JSON file so
+// that new codes can be handled without a release, e.g
+//
+//	{
+//	    "version": 1,
+//	    "authorisation": {
+//	        "FPRA10": {
+//	            "txn_status": "DECLINED",
+//	            "log_message": "Declined because ...",
+//	            "customer_message": "Please contact customer support",
+//	            "retryable": false
+//	        }
+//	    }
+//	}
+//
+// Customer messages may use the {product}, {support_email} and
+// {support_phone} placeholders, which are filled in from the branding profile
+// of the merchant. A code in the file is shown with its customer message in
+// every locale. Retryable codes let the cashier try again rather than
+// declining the sale in Vend.
+type ResponseCatalogue struct {
+	Version       int                      `json:"version"`
+	Registration  map[string]*ResponseCode `json:"registration"`
+	Authorisation map[string]*ResponseCode `json:"authorisation"`
+	Adjustment    map[string]*ResponseCode `json:"adjustment"`
+}
+
+var defaultCatalogue = DefaultResponseCatalogue()
+
+// DefaultResponseCatalogue returns the response codes built into the proxy
+func DefaultResponseCatalogue() *ResponseCatalogue {
+	return &ResponseCatalogue{
+		Version:       ResponseCatalogueVersion,
+		Registration:  registrationCodes(),
+		Authorisation: authorisationCodes(),
+		Adjustment:    adjustmentCodes(),
+	}
+}
+
+// LoadResponseCatalogue reads a catalogue file and merges it over the built
+// in response codes
+func LoadResponseCatalogue(file string) (*ResponseCatalogue, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := new(ResponseCatalogue)
+	if err := json.Unmarshal(contents, overrides); err != nil {
+		return nil, fmt.Errorf("unable to parse response codes in %s: %s", file, err)
+	}
+
+	if overrides.Version < 1 || overrides.Version > ResponseCatalogueVersion {
+		return nil, fmt.Errorf("%s has version %d, we only understand versions 1 to %d", file, overrides.Version, ResponseCatalogueVersion)
+	}
+
+	catalogue := DefaultResponseCatalogue()
+	for _, responseType := range []ResponseType{Registration, Authorisation, Adjustment} {
+		for code, responseCode := range overrides.codes(responseType) {
+			if err := responseCode.validate(); err != nil {
+				return nil, fmt.Errorf("%s %s in %s: %s", responseType, code, file, err)
+			}
+			responseCode.Custom = true
+			catalogue.codes(responseType)[code] = responseCode
+		}
+	}
+	return catalogue, nil
+}
+
+func (c *ResponseCatalogue) codes(responseType ResponseType) map[string]*ResponseCode {
+	var codes *map[string]*ResponseCode
+	switch responseType {
+	case Registration:
+		codes = &c.Registration
+	case Authorisation:
+		codes = &c.Authorisation
+	case Adjustment:
+		codes = &c.Adjustment
+	default:
+		return nil
+	}
+
+	if *codes == nil {
+		*codes = make(map[string]*ResponseCode)
+	}
+	return *codes
+}
+
+// Lookup returns how to treat the code. Codes that aren't in the catalogue are
+// treated as a server error but are flagged as Unknown so they can be logged
+func (c *ResponseCatalogue) Lookup(responseType ResponseType, code string) *ResponseCode {
+	codes := c.codes(responseType)
+	if ret, ok := codes[code]; ok {
+		return ret
+	}
+
+	ret := &ResponseCode{
+		TxnStatus:  StatusFailed,
+		LogMessage: "Server Error",
+		Unknown:    true,
+	}
+	if fallback, ok := codes[DefaultResponseCode]; ok {
+		*ret = *fallback
+		ret.Unknown = true
+	}
+	return ret
+}
+
+func (r *ResponseCode) validate() error {
+	if r == nil {
+		return fmt.Errorf("is empty")
+	}
+
+	switch r.TxnStatus {
+	case StatusApproved, StatusDeclined, StatusFailed:
+	default:
+		return fmt.Errorf("txn_status %q must be one of %s, %s or %s", r.TxnStatus, StatusApproved, StatusDeclined, StatusFailed)
+	}
+
+	if r.CustomerMessage == "" {
+		return fmt.Errorf("customer_message is required")
+	}
+	return nil
+}
+
+// ProcessRegistrationResponse provides a function to map an Oxipay CreateKey response to something we can pass back to the client
+func ProcessRegistrationResponse() func(string) *ResponseCode {
+	return func(key string) *ResponseCode {
+		return defaultCatalogue.Lookup(Registration, key)
+	}
+}
+
+// ProcessAuthorisationResponses provides a guarded response type based on the response code from the Oxipay request
+func ProcessAuthorisationResponses() func(string) *ResponseCode {
+	return func(key string) *ResponseCode {
+		return defaultCatalogue.Lookup(Authorisation, key)
+	}
+}
+
+// ProcessSalesAdjustmentResponse provides a guarded response type based on the response code from the Oxipay request
+func ProcessSalesAdjustmentResponse() func(string) *ResponseCode {
+	return func(key string) *ResponseCode {
+		return defaultCatalogue.Lookup(Adjustment, key)
+	}
+}
+
+func registrationCodes() map[string]*ResponseCode {
+	return map[string]*ResponseCode{
+		"SCRK01": {
+			TxnStatus:       StatusApproved,
+			LogMessage:      "SUCCESS",
+			CustomerMessage: "SUCCESS",
+		},
+		"FCRK01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Device token provided could not be found",
+			CustomerMessage: "Device token provided could not be found",
+		},
+		"FCRK02": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Device token provided has already been used",
+			CustomerMessage: "Device token provided has already been used",
+		},
+		"EVAL01": {
+			TxnStatus:  StatusFailed,
+			LogMessage: "Request is invalid",
+			CustomerMessage: `The request to {product} was invalid. 
+			You can try again with a different Payment Code. 
+			Please contact {support_email} for further support`,
+		},
+		"ESIG01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Signature mismatch error. Has the terminal changed, try removing the key for the device? ",
+			CustomerMessage: `Please contact {support_email} for further support`,
+		},
+		"EISE01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Server Error",
+			CustomerMessage: "Please contact {support_email} for further support",
+			Retryable:       true,
+		},
+	}
+}
+
+func authorisationCodes() map[string]*ResponseCode {
+	return map[string]*ResponseCode{
+		"SPRA01": {
+			TxnStatus:       StatusApproved,
+			LogMessage:      "APPROVED",
+			CustomerMessage: "APPROVED",
+		},
+		"FPRA01": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined due to internal risk assessment against the customer",
+			CustomerMessage: "Do not try again",
+		},
+		"FPRA02": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined due to insufficient funds for the deposit",
+			CustomerMessage: "Please call customer support",
+		},
+		"FPRA03": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Declined as communication to the bank is currently unavailable",
+			CustomerMessage: "Please try again shortly. Communication to the bank is unavailable",
+			Retryable:       true,
+		},
+		"FPRA04": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined because the customer limit has been exceeded",
+			CustomerMessage: "Please contact {product} customer support",
+		},
+		"FPRA05": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined due to negative payment history for the customer",
+			CustomerMessage: "Please contact {product} customer support for more information",
+		},
+		"FPRA06": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined because the credit-card used for the deposit is expired",
+			CustomerMessage: "Declined because the credit-card used for the deposit is expired",
+		},
+		"FPRA07": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined because supplied POSTransactionRef has already been processed",
+			CustomerMessage: "We have seen this Transaction ID before, please try again",
+			Retryable:       true,
+		},
+		"FPRA08": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined because the instalment amount was below the minimum threshold",
+			CustomerMessage: "Transaction below minimum",
+		},
+		"FPRA09": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Declined because purchase amount exceeded pre-approved amount",
+			CustomerMessage: "Please contact {product} customer support",
+		},
+		"FPRA21": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "The Payment Code was not found",
+			CustomerMessage: "This is not a valid Payment Code.",
+		},
+		"FPRA22": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "The Payment Code has already been used",
+			CustomerMessage: "The Payment Code has already been used",
+		},
+		"FPRA23": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "The Payment Code has expired",
+			CustomerMessage: "The Payment Code has expired",
+		},
+		"FPRA24": {
+			TxnStatus:  StatusDeclined,
+			LogMessage: "The Payment Code has been cancelled",
+			CustomerMessage: `Payment Code has been cancelled. 
+			Please try again with a new Payment Code`,
+		},
+		"FPRA99": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "DECLINED by Oxipay Gateway",
+			CustomerMessage: "Transaction has been declined by the {product} Gateway",
+		},
+		"EVAL02": {
+			TxnStatus:  StatusFailed,
+			LogMessage: "Request is invalid",
+			CustomerMessage: `The request to {product} was invalid. 
+			You can try again with a different Payment Code. 
+			Please contact {support_email} for further support`,
+		},
+		"ESIG01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Signature mismatch error. Has the terminal changed, try removing the key for the device? ",
+			CustomerMessage: `Please contact {support_email} for further support`,
+		},
+		"EISE01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Server Error",
+			CustomerMessage: `Please contact {support_email} for further support`,
+			Retryable:       true,
+		},
+	}
+}
+
+func adjustmentCodes() map[string]*ResponseCode {
+	return map[string]*ResponseCode{
+		"SPSA01": {
+			TxnStatus:       StatusApproved,
+			LogMessage:      "APPROVED",
+			CustomerMessage: "APPROVED",
+		},
+		"FPSA01": {
+			TxnStatus:       StatusDeclined,
+			LogMessage:      "Unable to find the specified POS transaction reference",
+			CustomerMessage: "Unable to find the specified POS transaction reference",
+		},
+		"FPSA02": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "This contract has already been completed",
+			CustomerMessage: "This contract has already been completed",
+		},
+		"FPSA03": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "This Oxipay contract has previously been cancelled and all payments collected have been refunded to the customer",
+			CustomerMessage: "This {product} contract has previously been cancelled and all payments collected have been refunded to the customer",
+		},
+		"FPSA04": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Sales adjustment cannot be processed for this amount",
+			CustomerMessage: "Sales adjustment cannot be processed for this amount",
+		},
+		"FPSA05": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Unable to process a sales adjustment for this contract. Please contact Merchant Services during business hours for further information",
+			CustomerMessage: "Unable to process a sales adjustment for this contract. Please contact Merchant Services during business hours for further information",
+		},
+		"FPSA06": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Sales adjustment cannot be processed. Please call Oxipay Collections",
+			CustomerMessage: "Sales adjustment cannot be processed. Please call {product} Collections",
+		},
+		"FPSA07": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Sales adjustment cannot be processed at this store",
+			CustomerMessage: "Sales adjustment cannot be processed at this store",
+		},
+		"FPSA08": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Sales adjustment cannot be processed for this transaction. Duplicate receipt number found.",
+			CustomerMessage: "Sales adjustment cannot be processed for this transaction. Duplicate receipt number found.",
+		},
+		"FPSA09": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Amount must be greater than 0.",
+			CustomerMessage: "Amount must be greater than 0.",
+		},
+		"EAUT01": {
+			TxnStatus:  StatusFailed,
+			LogMessage: "Authentication to gateway error",
+			CustomerMessage: `The request to {product} was not what we were expecting. 
+			You can try again with a different Payment Code. 
+			Please contact {support_email} for further support`,
+		},
+		"EVAL01": {
+			TxnStatus:  StatusFailed,
+			LogMessage: "Request is invalid",
+			CustomerMessage: `The request to {product} was not what we were expecting. 
+			You can try again with a different Payment Code. 
+			Please contact {support_email} for further support`,
+		},
+		"ESIG01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Signature mismatch error. Has the terminal changed, try removing the key for the device? ",
+			CustomerMessage: `Please contact {support_email} for further support`,
+		},
+		"EISE01": {
+			TxnStatus:       StatusFailed,
+			LogMessage:      "Server Error",
+			CustomerMessage: `Please contact {support_email} for further support`,
+			Retryable:       true,
+		},
+	}
+}
@@ -0,0 +1,97 @@
+package oxipay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCatalogue(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "responsecodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "responsecodes.json")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLookupUnknownCode(t *testing.T) {
+	x := DefaultResponseCatalogue().Lookup(Authorisation, "FPRA42")
+	if !x.Unknown {
+		t.Error("expected FPRA42 to be flagged as unknown")
+	}
+
+	if x.TxnStatus != StatusFailed {
+		t.Errorf("unexpected response: got %v want %v", x.TxnStatus, StatusFailed)
+	}
+
+	y := DefaultResponseCatalogue().Lookup(Authorisation, DefaultResponseCode)
+	if y.Unknown {
+		t.Errorf("expected %s to be known", DefaultResponseCode)
+	}
+}
+
+func TestLoadResponseCatalogue(t *testing.T) {
+	file := writeCatalogue(t, `{
+		"version": 1,
+		"authorisation": {
+			"FPRA10": {
+				"txn_status": "DECLINED",
+				"log_message": "Declined for a brand new reason",
+				"customer_message": "Please contact customer support",
+				"retryable": false
+			},
+			"FPRA03": {
+				"txn_status": "FAILED",
+				"log_message": "Bank unavailable",
+				"customer_message": "Try again in a minute",
+				"retryable": true
+			}
+		}
+	}`)
+
+	catalogue, err := LoadResponseCatalogue(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := catalogue.Lookup(Authorisation, "FPRA10")
+	if added.Unknown || added.TxnStatus != StatusDeclined {
+		t.Errorf("expected FPRA10 to be added, got %+v", added)
+	}
+
+	overridden := catalogue.Lookup(Authorisation, "FPRA03")
+	if overridden.CustomerMessage != "Try again in a minute" || !overridden.Custom {
+		t.Errorf("expected FPRA03 to be overridden, got %+v", overridden)
+	}
+
+	if builtIn := catalogue.Lookup(Authorisation, "SPRA01"); builtIn.TxnStatus != StatusApproved || builtIn.Custom {
+		t.Error("expected the built in codes to be kept")
+	}
+
+	if DefaultResponseCatalogue().Lookup(Authorisation, "FPRA10").Unknown == false {
+		t.Error("loading a catalogue should not change the built in codes")
+	}
+}
+
+func TestLoadResponseCatalogueRejectsBadFiles(t *testing.T) {
+	tests := map[string]string{
+		"future version":  `{"version": 99}`,
+		"missing version": `{"authorisation": {}}`,
+		"bad status":      `{"version": 1, "adjustment": {"FPSA10": {"txn_status": "MAYBE", "customer_message": "?"}}}`,
+		"no message":      `{"version": 1, "adjustment": {"FPSA10": {"txn_status": "FAILED"}}}`,
+		"not json":        `version: 1`,
+	}
+
+	for name, contents := range tests {
+		if _, err := LoadResponseCatalogue(writeCatalogue(t, contents)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Package reconcile matches a humm/Oxipay settlement file against the
+// transactions recorded by the proxy
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+)
+
+// The outcome of reconciling a purchase
+const (
+	Matched             = "matched"
+	MissingInProxy      = "missing_in_proxy"
+	MissingInSettlement = "missing_in_settlement"
+	AmountMismatch      = "amount_mismatch"
+)
+
+// ApprovedStatus is the transaction status that we expect to be settled
+const ApprovedStatus = "ACCEPTED"
+
+// SettlementLag is how many days after a payment it can be settled e.g a
+// payment late on a Friday settled on the Monday
+const SettlementLag = 3
+
+// SettlementRow is a single line of the settlement file
+type SettlementRow struct {
+	PurchaseNumber string
+	Amount         int64 // cents, negative for refunds
+	Date           time.Time
+	MerchantID     string
+}
+
+// Row is the reconciled result for the payments or refunds of a purchase
+type Row struct {
+	Status           string   `json:"status"`
+	PurchaseNumber   string   `json:"purchase_number"`
+	Type             string   `json:"type"`
+	MerchantID       string   `json:"merchant_id"`
+	SettlementAmount int64    `json:"settlement_amount"`
+	ProxyAmount      int64    `json:"proxy_amount"`
+	SettlementDate   string   `json:"settlement_date,omitempty"` // YYYY-MM-DD
+	TransactionIDs   []string `json:"transaction_ids,omitempty"`
+	VendSaleIDs      []string `json:"vend_sale_ids,omitempty"`
+}
+
+// Summary counts the rows with each status
+type Summary map[string]int
+
+// Report is the result of a reconciliation
+type Report struct {
+	Summary Summary `json:"summary"`
+	Rows    []Row   `json:"rows"`
+}
+
+// the columns we look for in the settlement file, the first match wins. They
+// are checked in this order so a file missing more than one always gets the
+// same error
+var columns = []struct {
+	field string
+	names []string
+}{
+	{"purchase", []string{"purchase number", "purchase_number", "purchaseno", "purchase no", "contract number"}},
+	{"amount", []string{"amount", "purchase amount", "transaction amount"}},
+	{"date", []string{"date", "settlement date", "transaction date"}},
+	{"merchant", []string{"merchant", "merchant id", "merchant_id", "merchant number"}},
+}
+
+var dateFormats = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"02/01/2006",
+	"02/01/2006 15:04",
+	"02/01/2006 15:04:05",
+}
+
+// ReadSettlement parses a settlement CSV. The file must have a header row
+// containing purchase number, amount, date and merchant columns, in any order.
+// Amounts are in dollars
+func ReadSettlement(r io.Reader) ([]SettlementRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the settlement header: %s", err)
+	}
+
+	index := make(map[string]int)
+	for _, column := range columns {
+		for i, name := range header {
+			if contains(column.names, strings.ToLower(strings.TrimSpace(name))) {
+				index[column.field] = i
+				break
+			}
+		}
+		if _, ok := index[column.field]; !ok {
+			return nil, fmt.Errorf("the settlement file has no %s column, expected one of %s", column.field, strings.Join(column.names, ", "))
+		}
+	}
+
+	var rows []SettlementRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		amount, err := ParseAmount(record[index["amount"]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		date, err := parseDate(record[index["date"]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		rows = append(rows, SettlementRow{
+			PurchaseNumber: strings.TrimSpace(record[index["purchase"]]),
+			Amount:         amount,
+			Date:           date,
+			MerchantID:     strings.TrimSpace(record[index["merchant"]]),
+		})
+	}
+
+	return rows, nil
+}
+
+// ParseAmount converts a dollar amount e.g $1,234.50 or -69.9 to cents
+// without going through a float
+func ParseAmount(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	s = strings.NewReplacer("$", "", ",", "", " ", "").Replace(s)
+
+	if s == "" {
+		return 0, errors.New("the amount is empty")
+	}
+
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	dollars, cents := s, "00"
+	if i := strings.Index(s, "."); i >= 0 {
+		dollars, cents = s[:i], s[i+1:]
+		switch len(cents) {
+		case 0:
+			cents = "00"
+		case 1:
+			cents += "0"
+		case 2:
+		default:
+			return 0, fmt.Errorf("%q has more than two decimal places", value)
+		}
+	}
+	if dollars == "" {
+		dollars = "0"
+	}
+	// ParseInt would take a sign, so "5.-1" or "--5" would parse
+	if !digits(dollars) || !digits(cents) {
+		return 0, fmt.Errorf("%q is not an amount", value)
+	}
+
+	d, err := strconv.ParseInt(dollars, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an amount", value)
+	}
+	c, err := strconv.ParseInt(cents, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an amount", value)
+	}
+
+	amount := d*100 + c
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, format := range dateFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date, use YYYY-MM-DD", value)
+}
+
+// DateRange returns the first and last day covered by the settlement, with
+// the end being exclusive
+func DateRange(rows []SettlementRow) (from time.Time, to time.Time, err error) {
+	if len(rows) == 0 {
+		return from, to, errors.New("the settlement file is empty")
+	}
+
+	from, to = rows[0].Date, rows[0].Date
+	for _, row := range rows[1:] {
+		if row.Date.Before(from) {
+			from = row.Date
+		}
+		if row.Date.After(to) {
+			to = row.Date
+		}
+	}
+
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, to.Location()).AddDate(0, 0, 1)
+	return from, to, nil
+}
+
+// ForMerchant returns the rows for the merchant, or every row when the
+// merchant is empty
+func ForMerchant(rows []SettlementRow, merchantID string) []SettlementRow {
+	if merchantID == "" {
+		return rows
+	}
+
+	var ret []SettlementRow
+	for _, row := range rows {
+		if row.MerchantID == merchantID {
+			ret = append(ret, row)
+		}
+	}
+	return ret
+}
+
+// Settled returns the transactions to match against a settlement covering
+// from onwards. The transactions should be looked up from SettlementLag days
+// before from, as payments are settled after they are made. Those made before
+// from are only kept when the settlement has their purchase, otherwise they
+// belong to an earlier settlement
+func Settled(settlement []SettlementRow, txns []*transaction.Transaction, from time.Time) []*transaction.Transaction {
+	purchases := make(map[string]bool, len(settlement))
+	for _, s := range settlement {
+		purchases[s.PurchaseNumber] = true
+	}
+
+	var ret []*transaction.Transaction
+	for _, txn := range txns {
+		if !txn.Created.Before(from) || (txn.PurchaseNumber != "" && purchases[txn.PurchaseNumber]) {
+			ret = append(ret, txn)
+		}
+	}
+	return ret
+}
+
+type key struct {
+	purchaseNumber string
+	kind           string
+}
+
+func kind(amount int64) string {
+	if amount < 0 {
+		return transaction.TypeRefund
+	}
+	return transaction.TypePayment
+}
+
+// Reconcile matches the settlement against the approved transactions. The
+// payments and refunds for a purchase are each totalled on both sides before
+// they are compared, as a purchase can be partially refunded more than once
+func Reconcile(settlement []SettlementRow, txns []*transaction.Transaction) Report {
+	rows := make(map[key]*Row)
+	var order []key
+
+	row := func(k key, merchantID string) *Row {
+		r, ok := rows[k]
+		if !ok {
+			r = &Row{PurchaseNumber: k.purchaseNumber, Type: k.kind, MerchantID: merchantID}
+			rows[k] = r
+			order = append(order, k)
+		}
+		return r
+	}
+
+	settled := make(map[key]time.Time)
+	for _, s := range settlement {
+		k := key{s.PurchaseNumber, kind(s.Amount)}
+		r := row(k, s.MerchantID)
+		r.SettlementAmount += s.Amount
+		if first, ok := settled[k]; !ok || s.Date.Before(first) {
+			settled[k] = s.Date
+			r.SettlementDate = s.Date.Format("2006-01-02")
+		}
+	}
+
+	recorded := make(map[key]bool)
+	for _, txn := range txns {
+		if txn.Status != ApprovedStatus {
+			continue
+		}
+
+		purchaseNumber := txn.PurchaseNumber
+		if purchaseNumber == "" {
+			// we can't match it, but it still needs to be looked at
+			purchaseNumber = txn.ID
+		}
+
+		k := key{purchaseNumber, kind(txn.Amount)}
+		r := row(k, txn.MerchantID)
+		r.ProxyAmount += txn.Amount
+		r.TransactionIDs = append(r.TransactionIDs, txn.ID)
+		if txn.VendSaleID != "" {
+			r.VendSaleIDs = append(r.VendSaleIDs, txn.VendSaleID)
+		}
+		recorded[k] = true
+	}
+
+	report := Report{Summary: Summary{
+		Matched:             0,
+		MissingInProxy:      0,
+		MissingInSettlement: 0,
+		AmountMismatch:      0,
+	}}
+
+	for _, k := range order {
+		r := rows[k]
+		switch {
+		case !recorded[k]:
+			r.Status = MissingInProxy
+		case settled[k].IsZero():
+			r.Status = MissingInSettlement
+		case r.SettlementAmount != r.ProxyAmount:
+			r.Status = AmountMismatch
+		default:
+			r.Status = Matched
+		}
+		report.Summary[r.Status]++
+		report.Rows = append(report.Rows, *r)
+	}
+
+	// the problems first so they aren't lost in a long report
+	sort.SliceStable(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Status != Matched && report.Rows[j].Status == Matched
+	})
+
+	return report
+}
+
+// WriteCSV writes the report as CSV with amounts in dollars
+func WriteCSV(w io.Writer, report Report) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"status",
+		"purchase_number",
+		"type",
+		"merchant_id",
+		"settlement_amount",
+		"proxy_amount",
+		"settlement_date",
+		"transaction_ids",
+		"vend_sale_ids",
+	})
+
+	for _, r := range report.Rows {
+		out.Write([]string{
+			r.Status,
+			r.PurchaseNumber,
+			r.Type,
+			r.MerchantID,
+			transaction.FormatAmount(r.SettlementAmount),
+			transaction.FormatAmount(r.ProxyAmount),
+			r.SettlementDate,
+			strings.Join(r.TransactionIDs, " "),
+			strings.Join(r.VendSaleIDs, " "),
+		})
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// WriteJSON writes the report as JSON with amounts in cents
+func WriteJSON(w io.Writer, report Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// digits is true when s is only the digits 0-9
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
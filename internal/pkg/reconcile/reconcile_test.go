@@ -0,0 +1,197 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+)
+
+const settlementCSV = `Date,Merchant ID,Purchase Number,Amount
+2018-11-05,30188105,P100,44.00
+2018-11-05,30188105,P101,"$1,200.50"
+2018-11-06,30188105,P102,10.00
+2018-11-06,30188105,P100,-4.00
+2018-11-06,30188105,P999,5.00
+`
+
+func TestParseAmount(t *testing.T) {
+	tests := map[string]int64{
+		"44.00":     4400,
+		"44":        4400,
+		"-69.9":     -6990,
+		"$1,234.56": 123456,
+		" 0.05 ":    5,
+		"-$0.50":    -50,
+		".5":        50,
+	}
+
+	for value, expected := range tests {
+		got, err := ParseAmount(value)
+		if err != nil {
+			t.Errorf("%q: %s", value, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("%q: expected %d, got %d", value, expected, got)
+		}
+	}
+
+	for _, value := range []string{"abc", "1.234", "", "5.-1", "5.+1", "5.a", "--5", "+5", "-+5"} {
+		if _, err := ParseAmount(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestReadSettlement(t *testing.T) {
+	rows, err := ReadSettlement(strings.NewReader(settlementCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 5 {
+		t.Fatalf("expected 5 rows, got %d", len(rows))
+	}
+
+	if rows[1].PurchaseNumber != "P101" || rows[1].Amount != 120050 || rows[1].MerchantID != "30188105" {
+		t.Errorf("unexpected row %+v", rows[1])
+	}
+
+	from, to, err := DateRange(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Format("2006-01-02") != "2018-11-05" || to.Format("2006-01-02") != "2018-11-07" {
+		t.Errorf("unexpected date range %s to %s", from, to)
+	}
+}
+
+func TestReadSettlementMissingColumn(t *testing.T) {
+	_, err := ReadSettlement(strings.NewReader("Date,Amount\n2018-11-05,44.00\n"))
+	if err == nil {
+		t.Error("expected an error for a file without a purchase number")
+	}
+
+	// the purchase number is always reported first, whichever columns are missing
+	for i := 0; i < 10; i++ {
+		_, err := ReadSettlement(strings.NewReader("Reference\nP100\n"))
+		if err == nil || !strings.Contains(err.Error(), "no purchase column") {
+			t.Fatalf("expected the missing purchase column, got %v", err)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	settlement, err := ReadSettlement(strings.NewReader(settlementCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txns := []*transaction.Transaction{
+		{ID: "t1", PurchaseNumber: "P100", Amount: 4400, Status: "ACCEPTED", VendSaleID: "sale-1"},
+		{ID: "t2", PurchaseNumber: "P100", Amount: -400, Status: "ACCEPTED"},
+		{ID: "t3", PurchaseNumber: "P101", Amount: 120000, Status: "ACCEPTED"},
+		{ID: "t4", PurchaseNumber: "P103", Amount: 2500, Status: "ACCEPTED"},
+		{ID: "t5", PurchaseNumber: "", Amount: 999, Status: "DECLINED"},
+		{ID: "t6", PurchaseNumber: "P102", Amount: 1000, Status: "ACCEPTED"},
+	}
+
+	report := Reconcile(settlement, txns)
+
+	expected := Summary{
+		Matched:             3, // P100 payment, P100 refund and P102
+		AmountMismatch:      1, // P101
+		MissingInProxy:      1, // P999
+		MissingInSettlement: 1, // P103
+	}
+	for status, count := range expected {
+		if report.Summary[status] != count {
+			t.Errorf("expected %d %s, got %d", count, status, report.Summary[status])
+		}
+	}
+
+	if report.Rows[0].Status == Matched {
+		t.Error("expected the problems to be listed first")
+	}
+
+	for _, row := range report.Rows {
+		if row.PurchaseNumber == "P101" && (row.SettlementAmount != 120050 || row.ProxyAmount != 120000) {
+			t.Errorf("unexpected amounts for P101: %+v", row)
+		}
+	}
+}
+
+func TestForMerchant(t *testing.T) {
+	rows := []SettlementRow{
+		{PurchaseNumber: "P100", MerchantID: "30188105"},
+		{PurchaseNumber: "P200", MerchantID: "30188106"},
+	}
+
+	if got := ForMerchant(rows, ""); len(got) != 2 {
+		t.Errorf("expected every row without a merchant, got %v", got)
+	}
+
+	if got := ForMerchant(rows, "30188106"); len(got) != 1 || got[0].PurchaseNumber != "P200" {
+		t.Errorf("expected only the merchant's rows, got %v", got)
+	}
+}
+
+func TestSettled(t *testing.T) {
+	from := time.Date(2018, 11, 5, 0, 0, 0, 0, time.Local)
+	settlement := []SettlementRow{
+		{PurchaseNumber: "P100", Amount: 4400, Date: from},
+	}
+
+	txns := []*transaction.Transaction{
+		// made late the day before and settled on the first day
+		{ID: "t1", PurchaseNumber: "P100", Amount: 4400, Status: "ACCEPTED", Created: from.Add(-10 * time.Minute)},
+		// settled in the previous file
+		{ID: "t2", PurchaseNumber: "P099", Amount: 1000, Status: "ACCEPTED", Created: from.Add(-time.Hour)},
+		{ID: "t3", PurchaseNumber: "P101", Amount: 2500, Status: "ACCEPTED", Created: from.Add(time.Hour)},
+	}
+
+	report := Reconcile(settlement, Settled(settlement, txns, from))
+	if report.Summary[Matched] != 1 || report.Summary[MissingInProxy] != 0 || report.Summary[MissingInSettlement] != 1 {
+		t.Errorf("expected P100 to match and only P101 to be missing, got %+v", report.Rows)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	report := Report{
+		Summary: Summary{AmountMismatch: 1},
+		Rows: []Row{{
+			Status:           AmountMismatch,
+			PurchaseNumber:   "P101",
+			Type:             transaction.TypePayment,
+			SettlementAmount: 120050,
+			ProxyAmount:      120000,
+			SettlementDate:   "2018-11-05",
+			TransactionIDs:   []string{"t3"},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "amount_mismatch,P101,payment,,1200.50,1200.00,2018-11-05,t3,") {
+		t.Errorf("unexpected csv %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteJSON(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Rows[0].ProxyAmount != 120000 || decoded.Summary[AmountMismatch] != 1 {
+		t.Errorf("unexpected json %s", buf.String())
+	}
+}
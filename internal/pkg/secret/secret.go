@@ -0,0 +1,83 @@
+// Package secret encrypts values such as OAuth tokens before they are stored
+// in the database
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeyLength is the length of the key in bytes, which selects AES-256
+const KeyLength = 32
+
+// ErrDecrypt is returned when a value can't be decrypted, usually because it
+// was encrypted with a different key
+var ErrDecrypt = errors.New("secret: unable to decrypt value")
+
+// Box encrypts and decrypts values with AES-GCM
+type Box struct {
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a key given as 64 hex characters or base64
+func ParseKey(encoded string) ([]byte, error) {
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == KeyLength {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == KeyLength {
+		return key, nil
+	}
+	return nil, fmt.Errorf("secret: the key must be %d bytes encoded as hex or base64", KeyLength)
+}
+
+// NewBox returns a Box using the key
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeyLength {
+		return nil, fmt.Errorf("secret: the key must be %d bytes, got %d", KeyLength, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts the plain text, returning the nonce and cipher text encoded
+// as base64
+func (b *Box) Seal(plainText string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(plainText), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value from Seal
+func (b *Box) Open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < b.aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+
+	nonce, cipherText := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plainText, err := b.aead.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plainText), nil
+}
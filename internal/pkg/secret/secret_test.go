@@ -0,0 +1,69 @@
+package secret
+
+import (
+	"strings"
+	"testing"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestSealOpen(t *testing.T) {
+	key, err := ParseKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	box, err := NewBox(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.Seal("access-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sealed, "access-token") {
+		t.Error("expected the value to be encrypted")
+	}
+
+	again, _ := box.Seal("access-token")
+	if again == sealed {
+		t.Error("expected a new nonce each time")
+	}
+
+	opened, err := box.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != "access-token" {
+		t.Errorf("expected access-token, got %q", opened)
+	}
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	key, _ := ParseKey(testKey)
+	box, _ := NewBox(key)
+	sealed, _ := box.Seal("access-token")
+
+	other := make([]byte, KeyLength)
+	otherBox, _ := NewBox(other)
+
+	if _, err := otherBox.Open(sealed); err != ErrDecrypt {
+		t.Errorf("expected ErrDecrypt, got %v", err)
+	}
+
+	if _, err := box.Open("not base64!"); err != ErrDecrypt {
+		t.Errorf("expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if _, err := ParseKey("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="); err != nil {
+		t.Errorf("expected a base64 key to parse, got %s", err)
+	}
+
+	if _, err := ParseKey("too short"); err == nil {
+		t.Error("expected a short key to be rejected")
+	}
+}
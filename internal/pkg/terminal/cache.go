@@ -0,0 +1,102 @@
+package terminal
+
+import (
+	"sync"
+	"time"
+)
+
+// cache keeps registers in memory so each payment doesn't look the register
+// up in the database. Entries expire after the TTL so changes made by another
+// process, like the command line, are picked up
+type cache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	// generation counts the invalidations, so a register read from the
+	// database before one isn't cached after it
+	generation uint64
+}
+
+type cacheKey struct {
+	origin     string
+	registerID string
+}
+
+type cacheEntry struct {
+	register Register
+	expires  time.Time
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[cacheKey]cacheEntry),
+	}
+}
+
+// get returns a copy of the register so callers can't change the cached one
+func (c *cache) get(originDomain string, vendRegisterID string) (*Register, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{originDomain, vendRegisterID}
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	register := entry.register
+	return &register, true
+}
+
+// snapshot is taken before the register is read from the database, and is
+// given to put with the register
+func (c *cache) snapshot() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// put caches the register unless it was invalidated after the snapshot was
+// taken, in which case it may already be out of date
+func (c *cache) put(register *Register, snapshot uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != snapshot {
+		return
+	}
+
+	c.entries[cacheKey{register.Origin, register.VendRegisterID}] = cacheEntry{
+		register: *register,
+		expires:  c.now().Add(c.ttl),
+	}
+}
+
+// invalidate drops the register. An empty register ID drops every register
+// for the origin, which is needed when an outlet mapping changes
+func (c *cache) invalidate(originDomain string, vendRegisterID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if vendRegisterID != "" {
+		delete(c.entries, cacheKey{originDomain, vendRegisterID})
+		return
+	}
+
+	for key := range c.entries {
+		if key.origin == originDomain {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Date(2018, 11, 5, 14, 30, 0, 0, time.UTC)
+	c := newCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.put(&Register{Origin: "https://example.vendhq.com", VendRegisterID: "r1", FxlSellerID: "30188105"}, 0)
+	c.put(&Register{Origin: "https://example.vendhq.com", VendRegisterID: "r2", FxlSellerID: "30188105"}, 0)
+	c.put(&Register{Origin: "https://other.vendhq.com", VendRegisterID: "r1", FxlSellerID: "30188106"}, 0)
+
+	register, ok := c.get("https://example.vendhq.com", "r1")
+	if !ok || register.FxlSellerID != "30188105" {
+		t.Fatalf("expected the cached register, got %+v", register)
+	}
+
+	// callers can't change the cached register
+	register.FxlDeviceSigningKey = "changed"
+	if register, _ := c.get("https://example.vendhq.com", "r1"); register.FxlDeviceSigningKey != "" {
+		t.Error("expected the cached register to be a copy")
+	}
+
+	c.invalidate("https://example.vendhq.com", "r1")
+	if _, ok := c.get("https://example.vendhq.com", "r1"); ok {
+		t.Error("expected the register to be invalidated")
+	}
+
+	c.invalidate("https://example.vendhq.com", "")
+	if _, ok := c.get("https://example.vendhq.com", "r2"); ok {
+		t.Error("expected every register for the origin to be invalidated")
+	}
+	if _, ok := c.get("https://other.vendhq.com", "r1"); !ok {
+		t.Error("expected other origins to stay cached")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("https://other.vendhq.com", "r1"); ok {
+		t.Error("expected the register to expire")
+	}
+}
+
+func TestCacheSkipsInvalidatedReads(t *testing.T) {
+	c := newCache(time.Minute)
+
+	// the register is read from the database, then unpaired before it is cached
+	snapshot := c.snapshot()
+	c.invalidate("https://example.vendhq.com", "r1")
+	c.put(&Register{Origin: "https://example.vendhq.com", VendRegisterID: "r1"}, snapshot)
+	if _, ok := c.get("https://example.vendhq.com", "r1"); ok {
+		t.Error("expected the stale register not to be cached")
+	}
+
+	c.put(&Register{Origin: "https://example.vendhq.com", VendRegisterID: "r1"}, c.snapshot())
+	if _, ok := c.get("https://example.vendhq.com", "r1"); !ok {
+		t.Error("expected the register to be cached")
+	}
+}
@@ -0,0 +1,101 @@
+package terminal
+
+import (
+	"database/sql"
+)
+
+// Outlet maps a Vend outlet to the Oxipay merchant its registers take payments
+// with, for retailers with a merchant ID per store
+type Outlet struct {
+	Origin       string
+	VendOutletID string
+	FxlSellerID  string
+}
+
+// SaveOutlet maps the outlet to the merchant, replacing any existing mapping
+func (t Terminal) SaveOutlet(user string, outlet *Outlet) error {
+	query := `INSERT INTO
+			oxipay_vend_outlet
+			(
+				origin_domain,
+				vend_outlet_id,
+				fxl_seller_id,
+				created_by
+			) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				fxl_seller_id = VALUES(fxl_seller_id),
+				modified_date = NOW(),
+				modified_by = VALUES(created_by)`
+
+	_, err := t.Db.Exec(query, outlet.Origin, outlet.VendOutletID, outlet.FxlSellerID, user)
+
+	// the outlet decides which pairing its registers use
+	t.invalidate(outlet.Origin, "")
+	return err
+}
+
+// OutletMerchant returns the merchant the outlet is mapped to, or an empty
+// string if it isn't mapped
+func (t Terminal) OutletMerchant(originDomain string, vendOutletID string) (string, error) {
+	query := `SELECT
+				fxl_seller_id
+			FROM
+				oxipay_vend_outlet
+			WHERE
+				origin_domain = ?
+			AND
+				vend_outlet_id = ?`
+
+	var merchantID string
+	err := t.Db.QueryRow(query, originDomain, vendOutletID).Scan(&merchantID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return merchantID, err
+}
+
+// ListOutlets returns the outlet mappings for the origin domain, or every
+// mapping if the origin is empty
+func (t Terminal) ListOutlets(originDomain string) ([]*Outlet, error) {
+	query := `SELECT
+				origin_domain,
+				vend_outlet_id,
+				fxl_seller_id
+			FROM
+				oxipay_vend_outlet
+			WHERE
+				(? = '' OR origin_domain = ?)
+			ORDER BY
+				origin_domain, vend_outlet_id`
+
+	rows, err := t.Db.Query(query, originDomain, originDomain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outlets []*Outlet
+	for rows.Next() {
+		outlet := new(Outlet)
+		if err := rows.Scan(&outlet.Origin, &outlet.VendOutletID, &outlet.FxlSellerID); err != nil {
+			return nil, err
+		}
+		outlets = append(outlets, outlet)
+	}
+
+	return outlets, rows.Err()
+}
+
+// DeleteOutlet removes the mapping for the outlet
+func (t Terminal) DeleteOutlet(originDomain string, vendOutletID string) error {
+	query := `DELETE FROM
+				oxipay_vend_outlet
+			WHERE
+				origin_domain = ?
+			AND
+				vend_outlet_id = ?`
+
+	_, err := t.Db.Exec(query, originDomain, vendOutletID)
+	t.invalidate(originDomain, "")
+	return err
+}
@@ -3,8 +3,19 @@ package terminal
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
+// ErrNotFound is returned when the register hasn't been paired, or has been
+// unpaired
+var ErrNotFound = errors.New("Unable to find a matching terminal")
+
+// ErrAmbiguous is returned when a register is paired with more than one
+// merchant and its outlet doesn't say which to use
+var ErrAmbiguous = errors.New("the register is paired with more than one merchant")
+
 // Terminal terminal mapping
 type Register struct {
 	FxlRegisterID       string // Oxipay registerid
@@ -12,11 +23,16 @@ type Register struct {
 	FxlDeviceSigningKey string
 	Origin              string
 	VendRegisterID      string
+	VendOutletID        string // the Vend outlet of the register when it was paired, if known
+	Locale              string // language used at the register, empty to use the browser's
+	NeedsRekey          bool   // Oxipay rejected the signing key, it must be re-keyed before taking payments
 }
 
 // Terminal terminal mapping
 type Terminal struct {
 	Db *sql.DB
+
+	cache *cache // nil when lookups aren't cached
 }
 
 // Db connection to the database
@@ -29,6 +45,16 @@ func NewTerminal(db *sql.DB) *Terminal {
 	}
 }
 
+// NewCachedTerminal caches the registers found by GetRegister for the TTL.
+// Changes made through the Terminal are seen straight away
+func NewCachedTerminal(db *sql.DB, ttl time.Duration) *Terminal {
+	t := NewTerminal(db)
+	if ttl > 0 {
+		t.cache = newCache(ttl)
+	}
+	return t
+}
+
 // NewRegister returns a Pointer to a terminal
 func NewRegister(key string, deviceID string, merchantID string, origin string, registerID string) *Register {
 	return &Register{
@@ -50,8 +76,10 @@ func (t Terminal) Save(user string, register *Register) (bool, error) {
 			fxl_device_signing_key,
 			origin_domain, 
 			vend_register_id,
+			vend_outlet_id,
+			locale,
 			created_by
-		) VALUES (?, ?, ?, ?, ?, ?) `
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?) `
 
 	stmt, err := t.Db.Prepare(query)
 
@@ -67,6 +95,8 @@ func (t Terminal) Save(user string, register *Register) (bool, error) {
 		newNullString(register.FxlDeviceSigningKey),
 		newNullString(register.Origin),
 		newNullString(register.VendRegisterID),
+		newNullString(register.VendOutletID),
+		newNullString(register.Locale),
 		newNullString(user),
 	)
 
@@ -74,53 +104,328 @@ func (t Terminal) Save(user string, register *Register) (bool, error) {
 		return false, err
 	}
 
+	t.invalidate(register.Origin, register.VendRegisterID)
 	return true, nil
 }
 
-// GetRegister will return a registered terminal for the the domain & vendregister_id combo
+// GetRegister will return a registered terminal for the the domain & vendregister_id combo.
+// A register paired with more than one merchant uses the merchant its outlet
+// is mapped to, otherwise ErrAmbiguous is returned. ErrNotFound is returned if
+// the register isn't paired
 func (t Terminal) GetRegister(originDomain string, vendRegisterID string) (*Register, error) {
-	var register = new(Register)
+	var snapshot uint64
+	if t.cache != nil {
+		if register, ok := t.cache.get(originDomain, vendRegisterID); ok {
+			return register, nil
+		}
+		snapshot = t.cache.snapshot()
+	}
+
 	sql := `SELECT 
-			 fxl_register_id, 
-			 fxl_seller_id,
-			 fxl_device_signing_key, 
-			 origin_domain,
-			 vend_register_id
+			 m.fxl_register_id, 
+			 m.fxl_seller_id,
+			 m.fxl_device_signing_key, 
+			 m.origin_domain,
+			 m.vend_register_id,
+			 COALESCE(m.vend_outlet_id, ''),
+			 COALESCE(m.locale, ''),
+			 COALESCE(m.needs_rekey, 0),
+			 COALESCE(o.fxl_seller_id, '')
 			FROM 
-				oxipay_vend_map 
+				oxipay_vend_map m
+			LEFT JOIN
+				oxipay_vend_outlet o
+			ON
+				o.origin_domain = m.origin_domain
+			AND
+				o.vend_outlet_id = m.vend_outlet_id
 			WHERE 
-				origin_domain = ? 
+				m.origin_domain = ? 
 			AND
-				vend_register_id = ? 
-			AND 1=1`
+				m.vend_register_id = ? 
+			AND
+				m.deleted_date IS NULL
+			ORDER BY
+				m.id`
 
 	rows, err := t.Db.Query(sql, originDomain, vendRegisterID)
-	if rows == nil {
-		return register, errors.New("Nothing returned from register lookup. Has the table been created ?")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		c.register = new(Register)
+		err = rows.Scan(
+			&c.register.FxlRegisterID,
+			&c.register.FxlSellerID,
+			&c.register.FxlDeviceSigningKey,
+			&c.register.Origin,
+			&c.register.VendRegisterID,
+			&c.register.VendOutletID,
+			&c.register.Locale,
+			&c.register.NeedsRekey,
+			&c.outletMerchant,
+		)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(candidates) < 1 {
+		return nil, ErrNotFound
 	}
 
-	noRows := 0
+	register, err := choose(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.cache != nil {
+		t.cache.put(register, snapshot)
+	}
+	return register, nil
+}
+
+// candidate is a pairing for a register and the merchant its outlet is mapped
+// to, if it is mapped
+type candidate struct {
+	register       *Register
+	outletMerchant string
+}
+
+// choose picks the pairing to use for a register. A register paired once uses
+// that pairing. A register paired with several merchants uses the one its
+// outlet is mapped to
+func choose(candidates []candidate) (*Register, error) {
+	if len(candidates) == 1 {
+		return candidates[0].register, nil
+	}
+
+	var chosen []*Register
+	var merchants []string
+	for _, c := range candidates {
+		merchants = append(merchants, c.register.FxlSellerID)
+		if c.outletMerchant != "" && c.outletMerchant == c.register.FxlSellerID {
+			chosen = append(chosen, c.register)
+		}
+	}
 
+	if len(chosen) == 1 {
+		return chosen[0], nil
+	}
+
+	register := candidates[0].register
+	return nil, fmt.Errorf("%w: register %s on %s is paired with merchants %s, map its outlet to one of them",
+		ErrAmbiguous, register.VendRegisterID, register.Origin, strings.Join(merchants, ", "))
+}
+
+// ListRegisters returns every register paired for the origin domain, or all
+// registers if the origin is empty
+func (t Terminal) ListRegisters(originDomain string) ([]*Register, error) {
+	query := `SELECT
+			 fxl_register_id,
+			 fxl_seller_id,
+			 fxl_device_signing_key,
+			 origin_domain,
+			 vend_register_id,
+			 COALESCE(vend_outlet_id, ''),
+			 COALESCE(locale, ''),
+			 COALESCE(needs_rekey, 0)
+			FROM
+				oxipay_vend_map
+			WHERE
+				(? = '' OR origin_domain = ?)
+			AND
+				deleted_date IS NULL
+			ORDER BY
+				origin_domain, vend_register_id`
+
+	rows, err := t.Db.Query(query, originDomain, originDomain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var registers []*Register
 	for rows.Next() {
-		noRows++
+		register := new(Register)
+		var signingKey sql.NullString
 		err = rows.Scan(
 			&register.FxlRegisterID,
 			&register.FxlSellerID,
-			&register.FxlDeviceSigningKey,
+			&signingKey,
 			&register.Origin,
 			&register.VendRegisterID,
+			&register.VendOutletID,
+			&register.Locale,
+			&register.NeedsRekey,
 		)
+		if err != nil {
+			return nil, err
+		}
+		register.FxlDeviceSigningKey = signingKey.String
+		registers = append(registers, register)
+	}
+
+	return registers, rows.Err()
+}
 
+// Rekey replaces the signing key of the paired register with a key from a new
+// CreateKey for the same device, so the register keeps its device ID. The old
+// key is kept in oxipay_vend_key_history
+func (t Terminal) Rekey(user string, register *Register, key string) error {
+	tx, err := t.Db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	history := `INSERT INTO
+			oxipay_vend_key_history
+			(
+				fxl_register_id,
+				fxl_seller_id,
+				fxl_device_signing_key,
+				origin_domain,
+				vend_register_id,
+				created_by
+			)
+			SELECT
+				fxl_register_id,
+				fxl_seller_id,
+				fxl_device_signing_key,
+				origin_domain,
+				vend_register_id,
+				?
+			FROM
+				oxipay_vend_map
+			WHERE
+				origin_domain = ?
+			AND
+				vend_register_id = ?
+			AND
+				fxl_register_id = ?
+			AND
+				deleted_date IS NULL`
+
+	_, err = tx.Exec(history, user, register.Origin, register.VendRegisterID, register.FxlRegisterID)
 	if err != nil {
-		return register, err
+		return err
 	}
 
-	if noRows < 1 {
-		return nil, errors.New("Unable to find a matching terminal ")
+	// the device ID is matched so a register that was paired again in the
+	// meantime isn't given this key
+	update := `UPDATE
+				oxipay_vend_map
+			SET
+				fxl_device_signing_key = ?,
+				needs_rekey = 0,
+				modified_date = NOW(),
+				modified_by = ?
+			WHERE
+				origin_domain = ?
+			AND
+				vend_register_id = ?
+			AND
+				fxl_register_id = ?
+			AND
+				deleted_date IS NULL`
+
+	result, err := tx.Exec(update, key, user, register.Origin, register.VendRegisterID, register.FxlRegisterID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
-	return register, err
+	t.invalidate(register.Origin, register.VendRegisterID)
+
+	register.FxlDeviceSigningKey = key
+	register.NeedsRekey = false
+	return nil
+}
+
+// MarkNeedsRekey flags the register after Oxipay rejects its signing key. The
+// flag is cleared when the register is re-keyed. Only the pairing with the
+// rejected key is flagged, so a register that was paired again or re-keyed in
+// the meantime keeps taking payments
+func (t Terminal) MarkNeedsRekey(register *Register) error {
+	query := `UPDATE
+				oxipay_vend_map
+			SET
+				needs_rekey = 1,
+				modified_date = NOW()
+			WHERE
+				origin_domain = ?
+			AND
+				vend_register_id = ?
+			AND
+				fxl_register_id = ?
+			AND
+				fxl_seller_id = ?
+			AND
+				fxl_device_signing_key = ?
+			AND
+				deleted_date IS NULL`
+
+	_, err := t.Db.Exec(query,
+		register.Origin,
+		register.VendRegisterID,
+		register.FxlRegisterID,
+		register.FxlSellerID,
+		register.FxlDeviceSigningKey,
+	)
+	t.invalidate(register.Origin, register.VendRegisterID)
+	return err
+}
+
+// Delete unpairs the Vend register so it has to be registered again before it
+// can take payments. The pairing is kept, marked as deleted, so the payments
+// it took can still be traced to the device
+func (t Terminal) Delete(user string, originDomain string, vendRegisterID string) error {
+	query := `UPDATE
+				oxipay_vend_map
+			SET
+				deleted_date = NOW(),
+				deleted_by = ?
+			WHERE
+				origin_domain = ?
+			AND
+				vend_register_id = ?
+			AND
+				deleted_date IS NULL`
+
+	result, err := t.Db.Exec(query, user, originDomain, vendRegisterID)
+	if err != nil {
+		return err
+	}
+	t.invalidate(originDomain, vendRegisterID)
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// invalidate drops the register from the cache. An empty register ID drops
+// every register for the origin
+func (t Terminal) invalidate(originDomain string, vendRegisterID string) {
+	if t.cache != nil {
+		t.cache.invalidate(originDomain, vendRegisterID)
+	}
 }
 
 func newNullString(s string) sql.NullString {
@@ -0,0 +1,46 @@
+package terminal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChoose(t *testing.T) {
+	paired := func(merchantID string, outletMerchant string) candidate {
+		return candidate{
+			register: &Register{
+				Origin:         "https://example.vendhq.com",
+				VendRegisterID: "r1",
+				FxlSellerID:    merchantID,
+				VendOutletID:   "o1",
+			},
+			outletMerchant: outletMerchant,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		candidates []candidate
+		expected   string
+		err        error
+	}{
+		{"paired once", []candidate{paired("30188105", "")}, "30188105", nil},
+		{"paired once with another outlet merchant", []candidate{paired("30188105", "30188106")}, "30188105", nil},
+		{"outlet chooses", []candidate{paired("30188105", "30188106"), paired("30188106", "30188106")}, "30188106", nil},
+		{"outlet not mapped", []candidate{paired("30188105", ""), paired("30188106", "")}, "", ErrAmbiguous},
+		{"outlet merchant not paired", []candidate{paired("30188105", "30188107"), paired("30188106", "30188107")}, "", ErrAmbiguous},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			register, err := choose(tt.candidates)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			if register != nil && register.FxlSellerID != tt.expected {
+				t.Errorf("expected merchant %s, got %s", tt.expected, register.FxlSellerID)
+			}
+		})
+	}
+}
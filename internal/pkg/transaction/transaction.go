@@ -0,0 +1,341 @@
+// Package transaction records every payment and refund attempted through the
+// proxy so that Vend payments can be joined with the Oxipay settlement
+package transaction
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	shortid "github.com/ventu-io/go-shortid"
+)
+
+// The types of transaction
+const (
+	TypePayment = "payment"
+	TypeRefund  = "refund"
+)
+
+// StatusPending is the status of a transaction that has been sent to Oxipay
+// but we haven't heard back about yet
+const StatusPending = "PENDING"
+
+// ErrNotFound is returned when there is no transaction with the ID
+var ErrNotFound = errors.New("transaction not found")
+
+// Transaction is a single payment or refund attempt
+type Transaction struct {
+	ID             string // proxy transaction ID, sent to Vend as transaction_id
+	Type           string
+	Origin         string
+	VendRegisterID string
+	VendSaleID     string
+	MerchantID     string
+	PurchaseNumber string // Oxipay purchase number
+	Amount         int64  // cents, negative for refunds
+	Status         string
+	ResponseCode   string
+	VendSaleStatus string // set when the sale is voided or returned in Vend
+	Created        time.Time
+}
+
+// Store saves transactions to the database
+type Store struct {
+	Db *sql.DB
+}
+
+// Filter narrows down a search. Empty fields match everything
+type Filter struct {
+	// Query matches the transaction ID, purchase number or Vend sale ID
+	Query      string
+	Origin     string
+	MerchantID string
+	From       time.Time
+	To         time.Time
+}
+
+// NewStore Used to marshall the DB connection
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		Db: db,
+	}
+}
+
+// NewID generates a transaction ID
+func NewID() (string, error) {
+	return shortid.Generate()
+}
+
+// FormatAmount converts cents to dollars e.g -6990 is -69.90
+func FormatAmount(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Create saves a new transaction, generating an ID for it if it doesn't
+// already have one
+func (s Store) Create(txn *Transaction) error {
+	if txn.ID == "" {
+		id, err := NewID()
+		if err != nil {
+			return err
+		}
+		txn.ID = id
+	}
+
+	if txn.Status == "" {
+		txn.Status = StatusPending
+	}
+
+	query := `INSERT INTO
+		oxipay_vend_transaction
+		(
+			transaction_id,
+			type,
+			origin_domain,
+			vend_register_id,
+			vend_sale_id,
+			fxl_seller_id,
+			fxl_purchase_number,
+			amount,
+			status
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := s.Db.Exec(query,
+		txn.ID,
+		txn.Type,
+		txn.Origin,
+		txn.VendRegisterID,
+		newNullString(txn.VendSaleID),
+		txn.MerchantID,
+		newNullString(txn.PurchaseNumber),
+		txn.Amount,
+		txn.Status,
+	)
+	return err
+}
+
+// Complete records the outcome of the transaction from Oxipay
+func (s Store) Complete(txn *Transaction) error {
+	query := `UPDATE
+			oxipay_vend_transaction
+		SET
+			fxl_purchase_number = ?,
+			status = ?,
+			response_code = ?,
+			modified_date = CURRENT_TIMESTAMP
+		WHERE
+			transaction_id = ?`
+
+	result, err := s.Db.Exec(query,
+		newNullString(txn.PurchaseNumber),
+		txn.Status,
+		newNullString(txn.ResponseCode),
+		txn.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetVendSaleStatus flags the transaction with the status of its sale in
+// Vend, which is how voided and returned sales are picked up for review
+func (s Store) SetVendSaleStatus(id string, status string) error {
+	query := `UPDATE
+			oxipay_vend_transaction
+		SET
+			vend_sale_status = ?,
+			modified_date = CURRENT_TIMESTAMP
+		WHERE
+			transaction_id = ?`
+
+	result, err := s.Db.Exec(query, newNullString(status), id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ClaimVoidRefund marks the payment as being refunded because its sale was
+// voided. It returns false if the payment has already been claimed, so only
+// one of the webhooks Vend sends for the sale refunds it
+func (s Store) ClaimVoidRefund(id string) (bool, error) {
+	query := `UPDATE
+			oxipay_vend_transaction
+		SET
+			void_refund_date = CURRENT_TIMESTAMP,
+			modified_date = CURRENT_TIMESTAMP
+		WHERE
+			transaction_id = ?
+			AND void_refund_date IS NULL`
+
+	result, err := s.Db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseVoidRefund lets go of a claim made by ClaimVoidRefund when nothing
+// was refunded, so the refund is tried again the next time Vend sends the
+// webhook
+func (s Store) ReleaseVoidRefund(id string) error {
+	query := `UPDATE
+			oxipay_vend_transaction
+		SET
+			void_refund_date = NULL,
+			modified_date = CURRENT_TIMESTAMP
+		WHERE
+			transaction_id = ?`
+
+	_, err := s.Db.Exec(query, id)
+	return err
+}
+
+// Get returns the transaction with the ID
+func (s Store) Get(id string) (*Transaction, error) {
+	row := s.Db.QueryRow(selectTransactions+" WHERE transaction_id = ?", id)
+
+	txn, err := scan(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return txn, err
+}
+
+// Search returns the transactions matching the filter, oldest first
+func (s Store) Search(filter Filter) ([]*Transaction, error) {
+	var txns []*Transaction
+	err := s.Each(filter, func(txn *Transaction) error {
+		txns = append(txns, txn)
+		return nil
+	})
+	return txns, err
+}
+
+// Each calls fn for every transaction matching the filter, oldest first,
+// without holding them all in memory. It stops at the first error from fn
+func (s Store) Each(filter Filter, fn func(*Transaction) error) error {
+	where, args := filter.where()
+
+	rows, err := s.Db.Query(selectTransactions+where+" ORDER BY created_date, id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		txn, err := scan(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(txn); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+const selectTransactions = `SELECT
+		transaction_id,
+		type,
+		origin_domain,
+		vend_register_id,
+		COALESCE(vend_sale_id, ''),
+		fxl_seller_id,
+		COALESCE(fxl_purchase_number, ''),
+		amount,
+		status,
+		COALESCE(response_code, ''),
+		COALESCE(vend_sale_status, ''),
+		created_date
+	FROM
+		oxipay_vend_transaction`
+
+// where builds the WHERE clause for the filter
+func (f Filter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.Query != "" {
+		conditions = append(conditions, "(transaction_id = ? OR fxl_purchase_number = ? OR vend_sale_id = ?)")
+		args = append(args, f.Query, f.Query, f.Query)
+	}
+	if f.Origin != "" {
+		conditions = append(conditions, "origin_domain = ?")
+		args = append(args, f.Origin)
+	}
+	if f.MerchantID != "" {
+		conditions = append(conditions, "fxl_seller_id = ?")
+		args = append(args, f.MerchantID)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "created_date >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "created_date < ?")
+		args = append(args, f.To)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (*Transaction, error) {
+	txn := new(Transaction)
+	err := row.Scan(
+		&txn.ID,
+		&txn.Type,
+		&txn.Origin,
+		&txn.VendRegisterID,
+		&txn.VendSaleID,
+		&txn.MerchantID,
+		&txn.PurchaseNumber,
+		&txn.Amount,
+		&txn.Status,
+		&txn.ResponseCode,
+		&txn.VendSaleStatus,
+		&txn.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func newNullString(s string) sql.NullString {
+	if len(s) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{
+		String: s,
+		Valid:  true,
+	}
+}
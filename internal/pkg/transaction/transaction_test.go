@@ -0,0 +1,40 @@
+package transaction
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilterWhere(t *testing.T) {
+	where, args := Filter{}.where()
+	if where != "" || len(args) != 0 {
+		t.Errorf("expected an empty filter to match everything, got %q %v", where, args)
+	}
+
+	from := time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)
+	where, args = Filter{Query: "P1234", MerchantID: "30188105", From: from}.where()
+
+	expected := " WHERE (transaction_id = ? OR fxl_purchase_number = ? OR vend_sale_id = ?) AND fxl_seller_id = ? AND created_date >= ?"
+	if where != expected {
+		t.Errorf("unexpected where clause %q", where)
+	}
+
+	if len(args) != 5 || args[0] != "P1234" || args[3] != "30188105" || args[4] != from {
+		t.Errorf("unexpected args %v", args)
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := map[int64]string{
+		4400:  "44.00",
+		-6990: "-69.90",
+		5:     "0.05",
+		0:     "0.00",
+	}
+
+	for cents, expected := range tests {
+		if got := FormatAmount(cents); got != expected {
+			t.Errorf("%d: expected %s, got %s", cents, expected, got)
+		}
+	}
+}
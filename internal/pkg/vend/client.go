@@ -0,0 +1,438 @@
+package vend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPageSize is the number of items requested per page of a list
+	DefaultPageSize = 200
+
+	// DefaultMaxRetries is how many times a rate limited request is retried
+	DefaultMaxRetries = 3
+
+	// MaxRetryWait is the longest we will wait for the rate limit to reset,
+	// beyond that the request fails rather than hold up the cashier
+	MaxRetryWait = 30 * time.Second
+
+	// HTTPClientTimeout is the timeout for a single request to Vend
+	HTTPClientTimeout = 20 * time.Second
+)
+
+var (
+	// ErrNotFound is returned when Vend doesn't have the requested item
+	ErrNotFound = errors.New("vend: not found")
+
+	// ErrUnauthorized is returned when Vend rejects the access token
+	ErrUnauthorized = errors.New("vend: access token was rejected")
+
+	// ErrNoToken is returned when we don't have an access token for the retailer
+	ErrNoToken = errors.New("vend: no access token for the retailer")
+
+	// ErrRateLimited is returned when Vend is still rate limiting us after
+	// the retries
+	ErrRateLimited = errors.New("vend: rate limit exceeded")
+)
+
+// APIError is returned for any other unexpected response from Vend
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("vend: unexpected response %d: %s", e.StatusCode, e.Body)
+}
+
+// TokenSource supplies the OAuth access token for a retailer, who is
+// identified by their Vend origin e.g https://example.vendhq.com
+type TokenSource interface {
+	Token(ctx context.Context, origin string) (string, error)
+}
+
+// StaticTokens is a TokenSource with fixed tokens, keyed by origin
+type StaticTokens map[string]string
+
+// Token returns the token for the origin
+func (s StaticTokens) Token(ctx context.Context, origin string) (string, error) {
+	token, ok := s[normaliseOrigin(origin)]
+	if !ok {
+		return "", ErrNoToken
+	}
+	return token, nil
+}
+
+// Client exposes the parts of the Vend API used by the proxy
+type Client interface {
+	Register(ctx context.Context, origin string, id string) (*Register, error)
+	Registers(ctx context.Context, origin string) ([]Register, error)
+	Outlet(ctx context.Context, origin string, id string) (*Outlet, error)
+	Outlets(ctx context.Context, origin string) ([]Outlet, error)
+	Sale(ctx context.Context, origin string, id string) (*Sale, error)
+	PaymentTypes(ctx context.Context, origin string) ([]PaymentType, error)
+	CreatePaymentType(ctx context.Context, origin string, paymentType PaymentType) (*PaymentType, error)
+	UpdatePaymentType(ctx context.Context, origin string, paymentType PaymentType) (*PaymentType, error)
+}
+
+// Register is a Vend register
+type Register struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	OutletID string `json:"outlet_id"`
+}
+
+// Outlet is a Vend outlet, which is a store
+type Outlet struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	TimeZone string `json:"time_zone"`
+}
+
+// Sale is a Vend register sale
+type Sale struct {
+	ID            string        `json:"id"`
+	OutletID      string        `json:"outlet_id"`
+	RegisterID    string        `json:"register_id"`
+	InvoiceNumber string        `json:"invoice_number"`
+	Status        string        `json:"status"`
+	TotalPrice    float64       `json:"total_price"` // excluding tax
+	TotalTax      float64       `json:"total_tax"`
+	Payments      []SalePayment `json:"payments"`
+}
+
+// Total returns the total of the sale including tax in cents
+func (s *Sale) Total() int64 {
+	return toCents(s.TotalPrice + s.TotalTax)
+}
+
+// Balance returns what is left to pay on the sale in cents
+func (s *Sale) Balance() int64 {
+	balance := s.Total()
+	for _, payment := range s.Payments {
+		balance -= toCents(payment.Amount)
+	}
+	return balance
+}
+
+// Open returns false once the sale has been voided or closed, which includes
+// completed on account, layby and delivery sales e.g LAYBY_CLOSED
+func (s *Sale) Open() bool {
+	return s.Status != SaleStatusVoided && !strings.HasSuffix(s.Status, SaleStatusClosed)
+}
+
+// SalePayment is a payment made against a sale
+type SalePayment struct {
+	ID                    string  `json:"id"`
+	RetailerPaymentTypeID string  `json:"retailer_payment_type_id"`
+	Amount                float64 `json:"amount"`
+}
+
+// PaymentTypeIntegrated is the type of payment type that opens an external
+// gateway, such as this proxy, to take the payment
+const PaymentTypeIntegrated = 7
+
+// PaymentType is a payment type set up by the retailer
+type PaymentType struct {
+	ID     string             `json:"id,omitempty"`
+	Name   string             `json:"name"`
+	TypeID int                `json:"type_id"`
+	Config *PaymentTypeConfig `json:"config,omitempty"`
+}
+
+// PaymentTypeConfig is the configuration of an integrated payment type
+type PaymentTypeConfig struct {
+	// URL is the gateway Vend opens to take the payment
+	URL string `json:"url"`
+}
+
+// GatewayURL returns the gateway of an integrated payment type
+func (p PaymentType) GatewayURL() string {
+	if p.Config == nil {
+		return ""
+	}
+	return p.Config.URL
+}
+
+type client struct {
+	tokens     TokenSource
+	httpClient *http.Client
+	pageSize   int
+	maxRetries int
+	Log        *log.Logger
+}
+
+// NewClient returns a Vend API client that authenticates with the tokens
+func NewClient(tokens TokenSource, log *log.Logger) Client {
+	return &client{
+		tokens:     tokens,
+		httpClient: &http.Client{Timeout: HTTPClientTimeout},
+		pageSize:   DefaultPageSize,
+		maxRetries: DefaultMaxRetries,
+		Log:        log,
+	}
+}
+
+// Register fetches a register by ID
+func (c *client) Register(ctx context.Context, origin string, id string) (*Register, error) {
+	register := new(Register)
+	err := c.get(ctx, origin, "/registers/"+url.PathEscape(id), register)
+	return register, err
+}
+
+// Registers lists every register the retailer has
+func (c *client) Registers(ctx context.Context, origin string) ([]Register, error) {
+	var registers []Register
+	err := c.list(ctx, origin, "/registers", func(data json.RawMessage) error {
+		var page []Register
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		registers = append(registers, page...)
+		return nil
+	})
+	return registers, err
+}
+
+// Outlet fetches an outlet by ID
+func (c *client) Outlet(ctx context.Context, origin string, id string) (*Outlet, error) {
+	outlet := new(Outlet)
+	err := c.get(ctx, origin, "/outlets/"+url.PathEscape(id), outlet)
+	return outlet, err
+}
+
+// Outlets lists every outlet the retailer has
+func (c *client) Outlets(ctx context.Context, origin string) ([]Outlet, error) {
+	var outlets []Outlet
+	err := c.list(ctx, origin, "/outlets", func(data json.RawMessage) error {
+		var page []Outlet
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		outlets = append(outlets, page...)
+		return nil
+	})
+	return outlets, err
+}
+
+// Sale fetches a sale by ID
+func (c *client) Sale(ctx context.Context, origin string, id string) (*Sale, error) {
+	sale := new(Sale)
+	err := c.get(ctx, origin, "/sales/"+url.PathEscape(id), sale)
+	return sale, err
+}
+
+// PaymentTypes lists every payment type the retailer has set up
+func (c *client) PaymentTypes(ctx context.Context, origin string) ([]PaymentType, error) {
+	var paymentTypes []PaymentType
+	err := c.list(ctx, origin, "/payment_types", func(data json.RawMessage) error {
+		var page []PaymentType
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		paymentTypes = append(paymentTypes, page...)
+		return nil
+	})
+	return paymentTypes, err
+}
+
+// CreatePaymentType adds a payment type for the retailer
+func (c *client) CreatePaymentType(ctx context.Context, origin string, paymentType PaymentType) (*PaymentType, error) {
+	created := new(PaymentType)
+	err := c.send(ctx, http.MethodPost, origin, "/payment_types", paymentType, created)
+	return created, err
+}
+
+// UpdatePaymentType changes an existing payment type
+func (c *client) UpdatePaymentType(ctx context.Context, origin string, paymentType PaymentType) (*PaymentType, error) {
+	updated := new(PaymentType)
+	err := c.send(ctx, http.MethodPut, origin, "/payment_types/"+url.PathEscape(paymentType.ID), paymentType, updated)
+	return updated, err
+}
+
+// envelope is how Vend wraps every response
+type envelope struct {
+	Data    json.RawMessage `json:"data"`
+	Version struct {
+		Min int64 `json:"min"`
+		Max int64 `json:"max"`
+	} `json:"version"`
+}
+
+func (c *client) get(ctx context.Context, origin string, path string, v interface{}) error {
+	var body envelope
+	if err := c.do(ctx, http.MethodGet, origin, path, nil, &body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body.Data, v)
+}
+
+// send sends the payload and decodes the item Vend returns
+func (c *client) send(ctx context.Context, method string, origin string, path string, payload interface{}, v interface{}) error {
+	var body envelope
+	if err := c.do(ctx, method, origin, path, payload, &body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body.Data, v)
+}
+
+// list follows the pages of a collection, which Vend pages by version. fn is
+// called with the data of each page
+func (c *client) list(ctx context.Context, origin string, path string, fn func(json.RawMessage) error) error {
+	var after int64
+	for {
+		query := url.Values{}
+		query.Set("page_size", strconv.Itoa(c.pageSize))
+		if after > 0 {
+			query.Set("after", strconv.FormatInt(after, 10))
+		}
+
+		var body envelope
+		if err := c.do(ctx, http.MethodGet, origin, path+"?"+query.Encode(), nil, &body); err != nil {
+			return err
+		}
+
+		// the last page is empty
+		if len(body.Data) == 0 || string(body.Data) == "[]" || string(body.Data) == "null" {
+			return nil
+		}
+
+		if err := fn(body.Data); err != nil {
+			return err
+		}
+
+		if body.Version.Max <= after {
+			return nil
+		}
+		after = body.Version.Max
+	}
+}
+
+// do sends the request, waiting and retrying while Vend is rate limiting us
+func (c *client) do(ctx context.Context, method string, origin string, path string, payload interface{}, v interface{}) error {
+	token, err := c.tokens.Token(ctx, origin)
+	if err != nil {
+		return err
+	}
+
+	contextLogger := c.Log.WithFields(log.Fields{
+		"module": "vend",
+		"origin": origin,
+		"path":   path,
+	})
+
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	endpoint := normaliseOrigin(origin) + "/api/2.0" + path
+
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = strings.NewReader(string(body))
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		contextLogger.Debugf("%s %s", method, endpoint)
+
+		response, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		responseBody, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case response.StatusCode == http.StatusTooManyRequests:
+			wait := retryAfter(response.Header.Get("Retry-After"), time.Now())
+			if attempt >= c.maxRetries || wait > MaxRetryWait {
+				return ErrRateLimited
+			}
+
+			contextLogger.Warnf("Rate limited by Vend, retrying in %s", wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		case response.StatusCode == http.StatusNotFound:
+			return ErrNotFound
+		case response.StatusCode == http.StatusUnauthorized:
+			return ErrUnauthorized
+		case response.StatusCode < 200 || response.StatusCode > 299:
+			return &APIError{StatusCode: response.StatusCode, Body: string(responseBody)}
+		}
+
+		if v == nil || len(responseBody) == 0 {
+			return nil
+		}
+		return json.Unmarshal(responseBody, v)
+	}
+}
+
+// retryAfter works out how long to wait from a Retry-After header, which is
+// either a number of seconds or a time
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return time.Second
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	for _, layout := range []string{http.TimeFormat, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			if wait := t.Sub(now); wait > 0 {
+				return wait
+			}
+			return 0
+		}
+	}
+
+	return time.Second
+}
+
+// normaliseOrigin removes the trailing slash so origins can be compared
+func normaliseOrigin(origin string) string {
+	return strings.TrimRight(origin, "/")
+}
+
+// toCents converts a dollar amount from Vend to cents
+func toCents(amount float64) int64 {
+	if amount < 0 {
+		return int64(amount*100 - 0.5)
+	}
+	return int64(amount*100 + 0.5)
+}
@@ -0,0 +1,152 @@
+package vend_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+	"github.com/sirupsen/logrus"
+)
+
+func newClient(t *testing.T) (*vendtest.Server, vend.Client) {
+	server := vendtest.NewServer("secret-token")
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	return server, vend.NewClient(server.Tokens(), logger)
+}
+
+func TestFetch(t *testing.T) {
+	server, client := newClient(t)
+	ctx := context.Background()
+
+	server.AddRegister(vend.Register{ID: "r1", Name: "Main Register", OutletID: "o1"})
+	server.AddOutlet(vend.Outlet{ID: "o1", Name: "Ponsonby"})
+	server.AddSale(vend.Sale{ID: "s1", TotalPrice: 38.26, TotalTax: 5.74, Payments: []vend.SalePayment{{Amount: 10}}})
+
+	register, err := client.Register(ctx, server.URL, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if register.OutletID != "o1" {
+		t.Errorf("unexpected register %+v", register)
+	}
+
+	outlet, err := client.Outlet(ctx, server.URL, register.OutletID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outlet.Name != "Ponsonby" {
+		t.Errorf("unexpected outlet %+v", outlet)
+	}
+
+	sale, err := client.Sale(ctx, server.URL, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sale.Total() != 4400 {
+		t.Errorf("expected the sale total to be 4400 cents, got %d", sale.Total())
+	}
+	if sale.Balance() != 3400 {
+		t.Errorf("expected 3400 cents left to pay, got %d", sale.Balance())
+	}
+
+	if _, err := client.Sale(ctx, server.URL, "missing"); err != vend.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	server, client := newClient(t)
+	server.PageSize = 2
+
+	for _, name := range []string{"Cash", "Credit Card", "humm", "Gift Card", "Store Credit"} {
+		server.AddPaymentType(vend.PaymentType{ID: name, Name: name})
+	}
+
+	paymentTypes, err := client.PaymentTypes(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paymentTypes) != 5 || paymentTypes[4].Name != "Store Credit" {
+		t.Errorf("expected every page, got %+v", paymentTypes)
+	}
+}
+
+func TestListRegistersAndOutlets(t *testing.T) {
+	server, client := newClient(t)
+	server.PageSize = 1
+	server.AddOutlet(vend.Outlet{ID: "o1", Name: "Ponsonby"})
+	server.AddRegister(vend.Register{ID: "r2", Name: "Back", OutletID: "o1"})
+	server.AddRegister(vend.Register{ID: "r1", Name: "Front", OutletID: "o1"})
+
+	registers, err := client.Registers(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registers) != 2 || registers[0].ID != "r1" || registers[1].ID != "r2" {
+		t.Errorf("expected both registers, got %+v", registers)
+	}
+
+	outlets, err := client.Outlets(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outlets) != 1 || outlets[0].Name != "Ponsonby" {
+		t.Errorf("expected the outlet, got %+v", outlets)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server, client := newClient(t)
+	server.AddSale(vend.Sale{ID: "s1"})
+
+	server.RateLimit(2)
+	if _, err := client.Sale(context.Background(), server.URL, "s1"); err != nil {
+		t.Fatalf("expected the request to be retried, got %s", err)
+	}
+	if server.Requests() != 3 {
+		t.Errorf("expected 3 requests, got %d", server.Requests())
+	}
+
+	server.RateLimit(10)
+	if _, err := client.Sale(context.Background(), server.URL, "s1"); err != vend.ErrRateLimited {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	server, _ := newClient(t)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	wrongToken := vend.NewClient(vend.StaticTokens{server.URL: "wrong"}, logger)
+	if _, err := wrongToken.Sale(context.Background(), server.URL, "s1"); err != vend.ErrUnauthorized {
+		t.Errorf("expected ErrUnauthorized, got %v", err)
+	}
+
+	noToken := vend.NewClient(vend.StaticTokens{}, logger)
+	if _, err := noToken.Sale(context.Background(), server.URL, "s1"); err != vend.ErrNoToken {
+		t.Errorf("expected ErrNoToken, got %v", err)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	server, client := newClient(t)
+	server.AddSale(vend.Sale{ID: "s1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	if _, err := client.Sale(ctx, server.URL, "s1"); err == nil {
+		t.Error("expected the cancelled request to fail")
+	}
+}
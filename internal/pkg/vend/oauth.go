@@ -0,0 +1,174 @@
+package vend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAuthURL is where the retailer is sent to give their consent
+	DefaultAuthURL = "https://secure.vendhq.com/connect"
+
+	// DefaultTokenURL is where codes and refresh tokens are exchanged for
+	// access tokens. {domain_prefix} is replaced with the retailer's prefix
+	DefaultTokenURL = "https://{domain_prefix}.vendhq.com/api/1.0/token"
+)
+
+var domainPrefix = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// OAuthConfig is the application registered with Vend
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	AuthURL      string
+	TokenURL     string
+}
+
+// Token is the access granted by a retailer
+type Token struct {
+	Origin       string
+	DomainPrefix string
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// tokenResponse is the body returned by the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	Expires      int64  `json:"expires"`    // unix time
+	ExpiresIn    int64  `json:"expires_in"` // seconds
+	DomainPrefix string `json:"domain_prefix"`
+	Error        string `json:"error"`
+}
+
+// OriginForDomainPrefix returns the Vend origin of the retailer, which is how
+// the registers are keyed
+func OriginForDomainPrefix(prefix string) string {
+	return "https://" + prefix + ".vendhq.com"
+}
+
+// DomainPrefixForOrigin returns the retailer's domain prefix from their origin
+// e.g https://example.vendhq.com is example
+func DomainPrefixForOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || !strings.HasSuffix(u.Hostname(), ".vendhq.com") {
+		return "", fmt.Errorf("vend: %q is not a Vend origin", origin)
+	}
+	return strings.TrimSuffix(u.Hostname(), ".vendhq.com"), nil
+}
+
+// AuthCodeURL returns the URL the retailer is sent to in order to connect
+func (c *OAuthConfig) AuthCodeURL(state string) string {
+	authURL := c.AuthURL
+	if authURL == "" {
+		authURL = DefaultAuthURL
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", c.ClientID)
+	query.Set("redirect_uri", c.RedirectURL)
+	query.Set("state", state)
+	return authURL + "?" + query.Encode()
+}
+
+// Exchange swaps the code from the callback for a token
+func (c *OAuthConfig) Exchange(ctx context.Context, code string, prefix string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.RedirectURL)
+
+	return c.token(ctx, prefix, form, nil)
+}
+
+// Refresh gets a new access token using the refresh token
+func (c *OAuthConfig) Refresh(ctx context.Context, token *Token) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", token.RefreshToken)
+
+	return c.token(ctx, token.DomainPrefix, form, token)
+}
+
+func (c *OAuthConfig) token(ctx context.Context, prefix string, form url.Values, previous *Token) (*Token, error) {
+	if !domainPrefix.MatchString(prefix) {
+		return nil, fmt.Errorf("vend: %q is not a valid domain prefix", prefix)
+	}
+
+	tokenURL := c.TokenURL
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	tokenURL = strings.Replace(tokenURL, "{domain_prefix}", prefix, 1)
+
+	form.Set("client_id", c.ClientID)
+	form.Set("client_secret", c.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	client := http.Client{Timeout: HTTPClientTimeout}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &APIError{StatusCode: response.StatusCode, Body: string(body)}
+	}
+
+	var granted tokenResponse
+	if err := json.Unmarshal(body, &granted); err != nil {
+		return nil, err
+	}
+	if granted.Error != "" || granted.AccessToken == "" {
+		return nil, errors.New("vend: no access token was granted " + granted.Error)
+	}
+
+	token := &Token{
+		Origin:       OriginForDomainPrefix(prefix),
+		DomainPrefix: prefix,
+		AccessToken:  granted.AccessToken,
+		RefreshToken: granted.RefreshToken,
+	}
+
+	switch {
+	case granted.Expires > 0:
+		token.Expiry = time.Unix(granted.Expires, 0)
+	case granted.ExpiresIn > 0:
+		token.Expiry = time.Now().Add(time.Duration(granted.ExpiresIn) * time.Second)
+	}
+
+	// Vend doesn't always send a new refresh token
+	if token.RefreshToken == "" && previous != nil {
+		token.RefreshToken = previous.RefreshToken
+	}
+	if previous != nil && previous.Origin != "" {
+		token.Origin = previous.Origin
+	}
+
+	return token, nil
+}
@@ -0,0 +1,95 @@
+package vend_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+)
+
+func oauthConfig(server *vendtest.Server) *vend.OAuthConfig {
+	return &vend.OAuthConfig{
+		ClientID:     server.ClientID,
+		ClientSecret: server.ClientSecret,
+		RedirectURL:  "https://vendproxy.example.com/vend/callback",
+		TokenURL:     server.URL + "/api/1.0/token",
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	c := &vend.OAuthConfig{ClientID: "client-id", RedirectURL: "https://vendproxy.example.com/vend/callback"}
+
+	u, err := url.Parse(c.AuthCodeURL("state-123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(u.String(), vend.DefaultAuthURL) {
+		t.Errorf("expected the default auth URL, got %s", u)
+	}
+
+	query := u.Query()
+	if query.Get("state") != "state-123" || query.Get("client_id") != "client-id" || query.Get("response_type") != "code" {
+		t.Errorf("unexpected query %s", u.RawQuery)
+	}
+}
+
+func TestExchangeAndRefresh(t *testing.T) {
+	server := vendtest.NewServer("access-token")
+	defer server.Close()
+
+	c := oauthConfig(server)
+	ctx := context.Background()
+
+	token, err := c.Exchange(ctx, "code", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.AccessToken != "access-token" || token.RefreshToken != "refresh-token" {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if token.Origin != "https://example.vendhq.com" {
+		t.Errorf("expected the origin to come from the domain prefix, got %s", token.Origin)
+	}
+	if time.Until(token.Expiry) < 59*time.Minute {
+		t.Errorf("expected the token to expire in an hour, got %s", token.Expiry)
+	}
+
+	server.Token = "new-access-token"
+	refreshed, err := c.Refresh(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.AccessToken != "new-access-token" {
+		t.Errorf("expected a new access token, got %+v", refreshed)
+	}
+
+	if _, err := c.Exchange(ctx, "wrong", "example"); err == nil {
+		t.Error("expected an invalid code to be rejected")
+	}
+}
+
+func TestExchangeRejectsBadDomainPrefix(t *testing.T) {
+	server := vendtest.NewServer("access-token")
+	defer server.Close()
+
+	if _, err := oauthConfig(server).Exchange(context.Background(), "code", "evil.example.com/"); err == nil {
+		t.Error("expected the domain prefix to be validated")
+	}
+}
+
+func TestDomainPrefixForOrigin(t *testing.T) {
+	prefix, err := vend.DomainPrefixForOrigin("https://example.vendhq.com/")
+	if err != nil || prefix != "example" {
+		t.Errorf("expected example, got %q %v", prefix, err)
+	}
+
+	if _, err := vend.DomainPrefixForOrigin("https://example.com"); err == nil {
+		t.Error("expected an error for an origin that isn't Vend")
+	}
+}
@@ -0,0 +1,108 @@
+package vend
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// The outcomes of checking or setting up the payment type
+const (
+	ProvisionOK       = "ok"
+	ProvisionCreated  = "created"
+	ProvisionUpdated  = "updated"
+	ProvisionMissing  = "missing"
+	ProvisionMismatch = "mismatch"
+)
+
+// Provision is the payment type found or set up for the retailer
+type Provision struct {
+	Status      string       `json:"status"`
+	PaymentType *PaymentType `json:"payment_type,omitempty"`
+
+	// PreviousURL is the gateway the payment type pointed at before it
+	// was updated, or still points at when only checking
+	PreviousURL string `json:"previous_url,omitempty"`
+}
+
+// ProvisionPaymentType makes sure the retailer has an integrated payment type
+// called name that opens gatewayURL. When apply is false it only reports
+// whether the payment type is missing or points somewhere else
+func ProvisionPaymentType(ctx context.Context, c Client, origin string, name string, gatewayURL string, apply bool) (*Provision, error) {
+	paymentTypes, err := c.PaymentTypes(ctx, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := findPaymentType(paymentTypes, name, gatewayURL)
+	if existing != nil && existing.GatewayURL() == gatewayURL {
+		return &Provision{Status: ProvisionOK, PaymentType: existing}, nil
+	}
+
+	if existing == nil {
+		if !apply {
+			return &Provision{Status: ProvisionMissing}, nil
+		}
+
+		created, err := c.CreatePaymentType(ctx, origin, PaymentType{
+			Name:   name,
+			TypeID: PaymentTypeIntegrated,
+			Config: &PaymentTypeConfig{URL: gatewayURL},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Provision{Status: ProvisionCreated, PaymentType: created}, nil
+	}
+
+	previous := existing.GatewayURL()
+	if !apply {
+		return &Provision{Status: ProvisionMismatch, PaymentType: existing, PreviousURL: previous}, nil
+	}
+
+	update := *existing
+	update.Config = &PaymentTypeConfig{URL: gatewayURL}
+	updated, err := c.UpdatePaymentType(ctx, origin, update)
+	if err != nil {
+		return nil, err
+	}
+	return &Provision{Status: ProvisionUpdated, PaymentType: updated, PreviousURL: previous}, nil
+}
+
+// findPaymentType looks for the integrated payment type that points at the
+// gateway, otherwise one with the same name or on the same host
+func findPaymentType(paymentTypes []PaymentType, name string, gatewayURL string) *PaymentType {
+	var byName, byHost *PaymentType
+	for i := range paymentTypes {
+		p := &paymentTypes[i]
+		if p.TypeID != PaymentTypeIntegrated {
+			continue
+		}
+
+		switch {
+		case p.GatewayURL() == gatewayURL:
+			return p
+		case byName == nil && strings.EqualFold(p.Name, name):
+			byName = p
+		case byHost == nil && sameHost(p.GatewayURL(), gatewayURL):
+			byHost = p
+		}
+	}
+
+	if byName != nil {
+		return byName
+	}
+	return byHost
+}
+
+func sameHost(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
@@ -0,0 +1,72 @@
+package vend_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+)
+
+const gatewayURL = "https://vend.shophumm.co.nz/"
+
+func TestProvisionCreatesPaymentType(t *testing.T) {
+	server, client := newClient(t)
+	ctx := context.Background()
+	server.AddPaymentType(vend.PaymentType{ID: "cash", Name: "Cash", TypeID: 1})
+
+	provision, err := vend.ProvisionPaymentType(ctx, client, server.URL, "humm", gatewayURL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provision.Status != vend.ProvisionMissing || len(server.PaymentTypes()) != 1 {
+		t.Fatalf("expected checking to report the payment type missing, got %+v", provision)
+	}
+
+	provision, err = vend.ProvisionPaymentType(ctx, client, server.URL, "humm", gatewayURL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provision.Status != vend.ProvisionCreated || provision.PaymentType.GatewayURL() != gatewayURL {
+		t.Fatalf("unexpected provision %+v", provision)
+	}
+
+	// running it again changes nothing
+	provision, err = vend.ProvisionPaymentType(ctx, client, server.URL, "humm", gatewayURL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provision.Status != vend.ProvisionOK || len(server.PaymentTypes()) != 2 {
+		t.Errorf("expected the payment type to be found, got %+v", provision)
+	}
+}
+
+func TestProvisionUpdatesPaymentType(t *testing.T) {
+	server, client := newClient(t)
+	ctx := context.Background()
+	server.AddPaymentType(vend.PaymentType{
+		ID:     "pt1",
+		Name:   "Humm",
+		TypeID: vend.PaymentTypeIntegrated,
+		Config: &vend.PaymentTypeConfig{URL: "https://old.example.com/"},
+	})
+
+	provision, err := vend.ProvisionPaymentType(ctx, client, server.URL, "humm", gatewayURL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provision.Status != vend.ProvisionMismatch || provision.PreviousURL != "https://old.example.com/" {
+		t.Fatalf("expected a mismatch, got %+v", provision)
+	}
+
+	provision, err = vend.ProvisionPaymentType(ctx, client, server.URL, "humm", gatewayURL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provision.Status != vend.ProvisionUpdated || provision.PaymentType.ID != "pt1" {
+		t.Fatalf("expected the payment type to be updated, got %+v", provision)
+	}
+
+	if got := server.PaymentTypes()[0].GatewayURL(); got != gatewayURL {
+		t.Errorf("expected the payment type to point at %s, got %s", gatewayURL, got)
+	}
+}
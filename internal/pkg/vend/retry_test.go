@@ -0,0 +1,26 @@
+package vend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2018, 11, 5, 14, 30, 0, 0, time.UTC)
+
+	tests := map[string]time.Duration{
+		"":   time.Second,
+		"5":  5 * time.Second,
+		"-1": 0,
+		now.Add(10 * time.Second).Format(http.TimeFormat): 10 * time.Second,
+		now.Add(-time.Minute).Format(time.RFC3339):        0,
+		"soon": time.Second,
+	}
+
+	for value, expected := range tests {
+		if got := retryAfter(value, now); got != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package vend
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/secret"
+)
+
+// RefreshMargin is how long before the access token expires that we refresh it
+const RefreshMargin = 5 * time.Minute
+
+// TokenStore keeps the tokens for each retailer in the database, encrypted,
+// and refreshes them before they expire. It is a TokenSource
+type TokenStore struct {
+	Db    *sql.DB
+	box   *secret.Box
+	oauth *OAuthConfig
+
+	// refreshing one token per retailer at a time stops two requests racing
+	// to use the same refresh token, without one slow refresh holding up the
+	// other retailers
+	mu         sync.Mutex
+	refreshing map[string]*sync.Mutex
+}
+
+// NewTokenStore returns a store that encrypts the tokens with the box
+func NewTokenStore(db *sql.DB, box *secret.Box, oauth *OAuthConfig) *TokenStore {
+	return &TokenStore{
+		Db:    db,
+		box:   box,
+		oauth: oauth,
+	}
+}
+
+// Save stores the token for the retailer, replacing any existing token
+func (s *TokenStore) Save(token *Token) error {
+	accessToken, err := s.box.Seal(token.AccessToken)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := s.box.Seal(token.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	var expiry sql.NullTime
+	if !token.Expiry.IsZero() {
+		expiry = sql.NullTime{Time: token.Expiry, Valid: true}
+	}
+
+	query := `INSERT INTO
+		vend_oauth_token
+		(
+			origin_domain,
+			domain_prefix,
+			access_token,
+			refresh_token,
+			expires_date
+		) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			domain_prefix = VALUES(domain_prefix),
+			access_token = VALUES(access_token),
+			refresh_token = VALUES(refresh_token),
+			expires_date = VALUES(expires_date),
+			modified_date = CURRENT_TIMESTAMP`
+
+	_, err = s.Db.Exec(query,
+		normaliseOrigin(token.Origin),
+		token.DomainPrefix,
+		accessToken,
+		refreshToken,
+		expiry,
+	)
+	return err
+}
+
+// Get returns the stored token for the origin, or ErrNoToken
+func (s *TokenStore) Get(origin string) (*Token, error) {
+	query := `SELECT
+			origin_domain,
+			domain_prefix,
+			access_token,
+			refresh_token,
+			expires_date
+		FROM
+			vend_oauth_token
+		WHERE
+			origin_domain = ?`
+
+	token := new(Token)
+	var accessToken, refreshToken string
+	var expiry sql.NullTime
+
+	err := s.Db.QueryRow(query, normaliseOrigin(origin)).Scan(
+		&token.Origin,
+		&token.DomainPrefix,
+		&accessToken,
+		&refreshToken,
+		&expiry,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken, err = s.box.Open(accessToken); err != nil {
+		return nil, err
+	}
+	if token.RefreshToken, err = s.box.Open(refreshToken); err != nil {
+		return nil, err
+	}
+	token.Expiry = expiry.Time
+
+	return token, nil
+}
+
+// Delete removes the token for the origin, disconnecting the retailer
+func (s *TokenStore) Delete(origin string) error {
+	_, err := s.Db.Exec("DELETE FROM vend_oauth_token WHERE origin_domain = ?", normaliseOrigin(origin))
+	return err
+}
+
+// Token returns a current access token for the origin, refreshing it first
+// if it is about to expire
+func (s *TokenStore) Token(ctx context.Context, origin string) (string, error) {
+	token, err := s.Get(origin)
+	if err != nil {
+		return "", err
+	}
+
+	if !needsRefresh(token, time.Now()) {
+		return token.AccessToken, nil
+	}
+
+	lock := s.refreshLock(origin)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// another request may have refreshed it while we waited
+	token, err = s.Get(origin)
+	if err != nil {
+		return "", err
+	}
+	if !needsRefresh(token, time.Now()) {
+		return token.AccessToken, nil
+	}
+
+	refreshed, err := s.oauth.Refresh(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.Save(refreshed); err != nil {
+		return "", err
+	}
+	return refreshed.AccessToken, nil
+}
+
+// refreshLock returns the lock held while the token for the origin is
+// refreshed
+func (s *TokenStore) refreshLock(origin string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	origin = normaliseOrigin(origin)
+	if s.refreshing == nil {
+		s.refreshing = make(map[string]*sync.Mutex)
+	}
+	lock, ok := s.refreshing[origin]
+	if !ok {
+		lock = new(sync.Mutex)
+		s.refreshing[origin] = lock
+	}
+	return lock
+}
+
+// needsRefresh returns true if the token expires within the refresh margin
+func needsRefresh(token *Token, now time.Time) bool {
+	if token.Expiry.IsZero() || token.RefreshToken == "" {
+		return false
+	}
+	return token.Expiry.Sub(now) < RefreshMargin
+}
@@ -0,0 +1,55 @@
+package vend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNeedsRefresh(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		token    Token
+		expected bool
+	}{
+		{"no expiry", Token{RefreshToken: "r"}, false},
+		{"expires later", Token{RefreshToken: "r", Expiry: now.Add(time.Hour)}, false},
+		{"about to expire", Token{RefreshToken: "r", Expiry: now.Add(time.Minute)}, true},
+		{"expired", Token{RefreshToken: "r", Expiry: now.Add(-time.Minute)}, true},
+		{"no refresh token", Token{Expiry: now.Add(-time.Minute)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := needsRefresh(&tt.token, now); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestRefreshLockIsPerOrigin(t *testing.T) {
+	s := new(TokenStore)
+
+	example := s.refreshLock("https://example.vendhq.com")
+	if s.refreshLock("https://example.vendhq.com/") != example {
+		t.Error("expected the same lock for the same origin")
+	}
+
+	// a slow refresh for one retailer doesn't hold up another
+	example.Lock()
+	defer example.Unlock()
+
+	locked := make(chan struct{})
+	go func() {
+		other := s.refreshLock("https://other.vendhq.com")
+		other.Lock()
+		other.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("expected another origin's lock to be free")
+	}
+}
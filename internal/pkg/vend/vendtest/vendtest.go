@@ -0,0 +1,305 @@
+// Package vendtest provides a fake Vend API for tests
+package vendtest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+)
+
+// Server is a fake Vend API. Its URL is used as the retailer's origin
+type Server struct {
+	*httptest.Server
+
+	// Token is the access token the server accepts
+	Token string
+
+	// PageSize overrides the page size asked for by the client
+	PageSize int
+
+	// The OAuth application and the code and refresh token the token
+	// endpoint accepts. Granted tokens expire after ExpiresIn seconds
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RefreshToken string
+	ExpiresIn    int64
+
+	mu           sync.Mutex
+	registers    map[string]vend.Register
+	outlets      map[string]vend.Outlet
+	sales        map[string]vend.Sale
+	paymentTypes []vend.PaymentType
+	rateLimited  int
+	requests     int
+}
+
+// NewServer starts a fake Vend API that accepts the token
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:        token,
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		Code:         "code",
+		RefreshToken: "refresh-token",
+		ExpiresIn:    3600,
+		registers:    make(map[string]vend.Register),
+		outlets:      make(map[string]vend.Outlet),
+		sales:        make(map[string]vend.Sale),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Tokens returns a TokenSource for the server
+func (s *Server) Tokens() vend.StaticTokens {
+	return vend.StaticTokens{s.URL: s.Token}
+}
+
+// AddRegister adds a register
+func (s *Server) AddRegister(register vend.Register) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registers[register.ID] = register
+}
+
+// AddOutlet adds an outlet
+func (s *Server) AddOutlet(outlet vend.Outlet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outlets[outlet.ID] = outlet
+}
+
+// AddSale adds a sale
+func (s *Server) AddSale(sale vend.Sale) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sales[sale.ID] = sale
+}
+
+// AddPaymentType adds a payment type
+func (s *Server) AddPaymentType(paymentType vend.PaymentType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paymentTypes = append(s.paymentTypes, paymentType)
+}
+
+// PaymentTypes returns the payment types the retailer has
+func (s *Server) PaymentTypes() []vend.PaymentType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]vend.PaymentType(nil), s.paymentTypes...)
+}
+
+// RateLimit makes the next n requests fail with 429 Too Many Requests
+func (s *Server) RateLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited = n
+}
+
+// Requests returns the number of requests the server has received
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+
+	if r.URL.Path == "/api/1.0/token" {
+		s.serveToken(w, r)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+s.Token {
+		http.Error(w, `{"error":"invalid token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if s.rateLimited > 0 {
+		s.rateLimited--
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, `{"error":"rate limit exceeded"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/2.0/")
+	parts := strings.SplitN(path, "/", 2)
+
+	var (
+		data  interface{}
+		found bool
+	)
+
+	switch {
+	case len(parts) == 2 && parts[0] == "registers":
+		data, found = s.registers[parts[1]]
+	case len(parts) == 2 && parts[0] == "outlets":
+		data, found = s.outlets[parts[1]]
+	case len(parts) == 2 && parts[0] == "sales":
+		data, found = s.sales[parts[1]]
+	case len(parts) == 1 && parts[0] == "payment_types" && r.Method == http.MethodPost:
+		s.createPaymentType(w, r)
+		return
+	case len(parts) == 2 && parts[0] == "payment_types" && r.Method == http.MethodPut:
+		s.updatePaymentType(w, r, parts[1])
+		return
+	case len(parts) == 1 && parts[0] == "payment_types":
+		items := make([]interface{}, len(s.paymentTypes))
+		for i := range s.paymentTypes {
+			items[i] = s.paymentTypes[i]
+		}
+		s.writePage(w, r, items)
+		return
+	case len(parts) == 1 && parts[0] == "registers":
+		var items []interface{}
+		for _, register := range s.registers {
+			items = append(items, register)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].(vend.Register).ID < items[j].(vend.Register).ID })
+		s.writePage(w, r, items)
+		return
+	case len(parts) == 1 && parts[0] == "outlets":
+		var items []interface{}
+		for _, outlet := range s.outlets {
+			items = append(items, outlet)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].(vend.Outlet).ID < items[j].(vend.Outlet).ID })
+		s.writePage(w, r, items)
+		return
+	}
+
+	if !found {
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"data": data})
+}
+
+func (s *Server) createPaymentType(w http.ResponseWriter, r *http.Request) {
+	var paymentType vend.PaymentType
+	if err := json.NewDecoder(r.Body).Decode(&paymentType); err != nil {
+		http.Error(w, `{"error":"invalid payment type"}`, http.StatusBadRequest)
+		return
+	}
+
+	paymentType.ID = "pt" + strconv.Itoa(len(s.paymentTypes)+1)
+	s.paymentTypes = append(s.paymentTypes, paymentType)
+	writeJSON(w, map[string]interface{}{"data": paymentType})
+}
+
+func (s *Server) updatePaymentType(w http.ResponseWriter, r *http.Request, id string) {
+	var paymentType vend.PaymentType
+	if err := json.NewDecoder(r.Body).Decode(&paymentType); err != nil {
+		http.Error(w, `{"error":"invalid payment type"}`, http.StatusBadRequest)
+		return
+	}
+
+	for i := range s.paymentTypes {
+		if s.paymentTypes[i].ID == id {
+			paymentType.ID = id
+			s.paymentTypes[i] = paymentType
+			writeJSON(w, map[string]interface{}{"data": paymentType})
+			return
+		}
+	}
+	http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+}
+
+// serveToken implements the token endpoint of the OAuth flow
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	if r.Form.Get("client_id") != s.ClientID || r.Form.Get("client_secret") != s.ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		if r.Form.Get("code") != s.Code {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+	case "refresh_token":
+		if r.Form.Get("refresh_token") != s.RefreshToken {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"access_token":  s.Token,
+		"refresh_token": s.RefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    s.ExpiresIn,
+	})
+}
+
+// writePage pages through the items using their position as the version, the
+// way Vend pages collections
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []interface{}) {
+	after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+	size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if s.PageSize > 0 {
+		size = s.PageSize
+	}
+	if size <= 0 {
+		size = len(items)
+	}
+
+	page := []interface{}{}
+	start := after
+	end := after
+	for end < len(items) && len(page) < size {
+		page = append(page, items[end])
+		end++
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"data":    page,
+		"version": map[string]int{"min": start + 1, "max": end},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// NewWebhook returns a webhook request signed with the secret, the way Vend
+// sends them
+func NewWebhook(secret string, webhookType string, domainPrefix string, payload interface{}) *http.Request {
+	data, _ := json.Marshal(payload)
+	body := url.Values{
+		"type":          {webhookType},
+		"domain_prefix": {domainPrefix},
+		"payload":       {string(data)},
+	}.Encode()
+
+	r := httptest.NewRequest(http.MethodPost, "/vend/webhook", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Signature", "signature="+hex.EncodeToString(vend.Sign([]byte(body), secret))+", algorithm=HMAC-SHA256")
+	return r
+}
@@ -0,0 +1,124 @@
+package vend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WebhookSaleUpdate is sent whenever a sale is created or changed
+const WebhookSaleUpdate = "sale.update"
+
+// SaleStatusVoided is the status of a sale that has been voided
+const SaleStatusVoided = "VOIDED"
+
+// SaleStatusClosed is the status of a sale that has been paid in full
+const SaleStatusClosed = "CLOSED"
+
+// MaxWebhookSize is the largest webhook body we will read
+const MaxWebhookSize = 1 << 20
+
+// ErrInvalidSignature is returned when a webhook isn't signed by Vend
+var ErrInvalidSignature = errors.New("vend: webhook signature does not match")
+
+// Webhook is a notification from Vend about a change in a retailer's store
+type Webhook struct {
+	Type         string
+	DomainPrefix string
+	Payload      json.RawMessage
+}
+
+// Origin returns the Vend origin of the retailer the webhook is for
+func (w *Webhook) Origin() string {
+	return OriginForDomainPrefix(w.DomainPrefix)
+}
+
+// Sale decodes the payload of a sale.update webhook
+func (w *Webhook) Sale() (*WebhookSale, error) {
+	sale := new(WebhookSale)
+	if err := json.Unmarshal(w.Payload, sale); err != nil {
+		return nil, fmt.Errorf("vend: invalid sale payload: %s", err)
+	}
+	return sale, nil
+}
+
+// WebhookSale is the sale sent with sale.update
+type WebhookSale struct {
+	ID         string `json:"id"`
+	RegisterID string `json:"register_id"`
+	Status     string `json:"status"`
+
+	// ReturnFor is the ID of the original sale when this sale is a return
+	ReturnFor string `json:"return_for"`
+}
+
+// ParseWebhook reads a webhook from the request, checking it was signed by
+// Vend with the client secret of the application
+func ParseWebhook(r *http.Request, secret string) (*Webhook, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MaxWebhookSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if !validSignature(r.Header.Get("X-Signature"), body, secret) {
+		return nil, ErrInvalidSignature
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("vend: invalid webhook body: %s", err)
+	}
+
+	hook := &Webhook{
+		Type:         form.Get("type"),
+		DomainPrefix: form.Get("domain_prefix"),
+		Payload:      json.RawMessage(form.Get("payload")),
+	}
+
+	if !domainPrefix.MatchString(hook.DomainPrefix) {
+		return nil, fmt.Errorf("vend: invalid domain prefix %q", hook.DomainPrefix)
+	}
+	return hook, nil
+}
+
+// validSignature checks the X-Signature header, which looks like
+// signature=<hex>, algorithm=HMAC-SHA256
+func validSignature(header string, body []byte, secret string) bool {
+	var signature, algorithm string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "signature":
+			signature = kv[1]
+		case "algorithm":
+			algorithm = kv[1]
+		}
+	}
+
+	if algorithm != "HMAC-SHA256" || secret == "" {
+		return false
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, Sign(body, secret))
+}
+
+// Sign returns the signature Vend sends with a webhook body
+func Sign(body []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
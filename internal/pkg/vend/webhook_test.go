@@ -0,0 +1,53 @@
+package vend_test
+
+import (
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/vend/vendtest"
+)
+
+func TestParseWebhook(t *testing.T) {
+	r := vendtest.NewWebhook("client-secret", vend.WebhookSaleUpdate, "example", map[string]string{
+		"id":          "s1",
+		"register_id": "r1",
+		"status":      vend.SaleStatusVoided,
+	})
+
+	hook, err := vend.ParseWebhook(r, "client-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hook.Type != vend.WebhookSaleUpdate || hook.Origin() != "https://example.vendhq.com" {
+		t.Errorf("unexpected webhook %+v", hook)
+	}
+
+	sale, err := hook.Sale()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sale.ID != "s1" || sale.RegisterID != "r1" || sale.Status != vend.SaleStatusVoided {
+		t.Errorf("unexpected sale %+v", sale)
+	}
+}
+
+func TestParseWebhookChecksSignature(t *testing.T) {
+	r := vendtest.NewWebhook("someone-else", vend.WebhookSaleUpdate, "example", map[string]string{"id": "s1"})
+	if _, err := vend.ParseWebhook(r, "client-secret"); err != vend.ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	r = vendtest.NewWebhook("client-secret", vend.WebhookSaleUpdate, "example", map[string]string{"id": "s1"})
+	r.Header.Del("X-Signature")
+	if _, err := vend.ParseWebhook(r, "client-secret"); err != vend.ErrInvalidSignature {
+		t.Errorf("expected unsigned webhooks to be rejected, got %v", err)
+	}
+}
+
+func TestParseWebhookChecksDomainPrefix(t *testing.T) {
+	r := vendtest.NewWebhook("client-secret", vend.WebhookSaleUpdate, "evil.com/", map[string]string{"id": "s1"})
+	if _, err := vend.ParseWebhook(r, "client-secret"); err == nil {
+		t.Error("expected an invalid domain prefix to be rejected")
+	}
+}
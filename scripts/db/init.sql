@@ -10,16 +10,22 @@ create table oxipay_vend_map (
     fxl_device_signing_key varchar(255) COMMENT 'i.e Device specific signing key allocated by CreateKey',
     origin_domain varchar(255) NOT NULL COMMENT 'Vend origin provided in the initial request',
     vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    vend_outlet_id varchar(255) COMMENT 'Outlet ID from Vend, when known',
+    locale varchar(16) COMMENT 'i.e en-NZ, empty to use the browser language',
+    needs_rekey tinyint(1) NOT NULL DEFAULT 0 COMMENT '1 when the register must be re-keyed before taking payments',
     created_date datetime DEFAULT CURRENT_TIMESTAMP,
     created_by text NOT NULL ,
     modified_date datetime,
     modified_by text,
+    deleted_date datetime COMMENT 'when the register was unpaired',
+    deleted_by text,
+    active tinyint(1) AS (IF(deleted_date IS NULL, 1, NULL)) STORED COMMENT '1 until the register is unpaired, NULL after so it can be paired again',
     primary key(id)
      
 ) engine=InnoDB;
 
 CREATE OR REPLACE UNIQUE INDEX unique_registration USING HASH
-ON oxipay_vend_map (vend_register_id, fxl_seller_id, origin_domain);
+ON oxipay_vend_map (vend_register_id, fxl_seller_id, origin_domain, active);
 
 -- insert test records
 
@@ -48,3 +54,77 @@ CREATE TABLE sessions (
     expires_on TIMESTAMP DEFAULT NOW(),
      PRIMARY KEY(`id`)
  ) engine=InnoDB, COMMENT = 'This stores http sessions and is required by the session store handler';
+
+DROP TABLE IF EXISTS `oxipay_vend_transaction`;
+CREATE TABLE oxipay_vend_transaction (
+    id int NOT NULL auto_increment,
+    transaction_id varchar(32) NOT NULL COMMENT 'Proxy transaction ID sent to Vend as transaction_id',
+    type varchar(16) NOT NULL COMMENT 'payment or refund',
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin provided in the initial request',
+    vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    vend_sale_id varchar(255) COMMENT 'Client sale ID from Vend',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    fxl_purchase_number varchar(255) COMMENT 'Purchase number returned by oxipay/ezi-pay',
+    amount bigint NOT NULL COMMENT 'In cents, negative for refunds',
+    status varchar(16) NOT NULL,
+    response_code varchar(16),
+    vend_sale_status varchar(32) COMMENT 'i.e VOIDED when the sale was voided in Vend after it was paid',
+    void_refund_date datetime COMMENT 'when the payment was refunded because its sale was voided in Vend',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_transaction
+ON oxipay_vend_transaction (transaction_id);
+
+CREATE INDEX transaction_purchase_number ON oxipay_vend_transaction (fxl_purchase_number);
+CREATE INDEX transaction_sale ON oxipay_vend_transaction (vend_sale_id);
+CREATE INDEX transaction_created ON oxipay_vend_transaction (created_date);
+
+DROP TABLE IF EXISTS `vend_oauth_token`;
+CREATE TABLE vend_oauth_token (
+    id int NOT NULL auto_increment,
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin, the same as oxipay_vend_map',
+    domain_prefix varchar(255) NOT NULL COMMENT 'i.e example for example.vendhq.com',
+    access_token text NOT NULL COMMENT 'AES-GCM encrypted',
+    refresh_token text NOT NULL COMMENT 'AES-GCM encrypted',
+    expires_date datetime,
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_vend_oauth_origin
+ON vend_oauth_token (origin_domain);
+
+DROP TABLE IF EXISTS `oxipay_vend_key_history`;
+CREATE TABLE oxipay_vend_key_history (
+    id int NOT NULL auto_increment,
+    fxl_register_id varchar(255) NOT NULL COMMENT 'i.e oxipay/ezi-pay Device ID',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    fxl_device_signing_key varchar(255) COMMENT 'the key that was replaced',
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin, the same as oxipay_vend_map',
+    vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP COMMENT 'when the key was replaced',
+    created_by text NOT NULL,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE INDEX key_history_register ON oxipay_vend_key_history (origin_domain, vend_register_id);
+
+DROP TABLE IF EXISTS `oxipay_vend_outlet`;
+CREATE TABLE oxipay_vend_outlet (
+    id int NOT NULL auto_increment,
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin, the same as oxipay_vend_map',
+    vend_outlet_id varchar(255) NOT NULL COMMENT 'Unique Outlet ID from Vend',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    created_by text NOT NULL,
+    modified_date datetime,
+    modified_by text,
+    primary key(id)
+) engine=InnoDB;
+
+CREATE OR REPLACE UNIQUE INDEX unique_vend_outlet
+ON oxipay_vend_outlet (origin_domain, vend_outlet_id);